@@ -0,0 +1,543 @@
+package main
+
+/*
+ * Annotations and disputes of measurements.
+ * Measurements are never modified. Organizations append annotations to a measurement with a
+ * reason code instead:
+ *	suspect:		the reading looks wrong to the annotating organization
+ *	invalidated_by_owner:	the owner of the measurement declares it invalid
+ *	confirmed_by_owner:	the owner stands by the reading
+ *	confirmed_by_reference:	a valid reading of a reference station at most five minutes apart and
+ *				5 km away backs it
+ *	dispute_withdrawn:	the organization which raised a dispute has withdrawn it
+ * An organization which doubts a reading of a device of another organization opens a dispute.
+ * The owner of the measurement resolves it by invalidating the reading or upholding it, the
+ * raising organization may withdraw it. An invalidated reading cannot be upheld. Every step appends an annotation.
+ *
+ * Invalidated measurements are indexed as invalidated~measurementId. Rich queries,
+ * getMeasurementRecords and getMeasurementsInBoundingBox can leave them out, compliance reports,
+ * zone aggregates and latest readings always do. Invalidating removes the reading from the sum
+ * and count of its daily aggregate and from the covered hours, unless other readings were taken
+ * in the same hour. The minimum and maximum stay unchanged. An invalidated latest reading is
+ * removed, the next measurement of the device takes its place.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	annotationKey  = "annotation~measurementId~txId"
+	disputeKey     = "dispute~measurementId~txId"
+	invalidatedKey = "invalidated~measurementId"
+	// in meters, public locations of private devices are coarsened to a geohash cell of about 5 km
+	maxReferenceDistance = 5000
+)
+
+// annotation reason codes
+const (
+	reasonSuspect              = "suspect"
+	reasonInvalidatedByOwner   = "invalidated_by_owner"
+	reasonConfirmedByOwner     = "confirmed_by_owner"
+	reasonConfirmedByReference = "confirmed_by_reference"
+	reasonDisputeWithdrawn     = "dispute_withdrawn"
+)
+
+// dispute states
+const (
+	disputeOpen        = "open"
+	disputeInvalidated = "invalidated"
+	disputeUpheld      = "upheld"
+	disputeWithdrawn   = "withdrawn"
+)
+
+// Define the annotation structure
+type Annotation struct {
+	Id                     string    `json:"id"`
+	MeasurementId          string    `json:"measurementId"`
+	DeviceId               string    `json:"deviceId"`
+	Reason                 string    `json:"reason"`
+	Comment                string    `json:"comment,omitempty"`
+	ReferenceMeasurementId string    `json:"referenceMeasurementId,omitempty"`
+	DisputeId              string    `json:"disputeId,omitempty"`
+	CreatedBy              string    `json:"createdBy"`
+	CreatedAt              time.Time `json:"createdAt"`
+}
+
+// Define the dispute structure, raised against the organization owning the measurement
+type Dispute struct {
+	Id            string    `json:"id"`
+	MeasurementId string    `json:"measurementId"`
+	DeviceId      string    `json:"deviceId"`
+	Owner         string    `json:"owner"`
+	RaisedBy      string    `json:"raisedBy"`
+	Comment       string    `json:"comment,omitempty"`
+	Status        string    `json:"status"`
+	OpenedAt      time.Time `json:"openedAt"`
+	ClosedBy      string    `json:"closedBy,omitempty"`
+	ClosedAt      time.Time `json:"closedAt"`
+}
+
+// Define the measurement annotations structure, returned by getAnnotations
+type MeasurementAnnotations struct {
+	MeasurementId string       `json:"measurementId"`
+	Invalidated   bool         `json:"invalidated"`
+	Annotations   []Annotation `json:"annotations"`
+	Disputes      []Dispute    `json:"disputes"`
+}
+
+// returns the measurement and the owner it is attributed to
+func getMeasurement(APIstub shim.ChaincodeStubInterface, measurementId string) (SensorData, string, error) {
+	dataAsBytes, err := APIstub.GetState(measurementId)
+	if err != nil {
+		return SensorData{}, "", err
+	}
+	data := SensorData{}
+	if dataAsBytes == nil || json.Unmarshal(dataAsBytes, &data) != nil || data.DeviceId == "" {
+		return SensorData{}, "", errors.New("Measurement " + measurementId + " does not exist")
+	}
+	device, err := getDevice(APIstub, data.DeviceId)
+	if err != nil {
+		return SensorData{}, "", err
+	}
+	return data, measurementOwner(data, device), nil
+}
+
+// checks whether the measurement has been invalidated by its owner
+func isInvalidated(APIstub shim.ChaincodeStubInterface, measurementId string) (bool, error) {
+	key, err := APIstub.CreateCompositeKey(invalidatedKey, []string{measurementId})
+	if err != nil {
+		return false, err
+	}
+	invalidatedAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return false, err
+	}
+	return invalidatedAsBytes != nil, nil
+}
+
+// returns the records without invalidated measurements
+func filterInvalidated(APIstub shim.ChaincodeStubInterface, records []queryRecord) ([]queryRecord, error) {
+	valid := []queryRecord{}
+	for _, record := range records {
+		invalidated, err := isInvalidated(APIstub, record.Key)
+		if err != nil {
+			return nil, err
+		}
+		if !invalidated {
+			valid = append(valid, record)
+		}
+	}
+	return valid, nil
+}
+
+// parses the optional trailing argument of query functions, true to leave out invalidated measurements
+func parseExcludeInvalidated(args []string, index int) (bool, error) {
+	if len(args) <= index {
+		return false, nil
+	}
+	switch args[index] {
+	case "true":
+		return true, nil
+	case "false", "":
+		return false, nil
+	}
+	return false, errors.New("Invalid flag " + args[index] + ". Expecting true or false")
+}
+
+// checks the reference measurement is a reading of a reference station close in time to the measurement
+func validateReferenceMeasurement(APIstub shim.ChaincodeStubInterface, data SensorData, referenceMeasurementId string) error {
+	reference, _, err := getMeasurement(APIstub, referenceMeasurementId)
+	if err != nil {
+		return err
+	}
+	if !reference.Reference {
+		return errors.New("Measurement " + referenceMeasurementId + " is not a reading of a reference station")
+	}
+	distance := data.TSdevice.Sub(reference.TSdevice)
+	if distance < 0 {
+		distance = -distance
+	}
+	if distance > coLocationPairingWindow {
+		return errors.New("Measurement " + referenceMeasurementId + " was not taken within five minutes of the measurement")
+	}
+	if haversineDistance(data.Lat, data.Lon, reference.Lat, reference.Lon) > maxReferenceDistance {
+		return errors.New("Measurement " + referenceMeasurementId + " was not taken within 5 km of the measurement")
+	}
+	invalidated, err := isInvalidated(APIstub, referenceMeasurementId)
+	if err != nil {
+		return err
+	}
+	if invalidated {
+		return errors.New("Measurement " + referenceMeasurementId + " has been invalidated")
+	}
+	return nil
+}
+
+// appends an annotation to the measurement under the transaction ID
+func putAnnotation(APIstub shim.ChaincodeStubInterface, annotation Annotation) (Annotation, error) {
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return Annotation{}, err
+	}
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return Annotation{}, err
+	}
+	annotation.Id = APIstub.GetTxID()
+	annotation.CreatedBy = mspId
+	annotation.CreatedAt = txTime
+	key, err := APIstub.CreateCompositeKey(annotationKey, []string{annotation.MeasurementId, annotation.Id})
+	if err != nil {
+		return Annotation{}, err
+	}
+	annotationAsBytes, _ := json.Marshal(annotation)
+	return annotation, APIstub.PutState(key, annotationAsBytes)
+}
+
+// marks the measurement as invalidated and removes it from its daily aggregate and the latest readings
+func invalidateMeasurement(APIstub shim.ChaincodeStubInterface, measurementId string, data SensorData) error {
+	key, err := APIstub.CreateCompositeKey(invalidatedKey, []string{measurementId})
+	if err != nil {
+		return err
+	}
+	if err := APIstub.PutState(key, []byte{0x00}); err != nil {
+		return err
+	}
+	latest, latestKey, err := getLatestReading(APIstub, data.DeviceId)
+	if err != nil {
+		return err
+	}
+	if latest != nil && latest.MeasurementId == measurementId {
+		if err := APIstub.DelState(latestKey); err != nil {
+			return err
+		}
+	}
+	aggregateKey, err := APIstub.CreateCompositeKey(dailyAggregateKey, []string{data.DeviceId, data.TSdevice.UTC().Format(dailyDateLayout)})
+	if err != nil {
+		return err
+	}
+	aggregateAsBytes, err := APIstub.GetState(aggregateKey)
+	if err != nil || aggregateAsBytes == nil {
+		return err
+	}
+	aggregate := DailyAggregate{}
+	if err := json.Unmarshal(aggregateAsBytes, &aggregate); err != nil {
+		return err
+	}
+	aggregate.remove(data)
+	aggregateAsBytes, _ = json.Marshal(aggregate)
+	return APIstub.PutState(aggregateKey, aggregateAsBytes)
+}
+
+// returns the annotations of the measurement in the order they were added
+func getAnnotations(APIstub shim.ChaincodeStubInterface, measurementId string) ([]Annotation, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(annotationKey, []string{measurementId})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	annotations := []Annotation{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		annotation := Annotation{}
+		if json.Unmarshal(queryResponse.Value, &annotation) != nil {
+			continue
+		}
+		annotations = append(annotations, annotation)
+	}
+	sort.SliceStable(annotations, func(i, j int) bool {
+		return annotations[i].CreatedAt.Before(annotations[j].CreatedAt)
+	})
+	return annotations, nil
+}
+
+// returns the disputes of the measurement, or of all measurements if measurementId is empty
+func getDisputes(APIstub shim.ChaincodeStubInterface, measurementId string) ([]Dispute, error) {
+	attributes := []string{}
+	if measurementId != "" {
+		attributes = append(attributes, measurementId)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(disputeKey, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	disputes := []Dispute{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		dispute := Dispute{}
+		if json.Unmarshal(queryResponse.Value, &dispute) != nil {
+			continue
+		}
+		disputes = append(disputes, dispute)
+	}
+	sort.SliceStable(disputes, func(i, j int) bool {
+		return disputes[i].OpenedAt.Before(disputes[j].OpenedAt)
+	})
+	return disputes, nil
+}
+
+/*
+ * Expects measurementId, reason, comment and for confirmed_by_reference the ID of the reference
+ * measurement. Any organization may mark a reading as suspect or confirm it by a reference
+ * station, only the owner of the measurement may invalidate or confirm it itself.
+ */
+func (s *SmartContract) annotateMeasurement(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+	data, owner, err := getMeasurement(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	annotation := Annotation{MeasurementId: args[0], DeviceId: data.DeviceId, Reason: args[1], Comment: args[2]}
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	switch args[1] {
+	case reasonSuspect:
+	case reasonInvalidatedByOwner, reasonConfirmedByOwner:
+		if mspId != ownerMSPID(owner) {
+			return shim.Error("Only the owner of measurement " + args[0] + " may annotate it with " + args[1])
+		}
+	case reasonConfirmedByReference:
+		if len(args) != 4 {
+			return shim.Error("Expecting the ID of the reference measurement")
+		}
+		if err := validateReferenceMeasurement(APIstub, data, args[3]); err != nil {
+			return shim.Error(err.Error())
+		}
+		annotation.ReferenceMeasurementId = args[3]
+	default:
+		return shim.Error("Invalid reason " + args[1] + ". Expecting suspect, invalidated_by_owner, confirmed_by_owner or confirmed_by_reference")
+	}
+	if args[1] == reasonInvalidatedByOwner {
+		invalidated, err := isInvalidated(APIstub, args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if invalidated {
+			return shim.Error("Measurement " + args[0] + " has already been invalidated")
+		}
+		if err := invalidateMeasurement(APIstub, args[0], data); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	annotation, err = putAnnotation(APIstub, annotation)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	annotationAsBytes, _ := json.Marshal(annotation)
+	fmt.Printf("- annotateMeasurement:\n%s\n", annotationAsBytes)
+	return shim.Success(annotationAsBytes)
+}
+
+// expects measurementId and a comment, raises a dispute against the owner of the measurement
+func (s *SmartContract) openDispute(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	data, owner, err := getMeasurement(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if mspId == ownerMSPID(owner) {
+		return shim.Error("The owner of measurement " + args[0] + " cannot dispute it, it may invalidate it instead")
+	}
+	invalidated, err := isInvalidated(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if invalidated {
+		return shim.Error("Measurement " + args[0] + " has already been invalidated")
+	}
+	disputes, err := getDisputes(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, dispute := range disputes {
+		if dispute.Status == disputeOpen && dispute.RaisedBy == mspId {
+			return shim.Error("There is already an open dispute " + dispute.Id + " of measurement " + args[0])
+		}
+	}
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	dispute := Dispute{Id: APIstub.GetTxID(), MeasurementId: args[0], DeviceId: data.DeviceId, Owner: owner, RaisedBy: mspId, Comment: args[1], Status: disputeOpen, OpenedAt: txTime}
+	key, err := APIstub.CreateCompositeKey(disputeKey, []string{dispute.MeasurementId, dispute.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	disputeAsBytes, _ := json.Marshal(dispute)
+	if err := APIstub.PutState(key, disputeAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	if _, err := putAnnotation(APIstub, Annotation{MeasurementId: args[0], DeviceId: data.DeviceId, Reason: reasonSuspect, Comment: args[1], DisputeId: dispute.Id}); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- openDispute:\n%s\n", disputeAsBytes)
+	return shim.Success(disputeAsBytes)
+}
+
+/*
+ * Expects measurementId, disputeId, the resolution, a comment and optionally the ID of a
+ * reference measurement backing the reading. The owner of the measurement resolves the dispute
+ * as invalidated or upheld, the raising organization may withdraw it.
+ */
+func (s *SmartContract) resolveDispute(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 4 && len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 or 5")
+	}
+	data, _, err := getMeasurement(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key, err := APIstub.CreateCompositeKey(disputeKey, []string{args[0], args[1]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	disputeAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if disputeAsBytes == nil {
+		return shim.Error("Dispute " + args[1] + " of measurement " + args[0] + " does not exist")
+	}
+	dispute := Dispute{}
+	json.Unmarshal(disputeAsBytes, &dispute)
+	if dispute.Status != disputeOpen {
+		return shim.Error("Dispute " + args[1] + " has already been closed")
+	}
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	annotation := Annotation{MeasurementId: args[0], DeviceId: data.DeviceId, Comment: args[3], DisputeId: dispute.Id}
+	switch args[2] {
+	case disputeInvalidated, disputeUpheld:
+		if mspId != ownerMSPID(dispute.Owner) {
+			return shim.Error("Only the owner of measurement " + args[0] + " may resolve the dispute as " + args[2])
+		}
+	case disputeWithdrawn:
+		if mspId != dispute.RaisedBy {
+			return shim.Error("Only " + dispute.RaisedBy + " may withdraw the dispute")
+		}
+	default:
+		return shim.Error("Invalid resolution " + args[2] + ". Expecting invalidated, upheld or withdrawn")
+	}
+	if len(args) == 5 && args[2] != disputeUpheld {
+		return shim.Error("Only an upheld reading may refer to a reference measurement")
+	}
+	switch args[2] {
+	case disputeInvalidated:
+		annotation.Reason = reasonInvalidatedByOwner
+		invalidated, err := isInvalidated(APIstub, args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !invalidated {
+			if err := invalidateMeasurement(APIstub, args[0], data); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	case disputeUpheld:
+		annotation.Reason = reasonConfirmedByOwner
+		invalidated, err := isInvalidated(APIstub, args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if invalidated {
+			return shim.Error("Measurement " + args[0] + " has already been invalidated and cannot be upheld")
+		}
+		if len(args) == 5 {
+			if err := validateReferenceMeasurement(APIstub, data, args[4]); err != nil {
+				return shim.Error(err.Error())
+			}
+			annotation.Reason = reasonConfirmedByReference
+			annotation.ReferenceMeasurementId = args[4]
+		}
+	case disputeWithdrawn:
+		annotation.Reason = reasonDisputeWithdrawn
+	}
+
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	dispute.Status = args[2]
+	dispute.ClosedBy = mspId
+	dispute.ClosedAt = txTime
+	disputeAsBytes, _ = json.Marshal(dispute)
+	if err := APIstub.PutState(key, disputeAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	if _, err := putAnnotation(APIstub, annotation); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- resolveDispute:\n%s\n", disputeAsBytes)
+	return shim.Success(disputeAsBytes)
+}
+
+// expects measurementId, returns its annotations, disputes and whether it has been invalidated
+func (s *SmartContract) getAnnotations(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	result := MeasurementAnnotations{MeasurementId: args[0]}
+	var err error
+	if result.Invalidated, err = isInvalidated(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+	if result.Annotations, err = getAnnotations(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+	if result.Disputes, err = getDisputes(APIstub, args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+	resultAsBytes, _ := json.Marshal(result)
+	return shim.Success(resultAsBytes)
+}
+
+// expects an optional owner, returns the open disputes against the measurements of the owner or of all owners
+func (s *SmartContract) getOpenDisputes(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting at most 1")
+	}
+	disputes, err := getDisputes(APIstub, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	open := []Dispute{}
+	for _, dispute := range disputes {
+		if dispute.Status == disputeOpen && (len(args) == 0 || args[0] == "" || dispute.Owner == args[0]) {
+			open = append(open, dispute)
+		}
+	}
+	openAsBytes, _ := json.Marshal(open)
+	fmt.Printf("- getOpenDisputes:\n%s\n", openAsBytes)
+	return shim.Success(openAsBytes)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExcludeInvalidated(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected bool
+		valid    bool
+	}{
+		{[]string{"a", "b"}, false, true},
+		{[]string{"a", "b", "true"}, true, true},
+		{[]string{"a", "b", "false"}, false, true},
+		{[]string{"a", "b", "yes"}, false, false},
+	}
+	for _, test := range tests {
+		exclude, err := parseExcludeInvalidated(test.args, 2)
+		if exclude != test.expected || (err == nil) != test.valid {
+			t.Errorf("Flag of %v was incorrect, got: %v %v", test.args, exclude, err)
+		}
+	}
+}
+
+func TestDisputes(t *testing.T) {
+	stub := newTestStub()
+	priv1 := registerTestDevice(stub, 1, "org1")
+	priv2 := registerTestDevice(stub, 2, "org2")
+	stub.setCaller("Org2MSP", "Admin@org2.example.com")
+	if response := stub.invoke("tx1", [][]byte{[]byte("setDeviceClass"), []byte("DEVICE2"), []byte("reference")}); response.Message != "" {
+		t.Fatalf("setDeviceClass failed: %s", response.Message)
+	}
+
+	ts := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	measurementId := "8017480121707248c4601288a1543101"
+	referenceId := "8017480121707248c4601288a1543102"
+	if response := stub.invoke("m1", buildTestMeasurement(priv1, 1, 1, 200, ts, "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	if response := stub.invoke("m2", buildTestMeasurement(priv2, 2, 2, 190, ts.Add(time.Minute), "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+
+	stub.setCaller("Org2MSP", "User1@org2.example.com")
+	if response := stub.invoke("a1", [][]byte{[]byte("annotateMeasurement"), []byte(measurementId), []byte("invalidated_by_owner"), []byte("")}); response.Message != "Only the owner of measurement "+measurementId+" may annotate it with invalidated_by_owner" {
+		t.Errorf("Expected another organization not to invalidate the measurement, got: %s", response.Message)
+	}
+	if response := stub.invoke("a2", [][]byte{[]byte("annotateMeasurement"), []byte(measurementId), []byte("wrong"), []byte("")}); response.Message == "" {
+		t.Errorf("Expected an unknown reason to be rejected")
+	}
+	if response := stub.invoke("a3", [][]byte{[]byte("annotateMeasurement"), []byte(measurementId), []byte("confirmed_by_reference"), []byte(""), []byte(measurementId)}); response.Message == "" {
+		t.Errorf("Expected a measurement of a low-cost sensor not to confirm a reading")
+	}
+	if response := stub.invoke("d1", [][]byte{[]byte("openDispute"), []byte(measurementId), []byte("20 µg/m³ above the neighbourhood")}); response.Message != "" {
+		t.Fatalf("openDispute failed: %s", response.Message)
+	}
+	if response := stub.invoke("d2", [][]byte{[]byte("openDispute"), []byte(measurementId), []byte("again")}); response.Message != "There is already an open dispute d1 of measurement "+measurementId {
+		t.Errorf("Expected a second open dispute to be rejected, got: %s", response.Message)
+	}
+	if response := stub.invoke("d3", [][]byte{[]byte("resolveDispute"), []byte(measurementId), []byte("d1"), []byte("upheld"), []byte("")}); response.Message == "" {
+		t.Errorf("Expected the raising organization not to uphold the reading")
+	}
+	response := stub.invoke("q1", [][]byte{[]byte("getOpenDisputes"), []byte("org1")})
+	disputes := []Dispute{}
+	json.Unmarshal(response.Payload, &disputes)
+	if len(disputes) != 1 || disputes[0].Id != "d1" || disputes[0].RaisedBy != "Org2MSP" {
+		t.Errorf("Open disputes were incorrect, got: %s", response.Payload)
+	}
+
+	stub.setCaller("Org1MSP", "User1@org1.example.com")
+	if response := stub.invoke("d4", [][]byte{[]byte("openDispute"), []byte(measurementId), []byte("")}); response.Message == "" {
+		t.Errorf("Expected the owner not to dispute its own measurement")
+	}
+	if response := stub.invoke("d5", [][]byte{[]byte("resolveDispute"), []byte(measurementId), []byte("d1"), []byte("upheld"), []byte("matches the reference station"), []byte(referenceId)}); response.Message != "" {
+		t.Fatalf("resolveDispute failed: %s", response.Message)
+	}
+	if response := stub.invoke("d6", [][]byte{[]byte("resolveDispute"), []byte(measurementId), []byte("d1"), []byte("invalidated"), []byte("")}); response.Message != "Dispute d1 has already been closed" {
+		t.Errorf("Expected a closed dispute not to be resolved again, got: %s", response.Message)
+	}
+
+	stub.setCaller("Org2MSP", "User1@org2.example.com")
+	if response := stub.invoke("d7", [][]byte{[]byte("openDispute"), []byte(measurementId), []byte("still too high")}); response.Message != "" {
+		t.Fatalf("openDispute failed: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "User1@org1.example.com")
+	if response := stub.invoke("d8", [][]byte{[]byte("resolveDispute"), []byte(measurementId), []byte("d7"), []byte("withdrawn"), []byte("")}); response.Message != "Only Org2MSP may withdraw the dispute" {
+		t.Errorf("Expected the owner not to withdraw the dispute, got: %s", response.Message)
+	}
+	if response := stub.invoke("d9", [][]byte{[]byte("resolveDispute"), []byte(measurementId), []byte("d7"), []byte("invalidated"), []byte("inlet blocked")}); response.Message != "" {
+		t.Fatalf("resolveDispute failed: %s", response.Message)
+	}
+
+	response = stub.invoke("q2", [][]byte{[]byte("getAnnotations"), []byte(measurementId)})
+	annotations := MeasurementAnnotations{}
+	json.Unmarshal(response.Payload, &annotations)
+	reasons := []string{}
+	for _, annotation := range annotations.Annotations {
+		reasons = append(reasons, annotation.Reason)
+	}
+	expected := []string{reasonSuspect, reasonConfirmedByReference, reasonSuspect, reasonInvalidatedByOwner}
+	if !annotations.Invalidated || len(annotations.Disputes) != 2 || annotations.Disputes[1].Status != disputeInvalidated || len(reasons) != len(expected) {
+		t.Fatalf("Annotations were incorrect, got: %s", response.Payload)
+	}
+	for i := range expected {
+		if reasons[i] != expected[i] {
+			t.Errorf("Annotation %d was incorrect, got: %s, want: %s", i, reasons[i], expected[i])
+		}
+	}
+	if annotations.Annotations[1].ReferenceMeasurementId != referenceId || annotations.Annotations[3].DisputeId != "d7" || annotations.Annotations[3].CreatedBy != "Org1MSP" {
+		t.Errorf("Annotation details were incorrect, got: %s", response.Payload)
+	}
+	data := SensorData{}
+	json.Unmarshal(stub.State[measurementId], &data)
+	if data.Pm10 != 20 {
+		t.Errorf("Expected the measurement to stay unchanged, got: %+v", data)
+	}
+
+	aggregateKey, _ := stub.CreateCompositeKey(dailyAggregateKey, []string{"DEVICE1", ts.Format(dailyDateLayout)})
+	aggregate := DailyAggregate{}
+	json.Unmarshal(stub.State[aggregateKey], &aggregate)
+	if aggregate.Quantities[quantityPm10] == nil || aggregate.Quantities[quantityPm10].Count != 0 || aggregate.Quantities[quantityPm10].Sum != 0 || aggregate.Hours != 0 || aggregate.HourlyCounts[ts.Hour()] != 0 {
+		t.Errorf("Expected the invalidated measurement to be removed from the daily aggregate, got: %s", stub.State[aggregateKey])
+	}
+
+	response = stub.invoke("q3", [][]byte{[]byte("getMeasurementsInBoundingBox"), []byte("48.9"), []byte("8.3"), []byte("49.1"), []byte("8.5"), []byte(""), []byte(""), []byte("true")})
+	records := []struct {
+		Key string
+	}{}
+	json.Unmarshal(response.Payload, &records)
+	if len(records) != 1 || records[0].Key != referenceId {
+		t.Errorf("Expected only the valid measurement, got: %s %s", response.Message, response.Payload)
+	}
+	response = stub.invoke("q4", [][]byte{[]byte("getMeasurementsInBoundingBox"), []byte("48.9"), []byte("8.3"), []byte("49.1"), []byte("8.5"), []byte(""), []byte("")})
+	json.Unmarshal(response.Payload, &records)
+	if len(records) != 2 {
+		t.Errorf("Expected both measurements without the filter, got: %s", response.Payload)
+	}
+	response = stub.invoke("q5", [][]byte{[]byte("getMeasurementRecords"), []byte("true")})
+	if strings.Contains(string(response.Payload), `"Key":"`+measurementId+`"`) || !strings.Contains(string(response.Payload), `"Key":"`+referenceId+`"`) {
+		t.Errorf("Expected only the valid measurement record, got: %s %s", response.Message, response.Payload)
+	}
+
+	latestKey, _ := stub.CreateCompositeKey(latestReadingKey, []string{"DEVICE1"})
+	if stub.State[latestKey] != nil {
+		t.Errorf("Expected the invalidated latest reading to be removed, got: %s", stub.State[latestKey])
+	}
+	response = stub.invoke("q6", [][]byte{[]byte("getLatestReadings")})
+	readings := []LatestReading{}
+	json.Unmarshal(response.Payload, &readings)
+	if len(readings) != 1 || readings[0].MeasurementId != referenceId {
+		t.Errorf("Expected only the valid latest reading, got: %s", response.Payload)
+	}
+}
+
+func TestReferenceMeasurementChecks(t *testing.T) {
+	stub := newTestStub()
+	priv1 := registerTestDevice(stub, 1, "org1")
+	priv2 := registerTestDevice(stub, 2, "org2")
+	stub.setCaller("Org2MSP", "Admin@org2.example.com")
+	if response := stub.invoke("tx1", [][]byte{[]byte("setDeviceClass"), []byte("DEVICE2"), []byte("reference")}); response.Message != "" {
+		t.Fatalf("setDeviceClass failed: %s", response.Message)
+	}
+
+	ts := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	measurementId := "8017480121707248c4601288a1543101"
+	farReferenceId := "8017480121707248c4601288a1543102"
+	invalidReferenceId := "8017480121707248c4601288a1543103"
+	if response := stub.invoke("m1", buildTestMeasurement(priv1, 1, 1, 200, ts, "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	// Berlin, about 520 km away
+	if response := stub.invoke("m2", buildTestMeasurement(priv2, 2, 2, 190, ts.Add(time.Minute), "0523100000N", "00132400000E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	if response := stub.invoke("m3", buildTestMeasurement(priv2, 2, 3, 190, ts.Add(2*time.Minute), "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	if response := stub.invoke("a1", [][]byte{[]byte("annotateMeasurement"), []byte(invalidReferenceId), []byte("invalidated_by_owner"), []byte("calibration run")}); response.Message != "" {
+		t.Fatalf("annotateMeasurement failed: %s", response.Message)
+	}
+
+	if response := stub.invoke("a2", [][]byte{[]byte("annotateMeasurement"), []byte(measurementId), []byte("confirmed_by_reference"), []byte(""), []byte(farReferenceId)}); response.Message != "Measurement "+farReferenceId+" was not taken within 5 km of the measurement" {
+		t.Errorf("Expected a distant reference station to be rejected, got: %s", response.Message)
+	}
+	if response := stub.invoke("a3", [][]byte{[]byte("annotateMeasurement"), []byte(measurementId), []byte("confirmed_by_reference"), []byte(""), []byte(invalidReferenceId)}); response.Message != "Measurement "+invalidReferenceId+" has been invalidated" {
+		t.Errorf("Expected an invalidated reference reading to be rejected, got: %s", response.Message)
+	}
+
+	if response := stub.invoke("d1", [][]byte{[]byte("openDispute"), []byte(measurementId), []byte("too high")}); response.Message != "" {
+		t.Fatalf("openDispute failed: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "User1@org1.example.com")
+	if response := stub.invoke("a4", [][]byte{[]byte("annotateMeasurement"), []byte(measurementId), []byte("invalidated_by_owner"), []byte("inlet blocked")}); response.Message != "" {
+		t.Fatalf("annotateMeasurement failed: %s", response.Message)
+	}
+	if response := stub.invoke("d2", [][]byte{[]byte("resolveDispute"), []byte(measurementId), []byte("d1"), []byte("upheld"), []byte("")}); response.Message != "Measurement "+measurementId+" has already been invalidated and cannot be upheld" {
+		t.Errorf("Expected an invalidated measurement not to be upheld, got: %s", response.Message)
+	}
+	if response := stub.invoke("d3", [][]byte{[]byte("resolveDispute"), []byte(measurementId), []byte("d1"), []byte("invalidated"), []byte("")}); response.Message != "" {
+		t.Errorf("Expected the dispute of an invalidated measurement to be closed as invalidated, got: %s", response.Message)
+	}
+}
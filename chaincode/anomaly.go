@@ -0,0 +1,379 @@
+package main
+
+/*
+ * Ingestion-time anomaly detection.
+ * Every measurement is compared to the previous reading of its device:
+ *	flatline:	the value has not changed for at least flatlineMinutes
+ *	spike:		the value changed by spikeFactor or more, e.g. an order of magnitude,
+ *			unless both values are below spikeMinimum
+ *	rate:		the value changed faster than maxRatePerMinute
+ * The limits are configured per sensor model and quantity, devices without model use the
+ * default configuration. Only admins of the organization which configured a model first may
+ * change its limits. Anomalous measurements are stored nevertheless, with the anomaly flag
+ * set, their suspect channels flagged and an anomaly record for the device.
+ * Measurements older than the previous reading of the device are not checked.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	anomalyConfigKey = "anomalyConfig~model"
+	anomalyStateKey  = "anomalyState~deviceId"
+	anomalyRecordKey = "anomaly~deviceId~txId"
+)
+
+// model of devices without model
+const defaultSensorModel = "default"
+
+// anomaly checks
+const (
+	anomalyFlatline = "flatline"
+	anomalySpike    = "spike"
+	anomalyRate     = "rate"
+)
+
+// Define the anomaly limits structure, the limits of a quantity, zero disables a check
+type AnomalyLimits struct {
+	FlatlineMinutes  float64 `json:"flatlineMinutes,omitempty"`
+	SpikeFactor      float64 `json:"spikeFactor,omitempty"`
+	SpikeMinimum     float64 `json:"spikeMinimum,omitempty"`
+	MaxRatePerMinute float64 `json:"maxRatePerMinute,omitempty"`
+}
+
+// Define the anomaly configuration structure, the limits of a sensor model by quantity
+type AnomalyConfig struct {
+	Limits       map[string]AnomalyLimits `json:"limits"`
+	ConfiguredBy string                   `json:"configuredBy"` // organization whose admins may change the limits
+}
+
+// limits used for sensor models without configuration, tuned for the SDS011
+var defaultAnomalyLimits = map[string]AnomalyLimits{
+	quantityPm10: {FlatlineMinutes: 120, SpikeFactor: 10, SpikeMinimum: 10, MaxRatePerMinute: 50},
+	quantityPm25: {FlatlineMinutes: 120, SpikeFactor: 10, SpikeMinimum: 10, MaxRatePerMinute: 50},
+}
+
+// Define the quantity state structure, the previous reading of a quantity and how long it has not changed
+type QuantityState struct {
+	Value     float64   `json:"value"`
+	TSdevice  time.Time `json:"tsdevice"`
+	RunStart  time.Time `json:"runStart"`
+	RunLength int       `json:"runLength"`
+}
+
+// Define the anomaly finding structure, one failed check
+type AnomalyFinding struct {
+	Check     string  `json:"check"`
+	Quantity  string  `json:"quantity"`
+	Value     float64 `json:"value"`
+	Reference float64 `json:"reference"`
+	Limit     float64 `json:"limit"`
+}
+
+// Define the anomaly record structure, the findings of a measurement
+type AnomalyRecord struct {
+	DeviceId      string           `json:"deviceId"`
+	MeasurementId string           `json:"measurementId"`
+	Model         string           `json:"model"`
+	TSdevice      time.Time        `json:"tsdevice"`
+	DetectedAt    time.Time        `json:"detectedAt"`
+	Findings      []AnomalyFinding `json:"findings"`
+}
+
+// returns the sensor model of the device
+func sensorModel(device DeviceInfo) string {
+	if device.Model == "" {
+		return defaultSensorModel
+	}
+	return device.Model
+}
+
+// returns the limits configured for the sensor model, the default limits if there are none
+func getAnomalyLimits(APIstub shim.ChaincodeStubInterface, model string) (map[string]AnomalyLimits, error) {
+	config, err := getAnomalyConfig(APIstub, model)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil && model != defaultSensorModel {
+		return getAnomalyLimits(APIstub, defaultSensorModel)
+	}
+	if config == nil {
+		return defaultAnomalyLimits, nil
+	}
+	return config.Limits, nil
+}
+
+// returns the configuration of the sensor model, nil if it has not been configured
+func getAnomalyConfig(APIstub shim.ChaincodeStubInterface, model string) (*AnomalyConfig, error) {
+	configKey, err := APIstub.CreateCompositeKey(anomalyConfigKey, []string{model})
+	if err != nil {
+		return nil, err
+	}
+	configAsBytes, err := APIstub.GetState(configKey)
+	if err != nil {
+		return nil, err
+	}
+	if configAsBytes == nil {
+		return nil, nil
+	}
+	config := AnomalyConfig{}
+	if err := json.Unmarshal(configAsBytes, &config); err != nil {
+		return nil, err
+	}
+	// configurations written before the configuring organization was recorded hold the limits only
+	if config.Limits == nil {
+		if err := json.Unmarshal(configAsBytes, &config.Limits); err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// checks the value against the previous reading of the quantity and returns the findings and the new state
+func checkQuantity(quantity string, value float64, ts time.Time, previous *QuantityState, limits AnomalyLimits) ([]AnomalyFinding, QuantityState) {
+	state := QuantityState{Value: value, TSdevice: ts, RunStart: ts, RunLength: 1}
+	findings := []AnomalyFinding{}
+	if previous == nil {
+		return findings, state
+	}
+	if value == previous.Value {
+		state.RunStart = previous.RunStart
+		state.RunLength = previous.RunLength + 1
+		// a flatline needs at least three readings
+		if limits.FlatlineMinutes > 0 && state.RunLength >= 3 && ts.Sub(state.RunStart).Minutes() >= limits.FlatlineMinutes {
+			findings = append(findings, AnomalyFinding{Check: anomalyFlatline, Quantity: quantity, Value: value, Reference: ts.Sub(state.RunStart).Minutes(), Limit: limits.FlatlineMinutes})
+		}
+	}
+	if limits.SpikeFactor > 0 && math.Max(value, previous.Value) >= limits.SpikeMinimum {
+		if value >= previous.Value*limits.SpikeFactor || value*limits.SpikeFactor <= previous.Value {
+			findings = append(findings, AnomalyFinding{Check: anomalySpike, Quantity: quantity, Value: value, Reference: previous.Value, Limit: limits.SpikeFactor})
+		}
+	}
+	if minutes := ts.Sub(previous.TSdevice).Minutes(); limits.MaxRatePerMinute > 0 && minutes > 0 {
+		if rate := math.Abs(value-previous.Value) / minutes; rate > limits.MaxRatePerMinute {
+			findings = append(findings, AnomalyFinding{Check: anomalyRate, Quantity: quantity, Value: value, Reference: previous.Value, Limit: limits.MaxRatePerMinute})
+		}
+	}
+	return findings, state
+}
+
+// checks the measurement against the previous reading of the device
+// sets the anomaly flag and writes an anomaly record if any check fails
+func detectAnomalies(APIstub shim.ChaincodeStubInterface, txId string, data *SensorData, device DeviceInfo) error {
+	model := sensorModel(device)
+	limits, err := getAnomalyLimits(APIstub, model)
+	if err != nil {
+		return err
+	}
+	stateKey, err := APIstub.CreateCompositeKey(anomalyStateKey, []string{data.DeviceId})
+	if err != nil {
+		return err
+	}
+	stateAsBytes, err := APIstub.GetState(stateKey)
+	if err != nil {
+		return err
+	}
+	states := map[string]QuantityState{}
+	if stateAsBytes != nil {
+		if err := json.Unmarshal(stateAsBytes, &states); err != nil {
+			return err
+		}
+	}
+
+	findings := []AnomalyFinding{}
+	for _, channel := range measurementChannels(*data) {
+		quantityLimits, ok := limits[channel.Quantity]
+		if !ok {
+			continue
+		}
+		var previous *QuantityState
+		if state, ok := states[channel.Quantity]; ok {
+			if !data.TSdevice.After(state.TSdevice) {
+				continue
+			}
+			previous = &state
+		}
+		quantityFindings, state := checkQuantity(channel.Quantity, channel.Value, data.TSdevice, previous, quantityLimits)
+		findings = append(findings, quantityFindings...)
+		states[channel.Quantity] = state
+	}
+	stateAsBytes, _ = json.Marshal(states)
+	if err := APIstub.PutState(stateKey, stateAsBytes); err != nil {
+		return err
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+
+	data.Anomaly = true
+	for i, channel := range data.Channels {
+		for _, finding := range findings {
+			if finding.Quantity == channel.Quantity && channel.QualityFlag == qualityFlags[0] {
+				data.Channels[i].QualityFlag = "suspect"
+			}
+		}
+	}
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return err
+	}
+	recordKey, err := APIstub.CreateCompositeKey(anomalyRecordKey, []string{data.DeviceId, txId})
+	if err != nil {
+		return err
+	}
+	record := AnomalyRecord{DeviceId: data.DeviceId, MeasurementId: txId, Model: model, TSdevice: data.TSdevice, DetectedAt: txTime, Findings: findings}
+	recordAsBytes, _ := json.Marshal(record)
+	fmt.Printf("- detectAnomalies:\n%s\n", recordAsBytes)
+	return APIstub.PutState(recordKey, recordAsBytes)
+}
+
+// parses the limits of a sensor model, e.g. {"pm10":{"flatlineMinutes":120,"spikeFactor":10}}
+func parseAnomalyLimits(str string) (map[string]AnomalyLimits, error) {
+	limits := map[string]AnomalyLimits{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(str)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&limits); err != nil {
+		return nil, fmt.Errorf("Invalid anomaly limits: %s", err)
+	}
+	for quantity, quantityLimits := range limits {
+		if _, ok := quantityByName(quantity); !ok {
+			return nil, errors.New("Unknown quantity " + quantity)
+		}
+		if quantityLimits.FlatlineMinutes < 0 || quantityLimits.SpikeMinimum < 0 || quantityLimits.MaxRatePerMinute < 0 {
+			return nil, errors.New("Anomaly limits of " + quantity + " must not be negative")
+		}
+		if quantityLimits.SpikeFactor != 0 && quantityLimits.SpikeFactor <= 1 {
+			return nil, errors.New("Spike factor of " + quantity + " must be greater than 1")
+		}
+	}
+	return limits, nil
+}
+
+// expects the sensor model (default for devices without model) and its limits as JSON, only admins may configure limits
+// and only admins of the organization which configured the model first may change them
+func (s *SmartContract) setAnomalyLimits(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	admin, err := isClientAdmin(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !admin {
+		return shim.Error("Only admins may configure anomaly limits")
+	}
+	if args[0] == "" {
+		return shim.Error("Sensor model must not be empty")
+	}
+	limits, err := parseAnomalyLimits(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	existing, err := getAnomalyConfig(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil && existing.ConfiguredBy != "" && existing.ConfiguredBy != mspId {
+		return shim.Error("Anomaly limits of " + args[0] + " were configured by " + existing.ConfiguredBy + ", only its admins may change them")
+	}
+	configKey, err := APIstub.CreateCompositeKey(anomalyConfigKey, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	configAsBytes, _ := json.Marshal(AnomalyConfig{Limits: limits, ConfiguredBy: mspId})
+	if err := APIstub.PutState(configKey, configAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- setAnomalyLimits:\n%s\n", configAsBytes)
+	return shim.Success(nil)
+}
+
+// expects the sensor model, returns its limits
+func (s *SmartContract) getAnomalyLimits(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	limits, err := getAnomalyLimits(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	limitsAsBytes, _ := json.Marshal(limits)
+	return shim.Success(limitsAsBytes)
+}
+
+// expects deviceId and the sensor model, only the owner of the device may set it
+func (s *SmartContract) setDeviceModel(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	deviceAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if deviceAsBytes == nil {
+		return shim.Error("Device " + args[0] + " does not exist")
+	}
+	device := DeviceInfo{}
+	json.Unmarshal(deviceAsBytes, &device)
+	owner, err := isDeviceOwner(APIstub, device)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !owner {
+		return shim.Error("Only the owner of " + args[0] + " may set its sensor model")
+	}
+	mspId, _ := getClientMSPID(APIstub)
+	device.Model = args[1]
+	device.UpdatedBy = mspId
+	deviceAsBytes, _ = json.Marshal(device)
+	if err := APIstub.PutState(args[0], deviceAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// expects deviceId, returns the anomaly records of the device ordered by device timestamp
+func (s *SmartContract) getAnomalies(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(anomalyRecordKey, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	records := []AnomalyRecord{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		record := AnomalyRecord{}
+		if json.Unmarshal(queryResponse.Value, &record) != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].TSdevice.Before(records[j].TSdevice)
+	})
+
+	recordsAsBytes, _ := json.Marshal(records)
+	fmt.Printf("- getAnomalies:\n%s\n", recordsAsBytes)
+	return shim.Success(recordsAsBytes)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckQuantity(t *testing.T) {
+	limits := defaultAnomalyLimits[quantityPm10]
+	start := time.Date(2019, 7, 6, 10, 0, 0, 0, time.UTC)
+
+	// the same value every 30 minutes, flagged once it has not changed for two hours
+	var previous *QuantityState
+	for i := 0; i <= 5; i++ {
+		findings, state := checkQuantity(quantityPm10, 12.3, start.Add(time.Duration(i)*30*time.Minute), previous, limits)
+		flatline := len(findings) == 1 && findings[0].Check == anomalyFlatline
+		if flatline != (i >= 4) {
+			t.Errorf("Flatline after %d readings was incorrect, got: %+v", i+1, findings)
+		}
+		previous = &state
+	}
+
+	tests := []struct {
+		previous float64
+		value    float64
+		minutes  float64
+		expected []string
+	}{
+		{20, 25, 5, []string{}},
+		{2, 25, 5, []string{anomalySpike}},
+		{250, 20, 5, []string{anomalySpike}},
+		// both below the spike minimum
+		{0.5, 8, 5, []string{}},
+		{20, 140, 1, []string{anomalyRate}},
+		{20, 300, 1, []string{anomalySpike, anomalyRate}},
+	}
+	for _, test := range tests {
+		state := &QuantityState{Value: test.previous, TSdevice: start, RunStart: start, RunLength: 1}
+		findings, _ := checkQuantity(quantityPm10, test.value, start.Add(time.Duration(test.minutes*float64(time.Minute))), state, limits)
+		checks := []string{}
+		for _, finding := range findings {
+			checks = append(checks, finding.Check)
+		}
+		if !reflect.DeepEqual(checks, test.expected) {
+			t.Errorf("Checks of %g after %g were incorrect, got: %v, want: %v", test.value, test.previous, checks, test.expected)
+		}
+	}
+}
+
+func TestAnomalyDetection(t *testing.T) {
+	stub := newTestStub()
+	priv := registerTestDevice(stub, 1, "org1")
+
+	response := stub.invoke("tx1", [][]byte{[]byte("setAnomalyLimits"), []byte("SDS011"), []byte(`{"pm10":{"spikeFactor":5,"spikeMinimum":5}}`)})
+	if response.Message != "Only admins may configure anomaly limits" {
+		t.Errorf("Expected a non-admin to be rejected, got: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "Admin@org1.example.com")
+	response = stub.invoke("tx2", [][]byte{[]byte("setAnomalyLimits"), []byte("SDS011"), []byte(`{"pm10":{"spikeFactor":0.5}}`)})
+	if response.Message == "" {
+		t.Errorf("Expected a spike factor below 1 to be rejected")
+	}
+	response = stub.invoke("tx3", [][]byte{[]byte("setAnomalyLimits"), []byte("SDS011"), []byte(`{"pm10":{"spikeFactor":5,"spikeMinimum":5}}`)})
+	if response.Message != "" {
+		t.Fatalf("setAnomalyLimits failed: %s", response.Message)
+	}
+	stub.setCaller("Org2MSP", "Admin@org2.example.com")
+	response = stub.invoke("tx3b", [][]byte{[]byte("setAnomalyLimits"), []byte("SDS011"), []byte(`{"pm10":{"spikeFactor":100}}`)})
+	if response.Message != "Anomaly limits of SDS011 were configured by Org1MSP, only its admins may change them" {
+		t.Errorf("Expected an admin of another organization not to change the limits, got: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "User1@org1.example.com")
+	if response := stub.invoke("tx4", [][]byte{[]byte("setDeviceModel"), []byte("DEVICE1"), []byte("SDS011")}); response.Message != "" {
+		t.Fatalf("setDeviceModel failed: %s", response.Message)
+	}
+
+	ts := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	// 2.0, 3.0 and 16.0 µg/m³, the last one jumps by more than factor 5
+	for i, pm10 := range []byte{20, 30, 160} {
+		if response := stub.invoke("m"+strconv.Itoa(i), buildTestMeasurement(priv, 1, byte(i+1), pm10, ts.Add(time.Duration(i)*10*time.Minute), "0490033624N", "00082531116E")); response.Message != "" {
+			t.Fatalf("registerMeasurement %d failed: %s", i, response.Message)
+		}
+	}
+	for i, expected := range []bool{false, false, true} {
+		data := SensorData{}
+		json.Unmarshal(stub.State["8017480121707248c4601288a154310"+strconv.Itoa(i+1)], &data)
+		if data.Anomaly != expected || data.DeviceId != "DEVICE1" {
+			t.Errorf("Anomaly flag of measurement %d was incorrect, got: %+v", i, data)
+		}
+	}
+
+	response = stub.invoke("q1", [][]byte{[]byte("getAnomalies"), []byte("DEVICE1")})
+	records := []AnomalyRecord{}
+	json.Unmarshal(response.Payload, &records)
+	if len(records) != 1 || records[0].MeasurementId != "8017480121707248c4601288a1543103" || records[0].Model != "SDS011" || len(records[0].Findings) != 1 || records[0].Findings[0].Check != anomalySpike || records[0].Findings[0].Reference != 3 {
+		t.Errorf("Anomaly records were incorrect, got: %s", response.Payload)
+	}
+}
+
+func TestLegacyAnomalyConfig(t *testing.T) {
+	stub := newTestStub()
+	configKey, _ := stub.CreateCompositeKey(anomalyConfigKey, []string{"SDS011"})
+	stub.MockTransactionStart("setup")
+	stub.PutState(configKey, []byte(`{"pm10":{"spikeFactor":5,"spikeMinimum":5}}`))
+	stub.MockTransactionEnd("setup")
+
+	limits, err := getAnomalyLimits(stub, "SDS011")
+	if err != nil || limits[quantityPm10] != (AnomalyLimits{SpikeFactor: 5, SpikeMinimum: 5}) {
+		t.Errorf("Limits of the legacy configuration were incorrect, got: %v %v", limits, err)
+	}
+	stub.setCaller("Org2MSP", "Admin@org2.example.com")
+	if response := stub.invoke("tx1", [][]byte{[]byte("setAnomalyLimits"), []byte("SDS011"), []byte(`{"pm10":{"spikeFactor":8}}`)}); response.Message != "" {
+		t.Fatalf("setAnomalyLimits failed: %s", response.Message)
+	}
+	config, _ := getAnomalyConfig(stub, "SDS011")
+	if config == nil || config.ConfiguredBy != "Org2MSP" || config.Limits[quantityPm10].SpikeFactor != 8 {
+		t.Errorf("Expected the legacy configuration to be claimed, got: %+v", config)
+	}
+}
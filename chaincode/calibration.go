@@ -0,0 +1,472 @@
+package main
+
+/*
+ * Reference stations and calibration of low-cost sensors.
+ * Reference-grade stations are devices of the class reference, set by an admin of the owning
+ * organization. Low-cost sensors are calibrated against a reference station during a period in
+ * which both were co-located. The resulting factors are stored per device and quantity with a
+ * validity window:
+ *	calibrated = slope * raw + offset + humidityCoefficient * relative humidity
+ * registerMeasurement keeps the raw values in the measurement and adds the calibrated values of
+ * all quantities with a calibration valid at the device timestamp. Corrections with a humidity
+ * coefficient are only applied to measurements which report the humidity.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const calibrationKey = "calibration~deviceId~quantity~txId"
+
+// device classes, devices without class are low-cost sensors
+const deviceClassReference = "reference"
+
+const (
+	// maximum time between a reading of a sensor and the reference reading it is compared with
+	coLocationPairingWindow = 5 * time.Minute
+	minCoLocatedPairs       = 10
+)
+
+// Define the calibration structure, the correction of a quantity of a device within a validity window, open-ended if ValidTo is zero
+type Calibration struct {
+	Id                  string    `json:"id"`
+	DeviceId            string    `json:"deviceId"`
+	Quantity            string    `json:"quantity"`
+	Slope               float64   `json:"slope"`
+	Offset              float64   `json:"offset"`
+	HumidityCoefficient float64   `json:"humidityCoefficient"`
+	ValidFrom           time.Time `json:"validFrom"`
+	ValidTo             time.Time `json:"validTo"`
+	ReferenceDeviceId   string    `json:"referenceDeviceId"`
+	CoLocationFrom      time.Time `json:"coLocationFrom"`
+	CoLocationTo        time.Time `json:"coLocationTo"`
+	SetBy               string    `json:"setBy"`
+}
+
+// Define the calibrated value structure, a raw value and its calibration
+type CalibratedValue struct {
+	Quantity    string  `json:"quantity"`
+	Raw         float64 `json:"raw"`
+	Value       float64 `json:"value"`
+	Calibration string  `json:"calibration"`
+}
+
+// checks whether the calibration is valid at the given time, the window includes its start
+func (calibration Calibration) isValidAt(t time.Time) bool {
+	if t.Before(calibration.ValidFrom) {
+		return false
+	}
+	return calibration.ValidTo.IsZero() || t.Before(calibration.ValidTo)
+}
+
+// checks whether the validity windows of the calibrations overlap
+func (calibration Calibration) overlaps(other Calibration) bool {
+	startsBeforeOtherEnds := other.ValidTo.IsZero() || calibration.ValidFrom.Before(other.ValidTo)
+	endsAfterOtherStarts := calibration.ValidTo.IsZero() || calibration.ValidTo.After(other.ValidFrom)
+	return startsBeforeOtherEnds && endsAfterOtherStarts
+}
+
+// applies the calibration to the raw value
+func (calibration Calibration) apply(raw, humidity float64) float64 {
+	return calibration.Slope*raw + calibration.Offset + calibration.HumidityCoefficient*humidity
+}
+
+// returns the calibrations of the device, optionally restricted to a quantity
+func getCalibrations(APIstub shim.ChaincodeStubInterface, deviceId string, quantity string) ([]Calibration, error) {
+	attributes := []string{deviceId}
+	if quantity != "" {
+		attributes = append(attributes, quantity)
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(calibrationKey, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	calibrations := []Calibration{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		calibration := Calibration{}
+		if json.Unmarshal(queryResponse.Value, &calibration) != nil {
+			continue
+		}
+		calibrations = append(calibrations, calibration)
+	}
+	sort.SliceStable(calibrations, func(i, j int) bool {
+		return calibrations[i].ValidFrom.Before(calibrations[j].ValidFrom)
+	})
+	return calibrations, nil
+}
+
+// marks measurements of reference stations and adds the calibrated values of low-cost sensors
+func calibrateMeasurement(APIstub shim.ChaincodeStubInterface, data *SensorData, device DeviceInfo) error {
+	if device.Class == deviceClassReference {
+		data.Reference = true
+		return nil
+	}
+	calibrations, err := getCalibrations(APIstub, data.DeviceId, "")
+	if err != nil {
+		return err
+	}
+	if len(calibrations) == 0 {
+		return nil
+	}
+	channels := measurementChannels(*data)
+	humidity, hasHumidity := 0.0, false
+	for _, channel := range channels {
+		if channel.Quantity == quantityHumidity {
+			humidity, hasHumidity = channel.Value, true
+		}
+	}
+	for _, channel := range channels {
+		for _, calibration := range calibrations {
+			if calibration.Quantity != channel.Quantity || !calibration.isValidAt(data.TSdevice) {
+				continue
+			}
+			if calibration.HumidityCoefficient != 0 && !hasHumidity {
+				continue
+			}
+			value := calibration.apply(channel.Value, humidity)
+			data.Calibrated = append(data.Calibrated, CalibratedValue{Quantity: channel.Quantity, Raw: channel.Value, Value: value, Calibration: calibration.Id})
+		}
+	}
+	return nil
+}
+
+// Define the calibration request structure, a calibration whose factors are derived from the co-location period
+type CalibrationRequest struct {
+	Calibration
+	HumidityCorrection bool `json:"humidityCorrection"`
+}
+
+// Define the co-located pair structure, a reading of a sensor and the reference value at that time
+type coLocatedPair struct {
+	Raw       float64
+	Humidity  float64
+	Reference float64
+}
+
+// pairs each reading of the sensor with the closest reading of the reference station within
+// the pairing window, readings without the quantity or, for a humidity correction, sensor
+// readings without the humidity are skipped
+func pairCoLocatedReadings(sensor, reference []SensorData, quantity string, humidityCorrection bool) []coLocatedPair {
+	pairs := []coLocatedPair{}
+	for _, data := range sensor {
+		raw, ok := channelValue(data, quantity)
+		if !ok {
+			continue
+		}
+		humidity, ok := channelValue(data, quantityHumidity)
+		if humidityCorrection && !ok {
+			continue
+		}
+		best, found := time.Duration(0), false
+		value := 0.0
+		for _, other := range reference {
+			referenceValue, ok := channelValue(other, quantity)
+			if !ok {
+				continue
+			}
+			distance := data.TSdevice.Sub(other.TSdevice)
+			if distance < 0 {
+				distance = -distance
+			}
+			if distance <= coLocationPairingWindow && (!found || distance < best) {
+				best, found, value = distance, true, referenceValue
+			}
+		}
+		if found {
+			pairs = append(pairs, coLocatedPair{Raw: raw, Humidity: humidity, Reference: value})
+		}
+	}
+	return pairs
+}
+
+// returns the value of the quantity in the measurement
+func channelValue(data SensorData, quantity string) (float64, bool) {
+	for _, channel := range measurementChannels(data) {
+		if channel.Quantity == quantity && channel.QualityFlag != "invalid" {
+			return channel.Value, true
+		}
+	}
+	return 0, false
+}
+
+/*
+ * Fits reference = slope * raw + offset (+ humidityCoefficient * humidity) by least squares.
+ * The normal equations are solved by Gaussian elimination with partial pivoting.
+ */
+func fitCalibration(pairs []coLocatedPair, humidityCorrection bool) (float64, float64, float64, error) {
+	if len(pairs) < minCoLocatedPairs {
+		return 0, 0, 0, fmt.Errorf("Not enough co-located readings. Expecting at least %d, got %d", minCoLocatedPairs, len(pairs))
+	}
+	n := 2
+	if humidityCorrection {
+		n = 3
+	}
+	// augmented matrix of the normal equations for the terms raw, 1 and humidity
+	matrix := make([][]float64, n)
+	for i := range matrix {
+		matrix[i] = make([]float64, n+1)
+	}
+	for _, pair := range pairs {
+		terms := []float64{pair.Raw, 1, pair.Humidity}[:n]
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				matrix[i][j] += terms[i] * terms[j]
+			}
+			matrix[i][n] += terms[i] * pair.Reference
+		}
+	}
+	for column := 0; column < n; column++ {
+		pivot := column
+		for row := column + 1; row < n; row++ {
+			if math.Abs(matrix[row][column]) > math.Abs(matrix[pivot][column]) {
+				pivot = row
+			}
+		}
+		if math.Abs(matrix[pivot][column]) < 1e-9 {
+			return 0, 0, 0, errors.New("Co-located readings do not vary enough to derive a calibration")
+		}
+		matrix[column], matrix[pivot] = matrix[pivot], matrix[column]
+		for row := 0; row < n; row++ {
+			if row == column {
+				continue
+			}
+			factor := matrix[row][column] / matrix[column][column]
+			for k := column; k <= n; k++ {
+				matrix[row][k] -= factor * matrix[column][k]
+			}
+		}
+	}
+	solution := make([]float64, 3)
+	for i := 0; i < n; i++ {
+		solution[i] = matrix[i][n] / matrix[i][i]
+	}
+	return solution[0], solution[1], solution[2], nil
+}
+
+// returns the device, an error if it does not exist
+func getDevice(APIstub shim.ChaincodeStubInterface, deviceId string) (DeviceInfo, error) {
+	deviceAsBytes, err := APIstub.GetState(deviceId)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	if deviceAsBytes == nil {
+		return DeviceInfo{}, errors.New("Device " + deviceId + " does not exist")
+	}
+	device := DeviceInfo{}
+	if err := json.Unmarshal(deviceAsBytes, &device); err != nil {
+		return DeviceInfo{}, err
+	}
+	return device, nil
+}
+
+// expects deviceId and the class (reference, or empty for a low-cost sensor), only an admin of the owner may change it
+func (s *SmartContract) setDeviceClass(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if args[1] != "" && args[1] != deviceClassReference {
+		return shim.Error("Invalid device class " + args[1] + ". Expecting reference or an empty class")
+	}
+	device, err := getDevice(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	admin, err := isOrganizationAdmin(APIstub, device.Owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !admin {
+		return shim.Error("Only an admin of the owner of " + args[0] + " may change its device class")
+	}
+	mspId, _ := getClientMSPID(APIstub)
+	device.Class = args[1]
+	device.UpdatedBy = mspId
+	deviceAsBytes, _ := json.Marshal(device)
+	if err := APIstub.PutState(args[0], deviceAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// checks the calibration against the devices and the existing calibrations of the quantity
+func validateCalibration(APIstub shim.ChaincodeStubInterface, calibration Calibration) error {
+	if calibration.Quantity == quantityHumidity && calibration.HumidityCoefficient != 0 {
+		return errors.New("Humidity cannot be calibrated with a humidity correction")
+	}
+	if _, ok := quantityByName(calibration.Quantity); !ok {
+		return errors.New("Unknown quantity " + calibration.Quantity)
+	}
+	if calibration.Slope <= 0 {
+		return errors.New("Slope must be positive")
+	}
+	if calibration.ValidFrom.IsZero() || (!calibration.ValidTo.IsZero() && !calibration.ValidTo.After(calibration.ValidFrom)) {
+		return errors.New("Invalid validity window. Expecting validFrom and an optional later validTo")
+	}
+	if calibration.CoLocationFrom.IsZero() || !calibration.CoLocationTo.After(calibration.CoLocationFrom) {
+		return errors.New("Invalid co-location period. Expecting coLocationFrom before coLocationTo")
+	}
+
+	device, err := getDevice(APIstub, calibration.DeviceId)
+	if err != nil {
+		return err
+	}
+	owner, err := isDeviceOwner(APIstub, device)
+	if err != nil {
+		return err
+	}
+	if !owner {
+		return errors.New("Only the owner of " + calibration.DeviceId + " may calibrate it")
+	}
+	if device.Class == deviceClassReference {
+		return errors.New(calibration.DeviceId + " is a reference station")
+	}
+	reference, err := getDevice(APIstub, calibration.ReferenceDeviceId)
+	if err != nil {
+		return err
+	}
+	if reference.Class != deviceClassReference {
+		return errors.New(calibration.ReferenceDeviceId + " is not a reference station")
+	}
+
+	existing, err := getCalibrations(APIstub, calibration.DeviceId, calibration.Quantity)
+	if err != nil {
+		return err
+	}
+	for _, other := range existing {
+		if calibration.overlaps(other) {
+			return errors.New("Validity window overlaps calibration " + other.Id)
+		}
+	}
+	return nil
+}
+
+// validates and stores the calibration under the transaction ID, returns the stored calibration
+func putCalibration(APIstub shim.ChaincodeStubInterface, calibration Calibration) ([]byte, error) {
+	if err := validateCalibration(APIstub, calibration); err != nil {
+		return nil, err
+	}
+	mspId, _ := getClientMSPID(APIstub)
+	calibration.Id = APIstub.GetTxID()
+	calibration.SetBy = mspId
+	key, err := APIstub.CreateCompositeKey(calibrationKey, []string{calibration.DeviceId, calibration.Quantity, calibration.Id})
+	if err != nil {
+		return nil, err
+	}
+	calibrationAsBytes, _ := json.Marshal(calibration)
+	if err := APIstub.PutState(key, calibrationAsBytes); err != nil {
+		return nil, err
+	}
+	return calibrationAsBytes, nil
+}
+
+/*
+ * Expects the calibration as JSON object, e.g.
+ * {"deviceId":"DEVICE2","quantity":"pm25","slope":0.52,"offset":5.75,"humidityCoefficient":-0.086,
+ *  "validFrom":"2019-08-01T00:00:00Z","referenceDeviceId":"DEVICE1",
+ *  "coLocationFrom":"2019-07-01T00:00:00Z","coLocationTo":"2019-07-31T00:00:00Z"}
+ * validTo is optional. Only the owner of the device may calibrate it, the validity window must
+ * not overlap other calibrations of the quantity. Returns the calibration with its ID.
+ */
+func (s *SmartContract) addCalibration(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	calibration := Calibration{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(args[0])))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&calibration); err != nil {
+		return shim.Error("Invalid calibration: " + err.Error())
+	}
+	calibrationAsBytes, err := putCalibration(APIstub, calibration)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- addCalibration:\n%s\n", calibrationAsBytes)
+	return shim.Success(calibrationAsBytes)
+}
+
+/*
+ * Expects the calibration as JSON object like addCalibration, but without slope, offset and
+ * humidityCoefficient, and an optional "humidityCorrection":true. The factors are fitted by least
+ * squares to the readings of the device paired with those of the reference station during the
+ * co-location period. The readings are found by a rich query, which is not re-executed when the
+ * transaction is validated, so the calibration is only returned and not stored. It has to be
+ * evaluated as a query and its result submitted through addCalibration.
+ */
+func (s *SmartContract) deriveCalibration(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	request := CalibrationRequest{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(args[0])))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return shim.Error("Invalid calibration: " + err.Error())
+	}
+	if request.Slope != 0 || request.Offset != 0 || request.HumidityCoefficient != 0 {
+		return shim.Error("Factors are derived from the co-location period and cannot be given")
+	}
+	if request.CoLocationFrom.IsZero() || !request.CoLocationTo.After(request.CoLocationFrom) {
+		return shim.Error("Invalid co-location period. Expecting coLocationFrom before coLocationTo")
+	}
+	records, err := queryMeasurementRecords(APIstub, MeasurementQuery{
+		DeviceIds: []string{request.DeviceId, request.ReferenceDeviceId},
+		From:      request.CoLocationFrom.UTC().Format(time.RFC3339),
+		To:        request.CoLocationTo.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var sensor, reference []SensorData
+	for _, record := range records {
+		data := SensorData{}
+		if json.Unmarshal(record.Record, &data) != nil {
+			continue
+		}
+		if data.DeviceId == request.DeviceId {
+			sensor = append(sensor, data)
+		} else if data.DeviceId == request.ReferenceDeviceId {
+			reference = append(reference, data)
+		}
+	}
+	pairs := pairCoLocatedReadings(sensor, reference, request.Quantity, request.HumidityCorrection)
+	calibration := request.Calibration
+	calibration.Slope, calibration.Offset, calibration.HumidityCoefficient, err = fitCalibration(pairs, request.HumidityCorrection)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := validateCalibration(APIstub, calibration); err != nil {
+		return shim.Error(err.Error())
+	}
+	calibrationAsBytes, _ := json.Marshal(calibration)
+	fmt.Printf("- deriveCalibration:\n%s\n", calibrationAsBytes)
+	return shim.Success(calibrationAsBytes)
+}
+
+// expects deviceId, returns its calibrations ordered by the start of their validity
+func (s *SmartContract) getCalibrations(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	calibrations, err := getCalibrations(APIstub, args[0], "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	calibrationsAsBytes, _ := json.Marshal(calibrations)
+	return shim.Success(calibrationsAsBytes)
+}
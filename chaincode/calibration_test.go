@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFitCalibration(t *testing.T) {
+	pairs := []coLocatedPair{}
+	for i := 0; i < 20; i++ {
+		raw := float64(5 + 3*i)
+		humidity := float64(40 + (i*7)%50)
+		pairs = append(pairs, coLocatedPair{Raw: raw, Humidity: humidity, Reference: 0.52*raw + 5.75 - 0.086*humidity})
+	}
+	slope, offset, coefficient, err := fitCalibration(pairs, true)
+	if err != nil || math.Abs(slope-0.52) > 1e-6 || math.Abs(offset-5.75) > 1e-6 || math.Abs(coefficient+0.086) > 1e-6 {
+		t.Errorf("Fit with humidity correction was incorrect, got: %g %g %g %v", slope, offset, coefficient, err)
+	}
+	for i := range pairs {
+		pairs[i].Reference = 0.8*pairs[i].Raw - 2
+	}
+	slope, offset, coefficient, err = fitCalibration(pairs, false)
+	if err != nil || math.Abs(slope-0.8) > 1e-6 || math.Abs(offset+2) > 1e-6 || coefficient != 0 {
+		t.Errorf("Linear fit was incorrect, got: %g %g %g %v", slope, offset, coefficient, err)
+	}
+	if _, _, _, err := fitCalibration(pairs[:5], false); err == nil {
+		t.Errorf("Expected too few pairs to be rejected")
+	}
+	constant := make([]coLocatedPair, 12)
+	for i := range constant {
+		constant[i] = coLocatedPair{Raw: 10, Humidity: 50, Reference: 8}
+	}
+	if _, _, _, err := fitCalibration(constant, false); err == nil {
+		t.Errorf("Expected constant readings to be rejected")
+	}
+}
+
+func TestPairCoLocatedReadings(t *testing.T) {
+	start := time.Date(2019, 7, 6, 10, 0, 0, 0, time.UTC)
+	sensor := []SensorData{
+		{DeviceId: "DEVICE2", Pm10: 20, Humidity: 60, TSdevice: start},
+		{DeviceId: "DEVICE2", Pm10: 30, Humidity: 65, TSdevice: start.Add(time.Hour)},
+		{DeviceId: "DEVICE2", Channels: []Channel{{Quantity: quantityPm10, Value: 28}}, TSdevice: start.Add(52 * time.Minute)},
+	}
+	reference := []SensorData{
+		{DeviceId: "DEVICE1", Pm10: 14, TSdevice: start.Add(-4 * time.Minute)},
+		{DeviceId: "DEVICE1", Pm10: 15, TSdevice: start.Add(time.Minute)},
+		{DeviceId: "DEVICE1", Pm10: 25, TSdevice: start.Add(50 * time.Minute)},
+	}
+	pairs := pairCoLocatedReadings(sensor, reference, quantityPm10, true)
+	if len(pairs) != 1 || pairs[0] != (coLocatedPair{Raw: 20, Humidity: 60, Reference: 15}) {
+		t.Errorf("Pairs were incorrect, got: %+v", pairs)
+	}
+	pairs = pairCoLocatedReadings(sensor, reference, quantityPm10, false)
+	if len(pairs) != 2 || pairs[1] != (coLocatedPair{Raw: 28, Reference: 25}) {
+		t.Errorf("Expected readings without humidity to be paired without a humidity correction, got: %+v", pairs)
+	}
+}
+
+func TestCalibration(t *testing.T) {
+	stub := newTestStub()
+	registerTestDevice(stub, 1, "org1")
+	priv := registerTestDevice(stub, 2, "org1")
+
+	if response := stub.invoke("tx1", [][]byte{[]byte("setDeviceClass"), []byte("DEVICE1"), []byte("reference")}); response.Message == "" {
+		t.Errorf("Expected a non-admin to be rejected")
+	}
+	stub.setCaller("Org1MSP", "Admin@org1.example.com")
+	if response := stub.invoke("tx2", [][]byte{[]byte("setDeviceClass"), []byte("DEVICE1"), []byte("gold")}); response.Message == "" {
+		t.Errorf("Expected an unknown class to be rejected")
+	}
+	if response := stub.invoke("tx3", [][]byte{[]byte("setDeviceClass"), []byte("DEVICE1"), []byte("reference")}); response.Message != "" {
+		t.Fatalf("setDeviceClass failed: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "User1@org1.example.com")
+
+	ts := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	calibration := `{"deviceId":"DEVICE2","quantity":"pm10","slope":0.5,"offset":1,"referenceDeviceId":"DEVICE1",` +
+		`"validFrom":"` + ts.Add(-time.Hour).Format(time.RFC3339) + `","validTo":"` + ts.Add(time.Hour).Format(time.RFC3339) + `",` +
+		`"coLocationFrom":"2019-07-01T00:00:00Z","coLocationTo":"2019-07-31T00:00:00Z"}`
+	response := stub.invoke("cal1", [][]byte{[]byte("addCalibration"), []byte(calibration)})
+	if response.Message != "" {
+		t.Fatalf("addCalibration failed: %s", response.Message)
+	}
+	if response := stub.invoke("cal2", [][]byte{[]byte("addCalibration"), []byte(calibration)}); response.Message != "Validity window overlaps calibration cal1" {
+		t.Errorf("Expected an overlapping calibration to be rejected, got: %s", response.Message)
+	}
+	reversed := `{"deviceId":"DEVICE1","quantity":"pm10","slope":2,"referenceDeviceId":"DEVICE1","validFrom":"2019-08-01T00:00:00Z",` +
+		`"coLocationFrom":"2019-07-01T00:00:00Z","coLocationTo":"2019-07-31T00:00:00Z"}`
+	if response := stub.invoke("cal3", [][]byte{[]byte("addCalibration"), []byte(reversed)}); response.Message != "DEVICE1 is a reference station" {
+		t.Errorf("Expected a reference station not to be calibrated, got: %s", response.Message)
+	}
+	humidity := `{"deviceId":"DEVICE2","quantity":"humidity","slope":0.9,"offset":2,"referenceDeviceId":"DEVICE1","validFrom":"2019-08-01T00:00:00Z","validTo":"2019-09-01T00:00:00Z",` +
+		`"coLocationFrom":"2019-07-01T00:00:00Z","coLocationTo":"2019-07-31T00:00:00Z"`
+	if response := stub.invoke("cal5", [][]byte{[]byte("addCalibration"), []byte(humidity + `,"humidityCoefficient":0.1}`)}); response.Message != "Humidity cannot be calibrated with a humidity correction" {
+		t.Errorf("Expected a humidity correction of the humidity to be rejected, got: %s", response.Message)
+	}
+	if response := stub.invoke("cal6", [][]byte{[]byte("addCalibration"), []byte(humidity + `}`)}); response.Message != "" {
+		t.Errorf("Expected a humidity calibration without correction to be accepted, got: %s", response.Message)
+	}
+	stub.setCaller("Org2MSP", "User1@org2.example.com")
+	if response := stub.invoke("cal4", [][]byte{[]byte("addCalibration"), []byte(calibration)}); response.Message != "Only the owner of DEVICE2 may calibrate it" {
+		t.Errorf("Expected another organization to be rejected, got: %s", response.Message)
+	}
+
+	// 4.0 µg/m³ within the validity window, 6.0 µg/m³ after it
+	if response := stub.invoke("m1", buildTestMeasurement(priv, 2, 1, 40, ts, "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	if response := stub.invoke("m2", buildTestMeasurement(priv, 2, 2, 60, ts.Add(90*time.Minute), "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	data := SensorData{}
+	json.Unmarshal(stub.State["8017480121707248c4601288a1543101"], &data)
+	if len(data.Calibrated) != 1 || data.Calibrated[0].Quantity != quantityPm10 || data.Calibrated[0].Calibration != "cal1" || math.Abs(data.Calibrated[0].Raw-4) > 1e-6 || math.Abs(data.Calibrated[0].Value-3) > 1e-6 || data.Pm10 != 4 {
+		t.Errorf("Calibrated values were incorrect, got: %+v", data)
+	}
+	data = SensorData{}
+	json.Unmarshal(stub.State["8017480121707248c4601288a1543102"], &data)
+	if len(data.Calibrated) != 0 {
+		t.Errorf("Expected no calibration after the validity window, got: %+v", data.Calibrated)
+	}
+
+	response = stub.invoke("q1", [][]byte{[]byte("getCalibrations"), []byte("DEVICE2")})
+	calibrations := []Calibration{}
+	json.Unmarshal(response.Payload, &calibrations)
+	if len(calibrations) != 2 || calibrations[0].Id != "cal6" || calibrations[1].Id != "cal1" || calibrations[1].SetBy != "Org1MSP" || calibrations[1].ReferenceDeviceId != "DEVICE1" {
+		t.Errorf("Calibrations were incorrect, got: %s", response.Payload)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+/*
+ * Minimal CBOR (RFC 8949) decoder and encoder for the COSE encoding scheme.
+ * Only definite lengths are supported, which is all that deterministically encoded
+ * messages use. Integers decode to int64, floats to float64, maps to
+ * map[interface{}]interface{} with int64 or string keys and tags to CBORTag.
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// maximum nesting of arrays, maps and tags
+const maxCBORDepth = 16
+
+// CBOR major types
+const (
+	cborUnsigned byte = iota
+	cborNegative
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+// Define the CBOR tag structure, a tagged data item
+type CBORTag struct {
+	Number  uint64
+	Content interface{}
+}
+
+// decodes exactly one data item, trailing bytes are an error
+func decodeCBOR(b []byte) (interface{}, error) {
+	item, rest, err := decodeCBORItem(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after CBOR item", len(rest))
+	}
+	return item, nil
+}
+
+// reads the argument of the initial byte, the length or value of the data item
+func decodeCBORHead(b []byte) (byte, byte, uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, 0, 0, nil, errors.New("Unexpected end of CBOR data")
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+	switch {
+	case info < 24:
+		return major, info, uint64(info), b, nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(b) < size {
+			return 0, 0, 0, nil, errors.New("Unexpected end of CBOR data")
+		}
+		value := uint64(0)
+		for _, c := range b[:size] {
+			value = value<<8 | uint64(c)
+		}
+		return major, info, value, b[size:], nil
+	}
+	return 0, 0, 0, nil, fmt.Errorf("Unsupported CBOR additional information %d", info)
+}
+
+func decodeCBORItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, errors.New("CBOR data is nested too deeply")
+	}
+	major, info, argument, rest, err := decodeCBORHead(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case cborUnsigned:
+		if argument > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer out of range")
+		}
+		return int64(argument), rest, nil
+	case cborNegative:
+		if argument > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer out of range")
+		}
+		return -1 - int64(argument), rest, nil
+	case cborBytes, cborText:
+		if argument > uint64(len(rest)) {
+			return nil, nil, errors.New("Unexpected end of CBOR data")
+		}
+		if major == cborText {
+			return string(rest[:argument]), rest[argument:], nil
+		}
+		return append([]byte{}, rest[:argument]...), rest[argument:], nil
+	case cborArray:
+		// every item takes at least one byte, which bounds the allocation
+		if argument > uint64(len(rest)) {
+			return nil, nil, errors.New("Unexpected end of CBOR data")
+		}
+		items := make([]interface{}, 0, argument)
+		for i := uint64(0); i < argument; i++ {
+			var item interface{}
+			item, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case cborMap:
+		if argument > uint64(len(rest)) {
+			return nil, nil, errors.New("Unexpected end of CBOR data")
+		}
+		items := make(map[interface{}]interface{})
+		for i := uint64(0); i < argument; i++ {
+			var key, value interface{}
+			key, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("Unsupported CBOR map key, expecting integers or text")
+			}
+			if _, ok := items[key]; ok {
+				return nil, nil, fmt.Errorf("Duplicate CBOR map key %v", key)
+			}
+			value, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, rest, nil
+	case cborTag:
+		content, rest, err := decodeCBORItem(rest, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return CBORTag{Number: argument, Content: content}, rest, nil
+	}
+	// major type 7: simple values and floats
+	switch info {
+	case 20:
+		return false, rest, nil
+	case 21:
+		return true, rest, nil
+	case 22, 23:
+		return nil, rest, nil
+	case 25:
+		return decodeHalfFloat(uint16(argument)), rest, nil
+	case 26:
+		return float64(math.Float32frombits(uint32(argument))), rest, nil
+	case 27:
+		return math.Float64frombits(argument), rest, nil
+	}
+	return nil, nil, fmt.Errorf("Unsupported CBOR simple value %d", info)
+}
+
+// converts an IEEE 754 half precision float
+func decodeHalfFloat(half uint16) float64 {
+	exponent := int(half>>10) & 0x1f
+	mantissa := float64(half & 0x3ff)
+	var value float64
+	switch exponent {
+	case 0:
+		value = math.Ldexp(mantissa, -24)
+	case 31:
+		if mantissa == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if half&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
+
+// encodes the initial byte and argument of a data item in its shortest form
+func encodeCBORHead(major byte, argument uint64) []byte {
+	switch {
+	case argument < 24:
+		return []byte{major<<5 | byte(argument)}
+	case argument <= math.MaxUint8:
+		return []byte{major<<5 | 24, byte(argument)}
+	case argument <= math.MaxUint16:
+		head := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(head[1:], uint16(argument))
+		return head
+	case argument <= math.MaxUint32:
+		head := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(head[1:], uint32(argument))
+		return head
+	}
+	head := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(head[1:], argument)
+	return head
+}
+
+// encodes a byte string
+func encodeCBORBytes(b []byte) []byte {
+	return append(encodeCBORHead(cborBytes, uint64(len(b))), b...)
+}
+
+// encodes a text string
+func encodeCBORText(str string) []byte {
+	return append(encodeCBORHead(cborText, uint64(len(str))), str...)
+}
+
+// returns the number as float64, CBOR encoders may choose integers or floats of any precision
+func cborNumber(item interface{}) (float64, bool) {
+	switch value := item.(type) {
+	case int64:
+		return float64(value), true
+	case float64:
+		return value, !math.IsNaN(value) && !math.IsInf(value, 0)
+	}
+	return 0, false
+}
@@ -0,0 +1,215 @@
+package main
+
+/*
+ * Channel-based measurements (encoding scheme 4) for stations with more sensors than PM,
+ * temperature and humidity. Every value is a channel {quantity, unit, value, qualityFlag},
+ * the quantities and their units are defined by the registry below.
+ *	Byte 1:		Header: 10101010
+ *	Byte 2-3:	Device Id: (1-65535)
+ *	Byte 4-19:	UUID of the transaction
+ *	Byte 20-23:	Timestamp in seconds since 1970-01-01 00:00:00 UTC (big endian)
+ *	Byte 24-34:	Latitude DDDMMmmmmmH
+ *	Byte 35-46:	Longtitude DDDDMMmmmmmH
+ *	Byte 47:	Number of channels n
+ *	Byte 48-:	Channel table, n entries of 6 bytes:
+ *			quantity code, quality flag, value as IEEE 754 float32 (big endian)
+ * The signature is detached, like with the default encoding.
+ *
+ * The channels of PM10, PM2.5, temperature and humidity are also written to the fixed fields
+ * of SensorData, so existing consumers keep working. Measurements without channels are read
+ * as the channels of their fixed fields, see measurementChannels.
+ */
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const channelEncodingScheme = 4
+
+// length of the frame up to the channel table and size of a channel table entry
+const (
+	channelHeaderLength     = 47
+	channelTableEntryLength = 6
+)
+
+// quantities of the registry
+const (
+	quantityPm10     = "pm10"
+	quantityPm25     = "pm25"
+	quantityTemp     = "temp"
+	quantityHumidity = "humidity"
+	quantityNO2      = "no2"
+	quantityO3       = "o3"
+	quantityCO       = "co"
+	quantityCO2      = "co2"
+	quantityNoise    = "noise"
+)
+
+// quality flags of a channel, indexed by their code in the channel table
+var qualityFlags = []string{"ok", "suspect", "invalid", "calibrating"}
+
+// Define the quantity structure, a measured quantity of the registry
+type Quantity struct {
+	Code        byte   `json:"code"`
+	Quantity    string `json:"quantity"`
+	Unit        string `json:"unit"`
+	Description string `json:"description"`
+	Definition  string `json:"definition"`
+}
+
+// registry of the known quantities, codes must never be reused
+// units are UCUM symbols as used by SenML where one exists, definitions are the URIs of the
+// EEA air quality pollutant vocabulary or of QUDT quantity kinds
+var quantityRegistry = []Quantity{
+	{1, quantityPm10, "ug/m3", "Particulate matter up to 10 µm", "http://dd.eionet.europa.eu/vocabulary/aq/pollutant/5"},
+	{2, quantityPm25, "ug/m3", "Particulate matter up to 2.5 µm", "http://dd.eionet.europa.eu/vocabulary/aq/pollutant/6001"},
+	{3, quantityTemp, "Cel", "Air temperature", "http://qudt.org/vocab/quantitykind/Temperature"},
+	{4, quantityHumidity, "%RH", "Relative humidity", "http://qudt.org/vocab/quantitykind/RelativeHumidity"},
+	{5, quantityNO2, "ug/m3", "Nitrogen dioxide", "http://dd.eionet.europa.eu/vocabulary/aq/pollutant/8"},
+	{6, quantityO3, "ug/m3", "Ozone", "http://dd.eionet.europa.eu/vocabulary/aq/pollutant/7"},
+	{7, quantityCO, "mg/m3", "Carbon monoxide", "http://dd.eionet.europa.eu/vocabulary/aq/pollutant/10"},
+	{8, quantityCO2, "ppm", "Carbon dioxide", "http://dd.eionet.europa.eu/vocabulary/aq/pollutant/71"},
+	{9, quantityNoise, "dB(A)", "A-weighted sound pressure level", "http://qudt.org/vocab/quantitykind/SoundPressureLevel"},
+}
+
+// Define the channel structure, one value of a measurement
+type Channel struct {
+	Quantity    string  `json:"quantity"`
+	Unit        string  `json:"unit"`
+	Value       float64 `json:"value"`
+	QualityFlag string  `json:"qualityFlag"`
+}
+
+// returns the registry entry of the quantity code
+func quantityByCode(code byte) (Quantity, bool) {
+	for _, quantity := range quantityRegistry {
+		if quantity.Code == code {
+			return quantity, true
+		}
+	}
+	return Quantity{}, false
+}
+
+// returns the registry entry of the quantity
+func quantityByName(name string) (Quantity, bool) {
+	for _, quantity := range quantityRegistry {
+		if quantity.Quantity == name {
+			return quantity, true
+		}
+	}
+	return Quantity{}, false
+}
+
+// parses the channel table, unknown quantities, quality flags and repeated quantities are an error
+func parseChannelTable(b []byte) ([]Channel, error) {
+	if len(b) == 0 {
+		return nil, errors.New("Missing channel count")
+	}
+	count := int(b[0])
+	b = b[1:]
+	if count == 0 || len(b) != count*channelTableEntryLength {
+		return nil, fmt.Errorf("Channel table has %d bytes. Expecting %d entries of %d bytes", len(b), count, channelTableEntryLength)
+	}
+	channels := []Channel{}
+	seen := make(map[string]bool)
+	for i := 0; i < count; i++ {
+		entry := b[i*channelTableEntryLength : (i+1)*channelTableEntryLength]
+		quantity, ok := quantityByCode(entry[0])
+		if !ok {
+			return nil, fmt.Errorf("Unknown quantity code %d in channel %d", entry[0], i)
+		}
+		if seen[quantity.Quantity] {
+			return nil, fmt.Errorf("Duplicate quantity %s in channel %d", quantity.Quantity, i)
+		}
+		seen[quantity.Quantity] = true
+		if int(entry[1]) >= len(qualityFlags) {
+			return nil, fmt.Errorf("Unknown quality flag %d in channel %d", entry[1], i)
+		}
+		value := float64(math.Float32frombits(binary.BigEndian.Uint32(entry[2:6])))
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("Invalid value in channel %d", i)
+		}
+		channels = append(channels, Channel{Quantity: quantity.Quantity, Unit: quantity.Unit, Value: value, QualityFlag: qualityFlags[entry[1]]})
+	}
+	return channels, nil
+}
+
+// returns the channels of the measurement, measurements without channels yield their fixed fields
+func measurementChannels(data SensorData) []Channel {
+	if len(data.Channels) > 0 {
+		return data.Channels
+	}
+	channels := []Channel{}
+	for _, field := range []struct {
+		quantity string
+		value    float32
+	}{{quantityPm10, data.Pm10}, {quantityPm25, data.Pm25}, {quantityTemp, data.Temp}, {quantityHumidity, data.Humidity}} {
+		quantity, _ := quantityByName(field.quantity)
+		channels = append(channels, Channel{Quantity: quantity.Quantity, Unit: quantity.Unit, Value: float64(field.value), QualityFlag: qualityFlags[0]})
+	}
+	return channels
+}
+
+// sets the fixed fields from the channels of the measurement
+func setLegacyFields(data *SensorData) {
+	for _, channel := range data.Channels {
+		switch channel.Quantity {
+		case quantityPm10:
+			data.Pm10 = float32(channel.Value)
+		case quantityPm25:
+			data.Pm25 = float32(channel.Value)
+		case quantityTemp:
+			data.Temp = float32(channel.Value)
+		case quantityHumidity:
+			data.Humidity = float32(channel.Value)
+		}
+	}
+}
+
+func decodeMessageWithChannelEncodingScheme(b, b2 []byte, device DeviceInfo, deviceId uint16) (SensorData, string) {
+	if len(b) < channelHeaderLength {
+		return SensorData{}, ""
+	}
+	if !verifyDeviceSignature(device, b, b2) {
+		return SensorData{}, ""
+	}
+	lat, latitude, err := parseLatitudeFromCharBytes(b[23:34])
+	if err != nil {
+		return SensorData{}, ""
+	}
+	lon, longtitude, err := parseLongtitudeFromCharBytes(b[34:46])
+	if err != nil {
+		return SensorData{}, ""
+	}
+	channels, err := parseChannelTable(b[46:])
+	if err != nil {
+		return SensorData{}, ""
+	}
+	data := SensorData{
+		DeviceId:   "DEVICE" + strconv.Itoa(int(deviceId)),
+		TSdevice:   convertEpochToDate(b[19:23]),
+		Latitude:   latitude,
+		Longtitude: longtitude,
+		Lat:        lat,
+		Lon:        lon,
+		Channels:   channels,
+	}
+	setLegacyFields(&data)
+	return data, hex.EncodeToString(b[3:19])
+}
+
+// returns the known quantities and their units
+func (s *SmartContract) getQuantityRegistry(APIstub shim.ChaincodeStubInterface) sc.Response {
+	quantitiesAsBytes, _ := json.Marshal(quantityRegistry)
+	fmt.Printf("- getQuantityRegistry:\n%s\n", quantitiesAsBytes)
+	return shim.Success(quantitiesAsBytes)
+}
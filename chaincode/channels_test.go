@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// builds the channel table of a channel frame, entries are quantity code, quality flag and value
+func buildTestChannelTable(entries ...[3]float64) []byte {
+	table := []byte{byte(len(entries))}
+	for _, entry := range entries {
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, math.Float32bits(float32(entry[2])))
+		table = append(table, byte(entry[0]), byte(entry[1]))
+		table = append(table, value...)
+	}
+	return table
+}
+
+func TestChannelTable(t *testing.T) {
+	channels, err := parseChannelTable(buildTestChannelTable([3]float64{1, 0, 12.5}, [3]float64{5, 1, 41}, [3]float64{9, 0, 63.5}))
+	if err != nil {
+		t.Fatalf("Parsing the channel table failed: %s", err)
+	}
+	expected := []Channel{
+		{Quantity: "pm10", Unit: "ug/m3", Value: 12.5, QualityFlag: "ok"},
+		{Quantity: "no2", Unit: "ug/m3", Value: 41, QualityFlag: "suspect"},
+		{Quantity: "noise", Unit: "dB(A)", Value: 63.5, QualityFlag: "ok"},
+	}
+	if !reflect.DeepEqual(channels, expected) {
+		t.Errorf("Channel table was incorrect, got: %+v, want: %+v", channels, expected)
+	}
+
+	invalid := map[string][]byte{
+		"no channels":          {0},
+		"truncated entry":      buildTestChannelTable([3]float64{1, 0, 12.5})[:6],
+		"unknown quantity":     buildTestChannelTable([3]float64{99, 0, 1}),
+		"unknown quality flag": buildTestChannelTable([3]float64{1, 9, 1}),
+		"duplicate quantity":   buildTestChannelTable([3]float64{1, 0, 1}, [3]float64{1, 0, 2}),
+		"not a number":         buildTestChannelTable([3]float64{1, 0, math.NaN()}),
+	}
+	for reason, table := range invalid {
+		if _, err := parseChannelTable(table); err == nil {
+			t.Errorf("Expected an error for %s", reason)
+		}
+	}
+}
+
+func TestMeasurementChannels(t *testing.T) {
+	legacy := SensorData{Pm10: 5.4, Pm25: 2.5, Temp: -3, Humidity: 48}
+	expected := []Channel{
+		{Quantity: "pm10", Unit: "ug/m3", Value: float64(float32(5.4)), QualityFlag: "ok"},
+		{Quantity: "pm25", Unit: "ug/m3", Value: 2.5, QualityFlag: "ok"},
+		{Quantity: "temp", Unit: "Cel", Value: -3, QualityFlag: "ok"},
+		{Quantity: "humidity", Unit: "%RH", Value: 48, QualityFlag: "ok"},
+	}
+	if channels := measurementChannels(legacy); !reflect.DeepEqual(channels, expected) {
+		t.Errorf("Channels of a legacy measurement were incorrect, got: %+v, want: %+v", channels, expected)
+	}
+	withChannels := SensorData{Channels: []Channel{{Quantity: "co2", Unit: "ppm", Value: 415, QualityFlag: "ok"}}}
+	if channels := measurementChannels(withChannels); !reflect.DeepEqual(channels, withChannels.Channels) {
+		t.Errorf("Channels were incorrect, got: %+v", channels)
+	}
+}
+
+func TestChannelEncodingScheme(t *testing.T) {
+	stub := newTestStub()
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	stub.invoke("tx1", [][]byte{[]byte("registerDevice"), []byte(base64.RawStdEncoding.EncodeToString(pub)), []byte("4"), []byte("org1"), []byte("true")})
+
+	ts := time.Now().UTC().Truncate(time.Second)
+	frame := []byte{170, 0, 1, 128, 23, 72, 1, 33, 112, 114, 72, 196, 96, 18, 136, 161, 84, 49, 1}
+	epoch := make([]byte, 4)
+	binary.BigEndian.PutUint32(epoch, uint32(ts.Unix()))
+	frame = append(frame, epoch...)
+	frame = append(frame, "0490033624N00082531116E"...)
+	frame = append(frame, buildTestChannelTable([3]float64{1, 0, 12.5}, [3]float64{2, 0, 7.25}, [3]float64{3, 0, 21.5}, [3]float64{5, 0, 41}, [3]float64{8, 3, 415})...)
+	signature := ed25519.Sign(priv, frame)
+	response := stub.invoke("tx2", [][]byte{[]byte("registerMeasurement"), []byte(base64.StdEncoding.EncodeToString(frame)), []byte(base64.StdEncoding.EncodeToString(signature)), []byte(ts.Format("2006-01-02 15:04:05-07:00"))})
+	if response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	data := SensorData{}
+	json.Unmarshal(stub.State[hex.EncodeToString(frame[3:19])], &data)
+	if data.Pm10 != 12.5 || data.Pm25 != 7.25 || data.Temp != 21.5 || data.Humidity != 0 || !data.TSdevice.Equal(ts) || data.Lat != 49.005604 {
+		t.Errorf("Fixed fields were incorrect, got: %+v", data)
+	}
+	if len(data.Channels) != 5 || data.Channels[3] != (Channel{Quantity: "no2", Unit: "ug/m3", Value: 41, QualityFlag: "ok"}) || data.Channels[4].QualityFlag != "calibrating" {
+		t.Errorf("Channels were incorrect, got: %+v", data.Channels)
+	}
+
+	frame[18] = 2
+	response = stub.invoke("tx3", [][]byte{[]byte("registerMeasurement"), []byte(base64.StdEncoding.EncodeToString(frame)), []byte(base64.StdEncoding.EncodeToString(signature)), []byte(ts.Format("2006-01-02 15:04:05-07:00"))})
+	if response.Message == "" {
+		t.Errorf("Expected a frame with an invalid signature to be rejected")
+	}
+
+	response = stub.invoke("tx4", [][]byte{[]byte("getQuantityRegistry")})
+	quantities := []Quantity{}
+	if err := json.Unmarshal(response.Payload, &quantities); err != nil || len(quantities) != len(quantityRegistry) {
+		t.Errorf("Quantity registry was incorrect, got: %s", response.Payload)
+	}
+}
@@ -0,0 +1,699 @@
+package main
+
+/*
+ * Air-quality compliance with the EU limit values of Directive 2008/50/EC.
+ * PM10: the daily mean must not exceed 50 µg/m³ on more than 35 days of a calendar year.
+ * PM2.5: the annual mean must not exceed 25 µg/m³.
+ * registerMeasurement maintains a daily aggregate per device with the sum, minimum, maximum
+ * and count of every quantity and the hours of the day covered by readings. Calibrated values
+ * replace raw values where available, channels flagged invalid and measurements taken during
+ * maintenance are left out. A daily mean is only valid if readings cover at least 18 hours
+ * (75 %) of the day and no maintenance window covering counted readings was declared later. Days are UTC calendar days. A station is only assessed as compliant if
+ * valid daily means cover at least 90 % of the days of the year, the minimum data capture of
+ * Annex I. Stations with less data capture are reported as having insufficient data, unless
+ * the days they did capture already exceed the limit.
+ * Daily means can also be computed from the stored readings, which needs rich queries. Rich
+ * query results are not re-checked when a transaction is validated, so compliance reports are
+ * only built from the key-ranged daily aggregates and readings are left to getDailyMeans.
+ *
+ * Compliance reports are stored on the ledger with the keys of their inputs and a SHA-256
+ * hash of the report, so they can be checked against the data later. The hash covers the
+ * JSON encoding of the report with an empty hash.
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	dailyAggregateKey   = "daily~deviceId~date"
+	complianceReportKey = "complianceReport~zone~year~txId"
+)
+
+const (
+	dailyDateLayout = "2006-01-02"
+	// hours of a day which must be covered by readings for a valid daily mean
+	minDailyCoverageHours = 18
+	pm10DailyLimit        = 50.0
+	pm10MaxExceedanceDays = 35
+	pm25AnnualLimit       = 25.0
+	// share of the days of the year which must have a valid daily mean
+	minDataCapture = 0.9
+)
+
+// outcomes of the assessment of a pollutant
+const (
+	assessmentCompliant        = "compliant"
+	assessmentExceeded         = "exceeded"
+	assessmentInsufficientData = "insufficient data"
+)
+
+// sources of daily means
+const (
+	sourceAggregates = "aggregates"
+	sourceReadings   = "readings"
+)
+
+// Define the daily quantity structure, the statistics of a quantity over a day
+type DailyQuantity struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// Define the daily aggregate structure, the readings of a device on a day, Hours has bit n set if readings were taken in hour n
+// HourlyCounts holds the number of readings of every hour, Maintenance the events declared after readings within their window had been counted
+type DailyAggregate struct {
+	DeviceId     string                    `json:"deviceId"`
+	Date         string                    `json:"date"`
+	Hours        uint32                    `json:"hours"`
+	HourlyCounts [24]int                   `json:"hourlyCounts"`
+	Quantities   map[string]*DailyQuantity `json:"quantities"`
+	Maintenance  []string                  `json:"maintenance,omitempty"`
+}
+
+// Define the daily mean structure
+type DailyMean struct {
+	Date string `json:"date"`
+	// number of devices for zone means, of readings for device means
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean"`
+}
+
+// Define the daily mean query structure, dates are given as YYYY-MM-DD and include both ends
+// the devices of the zone are used if no devices are listed, see zones.go
+type DailyMeanQuery struct {
+	Zone      string   `json:"zone,omitempty"`
+	DeviceIds []string `json:"deviceIds,omitempty"`
+	Quantity  string   `json:"quantity"`
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Source    string   `json:"source,omitempty"`
+}
+
+// Define the daily means structure, the means of every device and their mean as zone
+type DailyMeans struct {
+	Quantity string                 `json:"quantity"`
+	Devices  map[string][]DailyMean `json:"devices"`
+	Zone     []DailyMean            `json:"zone"`
+	Inputs   []InputRange           `json:"inputs"`
+}
+
+// Define the compliance report request structure
+type ComplianceReportRequest struct {
+	Zone      string   `json:"zone"`
+	Year      int      `json:"year"`
+	DeviceIds []string `json:"deviceIds,omitempty"`
+	Source    string   `json:"source,omitempty"`
+}
+
+// Define the input range structure, the first and last aggregate key read for a device, for
+// readings the selector and timestamp window of the rich query, whose result keys are no range
+type InputRange struct {
+	DeviceId string `json:"deviceId"`
+	StartKey string `json:"startKey,omitempty"`
+	EndKey   string `json:"endKey,omitempty"`
+	Selector string `json:"selector,omitempty"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Count    int    `json:"count"`
+}
+
+// Define the station compliance structure, the assessment of a single device
+type StationCompliance struct {
+	DeviceId           string   `json:"deviceId"`
+	Pm10ValidDays      int      `json:"pm10ValidDays"`
+	Pm10DataCapture    float64  `json:"pm10DataCapture"`
+	Pm10ExceedanceDays int      `json:"pm10ExceedanceDays"`
+	Pm10Assessment     string   `json:"pm10Assessment"`
+	Pm10Compliant      bool     `json:"pm10Compliant"`
+	Pm25ValidDays      int      `json:"pm25ValidDays"`
+	Pm25DataCapture    float64  `json:"pm25DataCapture"`
+	Pm25AnnualMean     *float64 `json:"pm25AnnualMean"`
+	Pm25Assessment     string   `json:"pm25Assessment"`
+	Pm25Compliant      bool     `json:"pm25Compliant"`
+}
+
+// Define the compliance report structure, a zone complies if all of its stations comply
+type ComplianceReport struct {
+	Id                 string              `json:"id"`
+	Zone               string              `json:"zone"`
+	Year               int                 `json:"year"`
+	Source             string              `json:"source"`
+	Stations           []StationCompliance `json:"stations"`
+	Pm10ExceedanceDays int                 `json:"pm10ExceedanceDays"`
+	Pm10Assessment     string              `json:"pm10Assessment"`
+	Pm10Compliant      bool                `json:"pm10Compliant"`
+	Pm25AnnualMean     *float64            `json:"pm25AnnualMean"`
+	Pm25Assessment     string              `json:"pm25Assessment"`
+	Pm25Compliant      bool                `json:"pm25Compliant"`
+	Inputs             []InputRange        `json:"inputs"`
+	CreatedBy          string              `json:"createdBy"`
+	CreatedAt          time.Time           `json:"createdAt"`
+	Hash               string              `json:"hash"`
+}
+
+// returns the values of the measurement used for compliance, calibrated where available
+func complianceValues(data SensorData) map[string]float64 {
+	values := make(map[string]float64)
+	if data.Maintenance != "" {
+		return values
+	}
+	for _, channel := range measurementChannels(data) {
+		if channel.QualityFlag != "invalid" {
+			values[channel.Quantity] = channel.Value
+		}
+	}
+	for _, calibrated := range data.Calibrated {
+		if _, ok := values[calibrated.Quantity]; ok {
+			values[calibrated.Quantity] = calibrated.Value
+		}
+	}
+	return values
+}
+
+// adds the measurement to the aggregate
+func (aggregate *DailyAggregate) add(data SensorData) {
+	if aggregate.Quantities == nil {
+		aggregate.Quantities = make(map[string]*DailyQuantity)
+	}
+	if data.Maintenance != "" {
+		return
+	}
+	hour := data.TSdevice.UTC().Hour()
+	aggregate.Hours |= 1 << uint(hour)
+	aggregate.HourlyCounts[hour]++
+	for quantity, value := range complianceValues(data) {
+		statistics, ok := aggregate.Quantities[quantity]
+		if !ok {
+			statistics = &DailyQuantity{Min: value, Max: value}
+			aggregate.Quantities[quantity] = statistics
+		}
+		statistics.Count++
+		statistics.Sum = statistics.Sum + value
+		if value < statistics.Min {
+			statistics.Min = value
+		}
+		if value > statistics.Max {
+			statistics.Max = value
+		}
+	}
+}
+
+// removes a measurement added before from the sum and count, and its hour from the covered hours
+// if no other readings were taken in it, the minimum and maximum cannot be recomputed
+func (aggregate *DailyAggregate) remove(data SensorData) {
+	if data.Maintenance != "" {
+		return
+	}
+	hour := data.TSdevice.UTC().Hour()
+	if aggregate.HourlyCounts[hour] > 0 {
+		aggregate.HourlyCounts[hour]--
+	}
+	if aggregate.HourlyCounts[hour] == 0 {
+		aggregate.Hours &^= 1 << uint(hour)
+	}
+	for quantity, value := range complianceValues(data) {
+		if statistics, ok := aggregate.Quantities[quantity]; ok && statistics.Count > 0 {
+			statistics.Count--
+			statistics.Sum = statistics.Sum - value
+		}
+	}
+}
+
+// returns the mean of the quantity, false if there are no readings, they do not cover enough of
+// the day or include readings taken during maintenance
+func (aggregate DailyAggregate) mean(quantity string) (float64, bool) {
+	statistics, ok := aggregate.Quantities[quantity]
+	if !ok || statistics.Count == 0 || bits.OnesCount32(aggregate.Hours) < minDailyCoverageHours || len(aggregate.Maintenance) > 0 {
+		return 0, false
+	}
+	return statistics.Sum / float64(statistics.Count), true
+}
+
+// adds the measurement to the daily aggregate of its device
+func updateDailyAggregate(APIstub shim.ChaincodeStubInterface, data SensorData) error {
+	date := data.TSdevice.UTC().Format(dailyDateLayout)
+	aggregateKey, err := APIstub.CreateCompositeKey(dailyAggregateKey, []string{data.DeviceId, date})
+	if err != nil {
+		return err
+	}
+	aggregateAsBytes, err := APIstub.GetState(aggregateKey)
+	if err != nil {
+		return err
+	}
+	aggregate := DailyAggregate{DeviceId: data.DeviceId, Date: date}
+	if aggregateAsBytes != nil {
+		if err := json.Unmarshal(aggregateAsBytes, &aggregate); err != nil {
+			return err
+		}
+	}
+	aggregate.add(data)
+	aggregateAsBytes, _ = json.Marshal(aggregate)
+	return APIstub.PutState(aggregateKey, aggregateAsBytes)
+}
+
+// aggregates the measurements of a device by day, the measurements must be ordered by device timestamp
+func aggregateReadings(measurements []SensorData) []DailyAggregate {
+	aggregates := []DailyAggregate{}
+	for _, data := range measurements {
+		date := data.TSdevice.UTC().Format(dailyDateLayout)
+		if n := len(aggregates); n == 0 || aggregates[n-1].Date != date {
+			aggregates = append(aggregates, DailyAggregate{DeviceId: data.DeviceId, Date: date})
+		}
+		aggregates[len(aggregates)-1].add(data)
+	}
+	return aggregates
+}
+
+// returns the maintained daily aggregates of the device between the dates, ordered by date
+func getDailyAggregates(APIstub shim.ChaincodeStubInterface, deviceId, from, to string) ([]DailyAggregate, InputRange, error) {
+	inputs := InputRange{DeviceId: deviceId}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(dailyAggregateKey, []string{deviceId})
+	if err != nil {
+		return nil, inputs, err
+	}
+	defer resultsIterator.Close()
+
+	aggregates := []DailyAggregate{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, inputs, err
+		}
+		aggregate := DailyAggregate{}
+		if json.Unmarshal(queryResponse.Value, &aggregate) != nil || aggregate.Date < from || aggregate.Date > to {
+			continue
+		}
+		if inputs.Count == 0 {
+			inputs.StartKey = queryResponse.Key
+		}
+		inputs.EndKey = queryResponse.Key
+		inputs.Count++
+		aggregates = append(aggregates, aggregate)
+	}
+	return aggregates, inputs, nil
+}
+
+// computes the daily aggregates of the device between the dates from its stored readings
+func getReadingAggregates(APIstub shim.ChaincodeStubInterface, deviceId, from, to string) ([]DailyAggregate, InputRange, error) {
+	end, _ := time.Parse(dailyDateLayout, to)
+	query := MeasurementQuery{
+		DeviceIds:          []string{deviceId},
+		From:               from + "T00:00:00Z",
+		To:                 end.Add(24*time.Hour - time.Nanosecond).Format(time.RFC3339Nano),
+		ExcludeInvalidated: true,
+	}
+	inputs := InputRange{DeviceId: deviceId, From: query.From, To: query.To}
+	selector, err := buildMeasurementSelector(query, query.DeviceIds, nil)
+	if err != nil {
+		return nil, inputs, err
+	}
+	inputs.Selector = selector
+	records, err := queryMeasurementRecords(APIstub, query)
+	if err != nil {
+		return nil, inputs, err
+	}
+	events, err := getMaintenanceEvents(APIstub, deviceId)
+	if err != nil {
+		return nil, inputs, err
+	}
+	measurements := []SensorData{}
+	for _, record := range records {
+		data := SensorData{}
+		if json.Unmarshal(record.Record, &data) != nil {
+			continue
+		}
+		// readings registered before their maintenance window was declared are not flagged
+		for _, event := range events {
+			if data.Maintenance == "" && event.covers(data.TSdevice) {
+				data.Maintenance = event.Id
+			}
+		}
+		inputs.Count++
+		measurements = append(measurements, data)
+	}
+	return aggregateReadings(measurements), inputs, nil
+}
+
+// returns the daily aggregates of the device from the given source
+func loadDailyAggregates(APIstub shim.ChaincodeStubInterface, source, deviceId, from, to string) ([]DailyAggregate, InputRange, error) {
+	if source == sourceReadings {
+		return getReadingAggregates(APIstub, deviceId, from, to)
+	}
+	return getDailyAggregates(APIstub, deviceId, from, to)
+}
+
+// returns the valid daily means of the quantity
+func dailyMeans(aggregates []DailyAggregate, quantity string) []DailyMean {
+	means := []DailyMean{}
+	for _, aggregate := range aggregates {
+		if mean, ok := aggregate.mean(quantity); ok {
+			means = append(means, DailyMean{Date: aggregate.Date, Count: aggregate.Quantities[quantity].Count, Mean: mean})
+		}
+	}
+	return means
+}
+
+// returns the mean of the device means of every day, ordered by date
+func zoneDailyMeans(devices map[string][]DailyMean) []DailyMean {
+	sums := make(map[string]*DailyMean)
+	for _, means := range devices {
+		for _, mean := range means {
+			if _, ok := sums[mean.Date]; !ok {
+				sums[mean.Date] = &DailyMean{Date: mean.Date}
+			}
+			sums[mean.Date].Count++
+			sums[mean.Date].Mean = sums[mean.Date].Mean + mean.Mean
+		}
+	}
+	zone := []DailyMean{}
+	for _, sum := range sums {
+		zone = append(zone, DailyMean{Date: sum.Date, Count: sum.Count, Mean: sum.Mean / float64(sum.Count)})
+	}
+	sort.Slice(zone, func(i, j int) bool {
+		return zone[i].Date < zone[j].Date
+	})
+	return zone
+}
+
+// returns the number of days of the calendar year
+func daysInYear(year int) int {
+	return time.Date(year, 12, 31, 0, 0, 0, 0, time.UTC).YearDay()
+}
+
+// returns the outcome of an assessment, an exceedance stands even with insufficient data capture
+func assessment(exceeded bool, dataCapture float64) string {
+	if exceeded {
+		return assessmentExceeded
+	}
+	if dataCapture < minDataCapture {
+		return assessmentInsufficientData
+	}
+	return assessmentCompliant
+}
+
+// assesses a station against the limit values, the aggregates must lie within the calendar year
+func assessStation(deviceId string, year int, aggregates []DailyAggregate) StationCompliance {
+	station := StationCompliance{DeviceId: deviceId}
+	days := float64(daysInYear(year))
+	for _, mean := range dailyMeans(aggregates, quantityPm10) {
+		station.Pm10ValidDays++
+		if mean.Mean > pm10DailyLimit {
+			station.Pm10ExceedanceDays++
+		}
+	}
+	station.Pm10DataCapture = float64(station.Pm10ValidDays) / days
+	station.Pm10Assessment = assessment(station.Pm10ExceedanceDays > pm10MaxExceedanceDays, station.Pm10DataCapture)
+	station.Pm10Compliant = station.Pm10Assessment == assessmentCompliant
+	sum := 0.0
+	for _, mean := range dailyMeans(aggregates, quantityPm25) {
+		station.Pm25ValidDays++
+		sum = sum + mean.Mean
+	}
+	station.Pm25DataCapture = float64(station.Pm25ValidDays) / days
+	exceeded := false
+	if station.Pm25ValidDays > 0 {
+		annualMean := sum / float64(station.Pm25ValidDays)
+		station.Pm25AnnualMean = &annualMean
+		exceeded = annualMean > pm25AnnualLimit
+	}
+	// the mean of a part of the year does not prove an exceedance of the annual limit
+	station.Pm25Assessment = assessment(exceeded && station.Pm25DataCapture >= minDataCapture, station.Pm25DataCapture)
+	station.Pm25Compliant = station.Pm25Assessment == assessmentCompliant
+	return station
+}
+
+// returns the outcome of a zone, exceeded if any station exceeds, compliant only if all stations comply
+func zoneAssessment(outcomes []string) string {
+	zone := assessmentCompliant
+	if len(outcomes) == 0 {
+		zone = assessmentInsufficientData
+	}
+	for _, outcome := range outcomes {
+		if outcome == assessmentExceeded {
+			return assessmentExceeded
+		}
+		if outcome == assessmentInsufficientData {
+			zone = assessmentInsufficientData
+		}
+	}
+	return zone
+}
+
+// assesses the zone from its stations, the PM2.5 mean of the zone is the mean of the station means
+func assessZone(report *ComplianceReport) {
+	sum, count := 0.0, 0
+	pm10, pm25 := []string{}, []string{}
+	for _, station := range report.Stations {
+		if station.Pm10ExceedanceDays > report.Pm10ExceedanceDays {
+			report.Pm10ExceedanceDays = station.Pm10ExceedanceDays
+		}
+		pm10 = append(pm10, station.Pm10Assessment)
+		pm25 = append(pm25, station.Pm25Assessment)
+		if station.Pm25AnnualMean != nil {
+			sum = sum + *station.Pm25AnnualMean
+			count++
+		}
+	}
+	report.Pm25AnnualMean = nil
+	if count > 0 {
+		mean := sum / float64(count)
+		report.Pm25AnnualMean = &mean
+	}
+	report.Pm10Assessment = zoneAssessment(pm10)
+	report.Pm10Compliant = report.Pm10Assessment == assessmentCompliant
+	report.Pm25Assessment = zoneAssessment(pm25)
+	report.Pm25Compliant = report.Pm25Assessment == assessmentCompliant
+}
+
+// returns the hex encoded SHA-256 hash of the report with an empty hash
+func complianceReportHash(report ComplianceReport) string {
+	report.Hash = ""
+	reportAsBytes, _ := json.Marshal(report)
+	hash := sha256.Sum256(reportAsBytes)
+	return hex.EncodeToString(hash[:])
+}
+
+// returns the listed devices, or the devices of the zone if none are listed
+func resolveZoneDeviceIds(APIstub shim.ChaincodeStubInterface, zoneId string, deviceIds []string) ([]string, error) {
+	if len(deviceIds) > 0 || zoneId == "" {
+		return deviceIds, nil
+	}
+	zone, err := getZone(APIstub, zoneId)
+	if err != nil {
+		return nil, err
+	}
+	return getZoneDeviceIds(APIstub, zone)
+}
+
+// returns the listed devices, or the devices of the zone if none are listed, listed devices
+// must belong to the zone, so a report on a zone cannot be built from stations outside of it
+func resolveReportDeviceIds(APIstub shim.ChaincodeStubInterface, zoneId string, deviceIds []string) ([]string, error) {
+	zone, err := getZone(APIstub, zoneId)
+	if err != nil {
+		return nil, err
+	}
+	zoneDeviceIds, err := getZoneDeviceIds(APIstub, zone)
+	if err != nil {
+		return nil, err
+	}
+	if len(deviceIds) == 0 {
+		return zoneDeviceIds, nil
+	}
+	members := make(map[string]bool)
+	for _, deviceId := range zoneDeviceIds {
+		members[deviceId] = true
+	}
+	for _, deviceId := range deviceIds {
+		if !members[deviceId] {
+			return nil, errors.New("Device " + deviceId + " does not belong to zone " + zoneId)
+		}
+	}
+	return deviceIds, nil
+}
+
+// checks the source and the device IDs shared by daily mean queries and reports
+func validateAggregateSource(source string, deviceIds []string) error {
+	if source != "" && source != sourceAggregates && source != sourceReadings {
+		return errors.New("Invalid source " + source + ". Expecting aggregates or readings")
+	}
+	if len(deviceIds) == 0 {
+		return errors.New("Expecting at least one device")
+	}
+	seen := make(map[string]bool)
+	for _, deviceId := range deviceIds {
+		if seen[deviceId] {
+			return errors.New("Device " + deviceId + " is listed twice")
+		}
+		seen[deviceId] = true
+	}
+	return nil
+}
+
+/*
+ * Expects a daily mean query as JSON object, e.g.
+ * {"deviceIds":["DEVICE1","DEVICE2"],"quantity":"pm10","from":"2019-01-01","to":"2019-01-31"}
+ * or {"zone":"stuttgart-mitte",...} for the devices of a zone, and an optional "source":"readings" to compute the means from the stored readings instead of
+ * the maintained aggregates. Returns the valid daily means of every device and of the devices as zone, and the inputs they were computed from.
+ */
+func (s *SmartContract) getDailyMeans(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	query := DailyMeanQuery{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(args[0])))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&query); err != nil {
+		return shim.Error("Invalid query: " + err.Error())
+	}
+	deviceIds, err := resolveZoneDeviceIds(APIstub, query.Zone, query.DeviceIds)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	query.DeviceIds = deviceIds
+	if err := validateAggregateSource(query.Source, query.DeviceIds); err != nil {
+		return shim.Error(err.Error())
+	}
+	if _, ok := quantityByName(query.Quantity); !ok {
+		return shim.Error("Unknown quantity " + query.Quantity)
+	}
+	from, err := time.Parse(dailyDateLayout, query.From)
+	if err != nil {
+		return shim.Error("Invalid date " + query.From + ". Expecting YYYY-MM-DD")
+	}
+	to, err := time.Parse(dailyDateLayout, query.To)
+	if err != nil || to.Before(from) {
+		return shim.Error("Invalid date " + query.To + ". Expecting YYYY-MM-DD not before " + query.From)
+	}
+
+	means := DailyMeans{Quantity: query.Quantity, Devices: make(map[string][]DailyMean), Inputs: []InputRange{}}
+	for _, deviceId := range query.DeviceIds {
+		aggregates, inputs, err := loadDailyAggregates(APIstub, query.Source, deviceId, query.From, query.To)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		means.Devices[deviceId] = dailyMeans(aggregates, query.Quantity)
+		means.Inputs = append(means.Inputs, inputs)
+	}
+	means.Zone = zoneDailyMeans(means.Devices)
+
+	meansAsBytes, _ := json.Marshal(means)
+	fmt.Printf("- getDailyMeans:\n%s\n", meansAsBytes)
+	return shim.Success(meansAsBytes)
+}
+
+/*
+ * Expects a report request as JSON object, e.g.
+ * {"zone":"Stuttgart-Mitte","year":2019,"deviceIds":["DEVICE1","DEVICE2"]}
+ * Without deviceIds all devices of the zone are assessed, listed devices must belong to the zone. The report is built from the daily aggregates, the only source accepted. Only admins may
+ * create reports. Stores the report and returns it.
+ */
+func (s *SmartContract) createComplianceReport(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	admin, err := isClientAdmin(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !admin {
+		return shim.Error("Only admins may create compliance reports")
+	}
+	request := ComplianceReportRequest{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(args[0])))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return shim.Error("Invalid report request: " + err.Error())
+	}
+	if request.Zone == "" {
+		return shim.Error("Expecting a zone")
+	}
+	if request.Year < 1970 || request.Year > 9999 {
+		return shim.Error("Invalid year " + strconv.Itoa(request.Year))
+	}
+	request.DeviceIds, err = resolveReportDeviceIds(APIstub, request.Zone, request.DeviceIds)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := validateAggregateSource(request.Source, request.DeviceIds); err != nil {
+		return shim.Error(err.Error())
+	}
+	// rich queries are not re-executed at validation, a report on readings could not be trusted
+	if request.Source == sourceReadings {
+		return shim.Error("Compliance reports are built from the daily aggregates. Readings can only be queried through getDailyMeans")
+	}
+	request.Source = sourceAggregates
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspId, _ := getClientMSPID(APIstub)
+
+	report := ComplianceReport{Id: APIstub.GetTxID(), Zone: request.Zone, Year: request.Year, Source: request.Source, Stations: []StationCompliance{}, Inputs: []InputRange{}, CreatedBy: mspId, CreatedAt: txTime}
+	year := strconv.Itoa(request.Year)
+	for _, deviceId := range request.DeviceIds {
+		aggregates, inputs, err := getDailyAggregates(APIstub, deviceId, year+"-01-01", year+"-12-31")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		report.Stations = append(report.Stations, assessStation(deviceId, request.Year, aggregates))
+		report.Inputs = append(report.Inputs, inputs)
+	}
+	assessZone(&report)
+	report.Hash = complianceReportHash(report)
+
+	reportKey, err := APIstub.CreateCompositeKey(complianceReportKey, []string{report.Zone, year, report.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	reportAsBytes, _ := json.Marshal(report)
+	if err := APIstub.PutState(reportKey, reportAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- createComplianceReport:\n%s\n", reportAsBytes)
+	return shim.Success(reportAsBytes)
+}
+
+// expects a zone and an optional year, returns the compliance reports of the zone
+func (s *SmartContract) getComplianceReports(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(complianceReportKey, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	reports := []ComplianceReport{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		report := ComplianceReport{}
+		if json.Unmarshal(queryResponse.Value, &report) != nil {
+			continue
+		}
+		reports = append(reports, report)
+	}
+	sort.SliceStable(reports, func(i, j int) bool {
+		return reports[i].CreatedAt.Before(reports[j].CreatedAt)
+	})
+	reportsAsBytes, _ := json.Marshal(reports)
+	return shim.Success(reportsAsBytes)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// returns an aggregate of a day fully covered by readings with the given PM means
+func testDailyAggregate(deviceId, date string, pm10, pm25 float64) DailyAggregate {
+	return DailyAggregate{DeviceId: deviceId, Date: date, Hours: 1<<24 - 1, Quantities: map[string]*DailyQuantity{
+		quantityPm10: {Count: 24, Sum: 24 * pm10, Min: pm10, Max: pm10},
+		quantityPm25: {Count: 24, Sum: 24 * pm25, Min: pm25, Max: pm25},
+	}}
+}
+
+func TestDailyAggregate(t *testing.T) {
+	start := time.Date(2019, 7, 6, 0, 30, 0, 0, time.UTC)
+	measurements := []SensorData{}
+	for hour := 0; hour < 18; hour++ {
+		measurements = append(measurements, SensorData{DeviceId: "DEVICE1", Pm10: float32(10 + hour), Pm25: 5, TSdevice: start.Add(time.Duration(hour) * time.Hour)})
+	}
+	aggregates := aggregateReadings(measurements)
+	if len(aggregates) != 1 || aggregates[0].Date != "2019-07-06" || aggregates[0].Quantities[quantityPm10].Max != 27 || aggregates[0].Quantities[quantityPm10].Min != 10 {
+		t.Fatalf("Aggregates were incorrect, got: %+v", aggregates)
+	}
+	if mean, ok := aggregates[0].mean(quantityPm10); !ok || mean != 18.5 {
+		t.Errorf("Mean was incorrect, got: %g %v", mean, ok)
+	}
+	aggregates = aggregateReadings(measurements[1:])
+	if _, ok := aggregates[0].mean(quantityPm10); ok {
+		t.Errorf("Expected a day covered by 17 hours to have no valid mean")
+	}
+	aggregates = aggregateReadings(measurements)
+	aggregates[0].Maintenance = []string{"tx1"}
+	if _, ok := aggregates[0].mean(quantityPm10); ok {
+		t.Errorf("Expected a day with readings during maintenance to have no valid mean")
+	}
+
+	calibrated := SensorData{Pm10: 40, Pm25: 20, Calibrated: []CalibratedValue{{Quantity: quantityPm10, Raw: 40, Value: 30}}}
+	values := complianceValues(calibrated)
+	if values[quantityPm10] != 30 || values[quantityPm25] != 20 {
+		t.Errorf("Expected the calibrated value to replace the raw value, got: %v", values)
+	}
+}
+
+func TestAssessStation(t *testing.T) {
+	aggregates := []DailyAggregate{}
+	day := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 365; i++ {
+		pm10 := 30.0
+		if i < 36 {
+			pm10 = 51
+		}
+		aggregates = append(aggregates, testDailyAggregate("DEVICE1", day.AddDate(0, 0, i).Format(dailyDateLayout), pm10, 20))
+	}
+	station := assessStation("DEVICE1", 2019, aggregates)
+	if station.Pm10ValidDays != 365 || station.Pm10ExceedanceDays != 36 || station.Pm10Assessment != assessmentExceeded || station.Pm10Compliant || station.Pm25AnnualMean == nil || *station.Pm25AnnualMean != 20 || station.Pm25Assessment != assessmentCompliant || !station.Pm25Compliant {
+		t.Errorf("Assessment was incorrect, got: %+v", station)
+	}
+	station = assessStation("DEVICE1", 2019, aggregates[1:])
+	if station.Pm10ExceedanceDays != 35 || station.Pm10Assessment != assessmentCompliant || !station.Pm10Compliant {
+		t.Errorf("Expected 35 exceedances to comply, got: %+v", station)
+	}
+
+	// 328 of 365 days are less than 90 %
+	station = assessStation("DEVICE1", 2019, aggregates[37:])
+	if station.Pm10DataCapture >= minDataCapture || station.Pm10Assessment != assessmentInsufficientData || station.Pm10Compliant || station.Pm25Assessment != assessmentInsufficientData || station.Pm25Compliant {
+		t.Errorf("Expected insufficient data capture not to comply, got: %+v", station)
+	}
+	station = assessStation("DEVICE1", 2019, aggregates[:40])
+	if station.Pm10Assessment != assessmentExceeded {
+		t.Errorf("Expected 36 exceedances to exceed despite insufficient data capture, got: %+v", station)
+	}
+	if assessStation("DEVICE1", 2020, aggregates[1:]).Pm10DataCapture != 364.0/366 {
+		t.Errorf("Expected the data capture of a leap year to be based on 366 days")
+	}
+}
+
+func TestComplianceReport(t *testing.T) {
+	stub := newTestStub()
+	priv := registerTestDevice(stub, 1, "org1")
+	registerTestDevice(stub, 2, "org2")
+
+	ts := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	if response := stub.invoke("m1", buildTestMeasurement(priv, 1, 1, 200, ts, "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	aggregateKey, _ := stub.CreateCompositeKey(dailyAggregateKey, []string{"DEVICE1", ts.Format(dailyDateLayout)})
+	aggregate := DailyAggregate{}
+	json.Unmarshal(stub.State[aggregateKey], &aggregate)
+	if aggregate.Quantities[quantityPm10] == nil || aggregate.Quantities[quantityPm10].Count != 1 || aggregate.Hours != 1<<uint(ts.Hour()) {
+		t.Errorf("Daily aggregate was incorrect, got: %s", stub.State[aggregateKey])
+	}
+	if response := stub.invoke("m2", buildTestMeasurement(priv, 1, 1, 200, ts, "0490033624N", "00082531116E")); response.Message != "Measurement 8017480121707248c4601288a1543101 has already been registered" {
+		t.Errorf("Expected a replayed measurement to be rejected, got: %s", response.Message)
+	}
+	json.Unmarshal(stub.State[aggregateKey], &aggregate)
+	if aggregate.Quantities[quantityPm10].Count != 1 {
+		t.Errorf("Replayed measurement was counted in the daily aggregate, got: %s", stub.State[aggregateKey])
+	}
+
+	// DEVICE1 exceeds the PM10 limit on 40 days, DEVICE2 has a PM2.5 mean of 30 µg/m³
+	stub.MockTransactionStart("setup")
+	day := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 40; i++ {
+		date := day.AddDate(0, 0, i).Format(dailyDateLayout)
+		for deviceId, means := range map[string][2]float64{"DEVICE1": {60, 10}, "DEVICE2": {20, 30}} {
+			key, _ := stub.CreateCompositeKey(dailyAggregateKey, []string{deviceId, date})
+			aggregateAsBytes, _ := json.Marshal(testDailyAggregate(deviceId, date, means[0], means[1]))
+			stub.PutState(key, aggregateAsBytes)
+		}
+	}
+	key, _ := stub.CreateCompositeKey(dailyAggregateKey, []string{"DEVICE1", "2020-01-01"})
+	aggregateAsBytes, _ := json.Marshal(testDailyAggregate("DEVICE1", "2020-01-01", 500, 500))
+	stub.PutState(key, aggregateAsBytes)
+	stub.MockTransactionEnd("setup")
+
+	response := stub.invoke("q1", [][]byte{[]byte("getDailyMeans"), []byte(`{"deviceIds":["DEVICE1","DEVICE2"],"quantity":"pm10","from":"2019-01-01","to":"2019-01-02"}`)})
+	means := DailyMeans{}
+	json.Unmarshal(response.Payload, &means)
+	if len(means.Devices["DEVICE1"]) != 2 || means.Devices["DEVICE1"][0].Mean != 60 || len(means.Zone) != 2 || means.Zone[1].Date != "2019-01-02" || means.Zone[1].Mean != 40 || means.Zone[1].Count != 2 || len(means.Inputs) != 2 || means.Inputs[0].Count != 2 {
+		t.Errorf("Daily means were incorrect, got: %s %s", response.Message, response.Payload)
+	}
+
+	request := `{"zone":"Stuttgart-Mitte","year":2019,"deviceIds":["DEVICE1","DEVICE2"]}`
+	if response := stub.invoke("r1", [][]byte{[]byte("createComplianceReport"), []byte(request)}); response.Message != "Only admins may create compliance reports" {
+		t.Errorf("Expected a non-admin to be rejected, got: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "Admin@org1.example.com")
+	if response := stub.invoke("r5", [][]byte{[]byte("createComplianceReport"), []byte(request)}); response.Message != "Zone Stuttgart-Mitte does not exist" {
+		t.Errorf("Expected a report on an undefined zone to be rejected, got: %s", response.Message)
+	}
+	if response := stub.invoke("z1", [][]byte{[]byte("defineZone"), []byte(`{"id":"Stuttgart-Mitte","deviceIds":["DEVICE1","DEVICE2"]}`)}); response.Message != "" {
+		t.Fatalf("defineZone failed: %s", response.Message)
+	}
+	registerTestDevice(stub, 3, "org1")
+	if response := stub.invoke("r6", [][]byte{[]byte("createComplianceReport"), []byte(`{"zone":"Stuttgart-Mitte","year":2019,"deviceIds":["DEVICE1","DEVICE3"]}`)}); response.Message != "Device DEVICE3 does not belong to zone Stuttgart-Mitte" {
+		t.Errorf("Expected a device outside of the zone to be rejected, got: %s", response.Message)
+	}
+	if response := stub.invoke("r2", [][]byte{[]byte("createComplianceReport"), []byte(`{"zone":"Stuttgart-Mitte","year":2019,"deviceIds":["DEVICE1","DEVICE1"]}`)}); response.Message == "" {
+		t.Errorf("Expected a duplicate device to be rejected")
+	}
+	if response := stub.invoke("r3", [][]byte{[]byte("createComplianceReport"), []byte(`{"zone":"Stuttgart-Mitte","year":2019,"deviceIds":["DEVICE1"],"source":"readings"}`)}); response.Message != "Compliance reports are built from the daily aggregates. Readings can only be queried through getDailyMeans" {
+		t.Errorf("Expected a report on readings to be rejected, got: %s", response.Message)
+	}
+	response = stub.invoke("r4", [][]byte{[]byte("createComplianceReport"), []byte(request)})
+	report := ComplianceReport{}
+	json.Unmarshal(response.Payload, &report)
+	if response.Message != "" || len(report.Stations) != 2 || report.Pm10ExceedanceDays != 40 || report.Pm10Assessment != assessmentExceeded || report.Pm10Compliant || report.Pm25Assessment != assessmentInsufficientData || report.Pm25Compliant || report.Pm25AnnualMean == nil || math.Abs(*report.Pm25AnnualMean-20) > 1e-9 || report.Source != sourceAggregates {
+		t.Fatalf("Report was incorrect, got: %s %s", response.Message, response.Payload)
+	}
+	start, _ := stub.CreateCompositeKey(dailyAggregateKey, []string{"DEVICE1", "2019-01-01"})
+	end, _ := stub.CreateCompositeKey(dailyAggregateKey, []string{"DEVICE1", "2019-02-09"})
+	if report.Inputs[0].StartKey != start || report.Inputs[0].EndKey != end || report.Inputs[0].Count != 40 {
+		t.Errorf("Input range was incorrect, got: %+v", report.Inputs[0])
+	}
+	if report.Hash == "" || complianceReportHash(report) != report.Hash {
+		t.Errorf("Report hash could not be verified, got: %s", report.Hash)
+	}
+
+	response = stub.invoke("q2", [][]byte{[]byte("getComplianceReports"), []byte("Stuttgart-Mitte"), []byte(strconv.Itoa(2019))})
+	reports := []ComplianceReport{}
+	json.Unmarshal(response.Payload, &reports)
+	if len(reports) != 1 || reports[0].Id != "r4" || reports[0].Hash != report.Hash {
+		t.Errorf("Stored reports were incorrect, got: %s", response.Payload)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+/*
+ * COSE encoding scheme (encoding scheme 2).
+ * The measurement is a CBOR map signed as COSE_Sign1 (RFC 8152), so the signature is part of
+ * the frame and the detached signature argument stays empty. The protected header carries the
+ * algorithm (-8 EdDSA or -7 ES256, matching the device key) and the key ID, which is the
+ * device ID as UTF-8, e.g. DEVICE12.
+ *
+ * Payload labels:
+ *	1: UUID of the measurement (16 byte string)
+ *	2: timestamp in seconds since 1970-01-01 00:00:00 UTC (integer, optionally with tag 1)
+ *	3: Pm10, 4: Pm25 (µg/m³), 5: Temp (°C), 6: Humidity (%)
+ *	7: latitude, 8: longtitude in decimal degrees
+ */
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+const coseEncodingScheme = 2
+
+// CBOR tag of COSE_Sign1 and the header labels and algorithms used here
+const (
+	coseSign1Tag            = 18
+	coseHeaderAlgorithm     = 1
+	coseHeaderKeyId         = 4
+	coseAlgorithmEdDSA      = -8
+	coseAlgorithmES256      = -7
+	coseMeasurementUUID     = 1
+	coseMeasurementTime     = 2
+	coseMeasurementPm10     = 3
+	coseMeasurementPm25     = 4
+	coseMeasurementTemp     = 5
+	coseMeasurementHumidity = 6
+	coseMeasurementLat      = 7
+	coseMeasurementLon      = 8
+)
+
+// Define the COSE_Sign1 structure, the parts of a signed COSE message
+type COSESign1 struct {
+	Protected []byte
+	Algorithm int64
+	KeyId     string
+	Payload   []byte
+	Signature []byte
+}
+
+// checks whether the frame looks like a COSE_Sign1 message instead of a 0xAA frame
+func isCOSESign1(b []byte) bool {
+	// tag 18 or an array of four items
+	return len(b) > 0 && (b[0] == 0xd2 || b[0] == 0x84)
+}
+
+// parses a tagged or untagged COSE_Sign1 message
+func parseCOSESign1(b []byte) (COSESign1, error) {
+	item, err := decodeCBOR(b)
+	if err != nil {
+		return COSESign1{}, err
+	}
+	if tag, ok := item.(CBORTag); ok {
+		if tag.Number != coseSign1Tag {
+			return COSESign1{}, fmt.Errorf("Unexpected CBOR tag %d. Expecting %d (COSE_Sign1)", tag.Number, coseSign1Tag)
+		}
+		item = tag.Content
+	}
+	parts, ok := item.([]interface{})
+	if !ok || len(parts) != 4 {
+		return COSESign1{}, errors.New("COSE_Sign1 must be an array of four items")
+	}
+	protected, ok1 := parts[0].([]byte)
+	_, ok2 := parts[1].(map[interface{}]interface{})
+	payload, ok3 := parts[2].([]byte)
+	signature, ok4 := parts[3].([]byte)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return COSESign1{}, errors.New("Invalid COSE_Sign1 structure")
+	}
+	headerItem, err := decodeCBOR(protected)
+	if err != nil {
+		return COSESign1{}, errors.New("Invalid protected header: " + err.Error())
+	}
+	header, ok := headerItem.(map[interface{}]interface{})
+	if !ok {
+		return COSESign1{}, errors.New("Protected header must be a map")
+	}
+	algorithm, ok := header[int64(coseHeaderAlgorithm)].(int64)
+	if !ok {
+		return COSESign1{}, errors.New("Protected header must contain the algorithm")
+	}
+	keyId, ok := header[int64(coseHeaderKeyId)].([]byte)
+	if !ok {
+		return COSESign1{}, errors.New("Protected header must contain the key ID")
+	}
+	return COSESign1{Protected: protected, Algorithm: algorithm, KeyId: string(keyId), Payload: payload, Signature: signature}, nil
+}
+
+// returns the Sig_structure of the message, the bytes which are signed
+func (message COSESign1) sigStructure() []byte {
+	structure := encodeCBORHead(cborArray, 4)
+	structure = append(structure, encodeCBORText("Signature1")...)
+	structure = append(structure, encodeCBORBytes(message.Protected)...)
+	// no external additional authenticated data
+	structure = append(structure, encodeCBORBytes(nil)...)
+	return append(structure, encodeCBORBytes(message.Payload)...)
+}
+
+// returns the number of the device the key ID refers to
+func coseDeviceId(message COSESign1) (uint16, error) {
+	number := deviceNumber(message.KeyId)
+	if number < 1 || number > math.MaxUint16 || message.KeyId != "DEVICE"+strconv.Itoa(number) {
+		return 0, errors.New("Invalid key ID " + strconv.Quote(message.KeyId) + ". Expecting a device ID")
+	}
+	return uint16(number), nil
+}
+
+func decodeMessageWithCOSEEncodingScheme(b []byte, device DeviceInfo, deviceId uint16) (SensorData, string) {
+	message, err := parseCOSESign1(b)
+	if err != nil {
+		return SensorData{}, ""
+	}
+	expectedAlgorithm := int64(coseAlgorithmEdDSA)
+	if deviceSignatureAlgorithm(device) == algorithmECDSAP256 {
+		expectedAlgorithm = coseAlgorithmES256
+	}
+	if message.Algorithm != expectedAlgorithm {
+		return SensorData{}, ""
+	}
+	if !verifyDeviceSignature(device, message.sigStructure(), message.Signature) {
+		return SensorData{}, ""
+	}
+	data, txId, err := decodeCOSEPayload(message.Payload)
+	if err != nil {
+		return SensorData{}, ""
+	}
+	data.DeviceId = "DEVICE" + strconv.Itoa(int(deviceId))
+	return data, txId
+}
+
+// decodes the CBOR map of the measurement
+func decodeCOSEPayload(payload []byte) (SensorData, string, error) {
+	item, err := decodeCBOR(payload)
+	if err != nil {
+		return SensorData{}, "", err
+	}
+	fields, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return SensorData{}, "", errors.New("Payload must be a map")
+	}
+	uuid, ok := fields[int64(coseMeasurementUUID)].([]byte)
+	if !ok || len(uuid) != 16 {
+		return SensorData{}, "", errors.New("Payload must contain a 16 byte UUID")
+	}
+	timestamp := fields[int64(coseMeasurementTime)]
+	if tag, ok := timestamp.(CBORTag); ok && tag.Number == 1 {
+		timestamp = tag.Content
+	}
+	seconds, ok := timestamp.(int64)
+	if !ok || seconds < 0 {
+		return SensorData{}, "", errors.New("Payload must contain the timestamp as epoch seconds")
+	}
+	values := make(map[int64]float64)
+	for _, label := range []int64{coseMeasurementPm10, coseMeasurementPm25, coseMeasurementTemp, coseMeasurementHumidity, coseMeasurementLat, coseMeasurementLon} {
+		value, ok := cborNumber(fields[label])
+		if !ok {
+			return SensorData{}, "", fmt.Errorf("Payload must contain a number with label %d", label)
+		}
+		values[label] = value
+	}
+	lat, lon := values[coseMeasurementLat], values[coseMeasurementLon]
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return SensorData{}, "", fmt.Errorf("Coordinate %g,%g out of range", lat, lon)
+	}
+	// seven decimal places, like the coordinates parsed from the frames
+	lat, lon = math.Round(lat*1e7)/1e7, math.Round(lon*1e7)/1e7
+	data := SensorData{
+		Pm10:       float32(values[coseMeasurementPm10]),
+		Pm25:       float32(values[coseMeasurementPm25]),
+		Temp:       float32(values[coseMeasurementTemp]),
+		Humidity:   float32(values[coseMeasurementHumidity]),
+		TSdevice:   time.Unix(seconds, 0).UTC(),
+		Lat:        lat,
+		Lon:        lon,
+		Latitude:   formatCoordinate(lat, 'N', 'S'),
+		Longtitude: formatCoordinate(lon, 'E', 'W'),
+	}
+	return data, hex.EncodeToString(uuid), nil
+}
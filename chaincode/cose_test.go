@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCBORDecoding(t *testing.T) {
+	// examples from RFC 8949, appendix A
+	tests := []struct {
+		encoded  string
+		expected interface{}
+	}{
+		{"00", int64(0)},
+		{"1903e8", int64(1000)},
+		{"1b7fffffffffffffff", int64(math.MaxInt64)},
+		{"3863", int64(-100)},
+		{"f93c00", 1.0},
+		{"f97bff", 65504.0},
+		{"f90001", 5.960464477539063e-8},
+		{"fa47c35000", 100000.0},
+		{"fb3ff199999999999a", 1.1},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"6449455446", "IETF"},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"c11a514b67b0", CBORTag{Number: 1, Content: int64(1363896240)}},
+	}
+	for _, test := range tests {
+		b, _ := hex.DecodeString(test.encoded)
+		item, err := decodeCBOR(b)
+		if err != nil || !reflect.DeepEqual(item, test.expected) {
+			t.Errorf("Decoding of %s was incorrect, got: %#v %v, want: %#v", test.encoded, item, err, test.expected)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"5f42010243030405ff", // indefinite length
+		"1bffffffffffffffff", // exceeds int64
+		"830102",             // truncated array
+		"5a00000100",         // truncated byte string
+		"0000",               // trailing bytes
+		"a201020103",         // duplicate map key
+		"a1430102030405",     // byte string as map key
+		"f820",               // simple value
+		"818181818181818181818181818181818181818100",
+	}
+	for _, encoded := range invalid {
+		b, _ := hex.DecodeString(encoded)
+		if item, err := decodeCBOR(b); err == nil {
+			t.Errorf("Expected an error for %s, got: %#v", encoded, item)
+		}
+	}
+}
+
+// COSE_Sign1 test vectors, CBOR encoded by hand following RFC 8949 and RFC 8152
+// The EdDSA vector uses the key of RFC 8032 test 1, the ES256 vector the key of RFC 6979 A.2.5.
+const (
+	testCOSEEdDSAKey     = "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+	testCOSEEdDSAMessage = "d2844ca20127044744455649434531a05844a801508017480121707248c4601288a1543101021a5d20de1c03fb401599999999999a04f9410005fa41ac000006183007fb404880b7a1c25d0708fbc020d9dd92edadee5840f739a4708b507a9d0d9729ecab2b1314cc37e0ef6156413d2ca5b83f2ce728116bf665fe59cddb4b0266a06eb4513076bfc491afcf64cfa40acc919fbf480c08"
+	testCOSEES256Message = "844ca20126044744455649434532a0583ca801508017480121707248c4601288a154310202c11a5d20de1c030c04fa40e80000052206f952f007fbc040ef357be2cf6e08fb4062e6b28c79f6665840cda2e13dc6fa33184ba128fdb1a046db22585cd2b11f0e03189f73f71d4d7921750d0bd1bf0a9d3a76651c611acafa19e32ff220616baec0ab7f8a58a6a50d81"
+)
+
+func registerCOSEMessage(stub *testStub, txId, message string) string {
+	b, _ := hex.DecodeString(message)
+	return stub.invoke(txId, [][]byte{[]byte("registerMeasurement"), []byte(base64.StdEncoding.EncodeToString(b)), []byte(""), []byte("2019-07-06 19:45:10+02:00")}).Message
+}
+
+func TestCOSEEncodingScheme(t *testing.T) {
+	stub := newTestStub()
+	stub.invoke("tx1", [][]byte{[]byte("registerDevice"), []byte(testCOSEEdDSAKey), []byte("2"), []byte("org1"), []byte("true")})
+	stub.invoke("tx2", [][]byte{[]byte("registerDevice"), []byte(testP256UncompressedKey), []byte("2"), []byte("org2"), []byte("true")})
+
+	tests := []struct {
+		message  string
+		uuid     string
+		expected SensorData
+	}{
+		{testCOSEEdDSAMessage, "8017480121707248c4601288a1543101", SensorData{DocType: measurementDocType, DeviceId: "DEVICE1", Pm10: 5.4, Pm25: 2.5, Temp: 21.5, Humidity: 48, Lat: 49.005604, Lon: -8.4255186, Latitude: "49°00.33624'N", Longtitude: "8°25.53112'W"}},
+		{testCOSEES256Message, "8017480121707248c4601288a1543102", SensorData{DocType: measurementDocType, DeviceId: "DEVICE2", Pm10: 12, Pm25: 7.25, Temp: -3, Humidity: 55.5, Lat: -33.8688197, Lon: 151.2092955, Latitude: "33°52.12918'S", Longtitude: "151°12.55773'E"}},
+	}
+	for i, test := range tests {
+		if message := registerCOSEMessage(stub, "m"+test.uuid, test.message); message != "" {
+			t.Fatalf("registerMeasurement of vector %d failed: %s", i, message)
+		}
+		data := SensorData{}
+		json.Unmarshal(stub.State[test.uuid], &data)
+		if !data.TSdevice.Equal(time.Date(2019, 7, 6, 17, 45, 0, 0, time.UTC)) || data.TSdeviceEpoch != data.TSdevice.Unix() {
+			t.Errorf("Timestamp of vector %d was incorrect, got: %s %d", i, data.TSdevice, data.TSdeviceEpoch)
+		}
+		data.TSdevice, data.TSdeviceEpoch, data.TSgw, data.Geohash, data.SubmittedBy, data.Owner = time.Time{}, 0, time.Time{}, "", "", ""
+		if !reflect.DeepEqual(data, test.expected) {
+			t.Errorf("Decoding of vector %d was incorrect, got: %+v, want: %+v", i, data, test.expected)
+		}
+	}
+
+	tampered, _ := hex.DecodeString(testCOSEEdDSAMessage)
+	tampered[40] ^= 1
+	if message := registerCOSEMessage(stub, "m3", hex.EncodeToString(tampered)); message == "" {
+		t.Errorf("Expected a tampered message to be rejected")
+	}
+	stub.invoke("tx3", [][]byte{[]byte("registerDevice"), []byte("pQBakw2oxXklWGruTdMVnbbNsNG+nsojdlusAiaRVLU"), []byte("1"), []byte("org1"), []byte("true")})
+	withOtherKeyId := "d2844ca20127044744455649434533" + testCOSEEdDSAMessage[30:]
+	if message := registerCOSEMessage(stub, "m4", withOtherKeyId); message != "Frame does not match encoding scheme 1 of DEVICE3" {
+		t.Errorf("Expected a COSE message for a device with another scheme to be rejected, got: %s", message)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+/*
+ * State-based endorsement for device keys.
+ * Every device key carries a key-level endorsement policy requiring an endorsement of the
+ * organization owning the device. Independent of the chaincode endorsement policy, changes
+ * to a device (revocation, owner details, transfers) are then only valid if a peer of the
+ * owning organization endorsed them.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// sets the key-level endorsement policy of the device key to the given organizations
+func setDeviceEndorsementPolicy(APIstub shim.ChaincodeStubInterface, deviceId string, mspIds ...string) error {
+	endorsementPolicy, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return err
+	}
+	// the MSPs of this network are configured without node OUs, so peers can only be identified as members
+	if err := endorsementPolicy.AddOrgs(statebased.RoleTypeMember, mspIds...); err != nil {
+		return err
+	}
+	policy, err := endorsementPolicy.Policy()
+	if err != nil {
+		return err
+	}
+	return APIstub.SetStateValidationParameter(deviceId, policy)
+}
+
+// returns the organizations required to endorse changes of the device key, ordered by MSP ID
+func getDeviceEndorsementOrgs(APIstub shim.ChaincodeStubInterface, deviceId string) ([]string, error) {
+	policy, err := APIstub.GetStateValidationParameter(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil {
+		return []string{}, nil
+	}
+	endorsementPolicy, err := statebased.NewStateEP(policy)
+	if err != nil {
+		return nil, err
+	}
+	// the policy keeps its organizations in a map
+	orgs := endorsementPolicy.ListOrgs()
+	sort.Strings(orgs)
+	return orgs, nil
+}
+
+/*
+ * Sets the key-level endorsement policy for all devices which were registered before
+ * state-based endorsement was introduced. Devices which already have a policy are skipped.
+ * Only admins may run the migration.
+ */
+func (s *SmartContract) setDeviceEndorsementPolicies(APIstub shim.ChaincodeStubInterface) sc.Response {
+	admin, err := isClientAdmin(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !admin {
+		return shim.Error("Only admins may set the endorsement policies of devices")
+	}
+	resultsIterator, err := APIstub.GetStateByRange(deviceRangeStartKey, deviceRangeEndKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	updated := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !strings.HasPrefix(queryResponse.Key, "DEVICE") {
+			continue
+		}
+		orgs, err := getDeviceEndorsementOrgs(APIstub, queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(orgs) > 0 {
+			continue
+		}
+		device := DeviceInfo{}
+		if json.Unmarshal(queryResponse.Value, &device) != nil || device.Owner == "" {
+			continue
+		}
+		if err := setDeviceEndorsementPolicy(APIstub, queryResponse.Key, ownerMSPID(device.Owner)); err != nil {
+			return shim.Error(err.Error())
+		}
+		updated = append(updated, queryResponse.Key)
+	}
+	updatedAsBytes, _ := json.Marshal(updated)
+	fmt.Printf("- setDeviceEndorsementPolicies:\n%s\n", updatedAsBytes)
+	return shim.Success(updatedAsBytes)
+}
+
+// returns the organizations whose endorsement is required to modify the device
+func (s *SmartContract) getDeviceEndorsementPolicy(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	orgs, err := getDeviceEndorsementOrgs(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	orgsAsBytes, _ := json.Marshal(orgs)
+	return shim.Success(orgsAsBytes)
+}
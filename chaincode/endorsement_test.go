@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRegisterDeviceSetsEndorsementPolicy(t *testing.T) {
+	stub := newTestStub()
+	response := stub.invoke("tx1", [][]byte{[]byte("registerDevice"), []byte("pQBakw2oxXklWGruTdMVnbbNsNG+nsojdlusAiaRVLU"), []byte("0"), []byte("org2"), []byte("true")})
+	if response.Message != "" {
+		t.Fatalf("registerDevice failed: %s", response.Message)
+	}
+	orgs, err := getDeviceEndorsementOrgs(stub, "DEVICE1")
+	if err != nil {
+		t.Fatalf("Reading the endorsement policy failed: %s", err)
+	}
+	if !reflect.DeepEqual(orgs, []string{"Org2MSP"}) {
+		t.Errorf("Expected the owning organization to be required, got: %v", orgs)
+	}
+}
+
+func TestSetDeviceEndorsementPolicies(t *testing.T) {
+	stub := newTestStub()
+	registerTestDevice(stub, 1, "org1")
+	registerTestDevice(stub, 2, "Org2MSP")
+	stub.MockTransactionStart("setup")
+	setDeviceEndorsementPolicy(stub, "DEVICE2", "Org1MSP", "Org2MSP")
+	stub.MockTransactionEnd("setup")
+
+	if response := stub.invoke("tx0", [][]byte{[]byte("setDeviceEndorsementPolicies")}); response.Message == "" {
+		t.Errorf("Expected a client which is not an admin to be rejected")
+	}
+	stub.setCaller("Org1MSP", "Admin@org1.example.com")
+	response := stub.invoke("tx1", [][]byte{[]byte("setDeviceEndorsementPolicies")})
+	updated := []string{}
+	json.Unmarshal(response.Payload, &updated)
+	if !reflect.DeepEqual(updated, []string{"DEVICE1"}) {
+		t.Errorf("Expected only DEVICE1 to be updated, got: %s %s", response.Message, string(response.Payload))
+	}
+	response = stub.invoke("q1", [][]byte{[]byte("getDeviceEndorsementPolicy"), []byte("DEVICE1")})
+	if string(response.Payload) != `["Org1MSP"]` {
+		t.Errorf("Unexpected policy for DEVICE1: %s", string(response.Payload))
+	}
+	response = stub.invoke("q2", [][]byte{[]byte("getDeviceEndorsementPolicy"), []byte("DEVICE2")})
+	if string(response.Payload) != `["Org1MSP","Org2MSP"]` {
+		t.Errorf("Existing policy of DEVICE2 must not be changed, got: %s", string(response.Payload))
+	}
+}
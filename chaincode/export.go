@@ -0,0 +1,295 @@
+package main
+
+/*
+ * Export of measurements for open data portals.
+ *	senml:		SenML JSON (RFC 8428), one pack of records per measurement with the device ID as
+ *			base name, e.g. DEVICE1:pm10, and the device timestamp as base time.
+ *			Location is given as lat and lon records. Channels flagged invalid are left
+ *			out, SenML has no way to mark them.
+ *	sensorthings:	OGC SensorThings API 1.1, the devices as Things with their Locations and one
+ *			Datastream per quantity, the readings as Observations of the Datastreams, like
+ *			the response to Things?$expand=Locations,Datastreams/Observations
+ * Units are converted to the registered SenML units where the stored unit has none.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const sensorThingsMeasurement = "http://www.opengis.net/def/observationType/OGC-OM/2.0/OM_Measurement"
+
+// Define the export unit structure, how a unit of the quantity registry is exported
+type ExportUnit struct {
+	SenML      string
+	Factor     float64
+	Name       string
+	Symbol     string
+	Definition string
+}
+
+// export units of the units of the quantity registry
+var exportUnits = map[string]ExportUnit{
+	"ug/m3": {"ug/m3", 1, "Microgram per cubic metre", "µg/m³", "http://qudt.org/vocab/unit/MicroGM-PER-M3"},
+	"mg/m3": {"ug/m3", 1000, "Microgram per cubic metre", "µg/m³", "http://qudt.org/vocab/unit/MicroGM-PER-M3"},
+	"Cel":   {"Cel", 1, "Degree Celsius", "°C", "http://qudt.org/vocab/unit/DEG_C"},
+	"%RH":   {"%RH", 1, "Percent relative humidity", "%", "http://qudt.org/vocab/unit/PERCENT"},
+	"ppm":   {"ppm", 1, "Parts per million", "ppm", "http://qudt.org/vocab/unit/PPM"},
+	"dB(A)": {"dB", 1, "Decibel (A-weighted)", "dB(A)", "http://qudt.org/vocab/unit/DeciB"},
+}
+
+// Define the SenML record structure (RFC 8428)
+type SenMLRecord struct {
+	BaseName string   `json:"bn,omitempty"`
+	BaseTime float64  `json:"bt,omitempty"`
+	Name     string   `json:"n"`
+	Unit     string   `json:"u,omitempty"`
+	Value    *float64 `json:"v,omitempty"`
+}
+
+// Define the SensorThings Thing structure, a device with its locations and datastreams
+type STThing struct {
+	Id          string            `json:"@iot.id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Properties  map[string]string `json:"properties,omitempty"`
+	Locations   []STLocation      `json:"Locations"`
+	Datastreams []STDatastream    `json:"Datastreams"`
+}
+
+// Define the SensorThings Location structure
+type STLocation struct {
+	Name         string  `json:"name"`
+	Description  string  `json:"description"`
+	EncodingType string  `json:"encodingType"`
+	Location     GeoJSON `json:"location"`
+}
+
+// Define the GeoJSON geometry structure
+type GeoJSON struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// Define the SensorThings unit of measurement structure
+type STUnitOfMeasurement struct {
+	Name       string `json:"name"`
+	Symbol     string `json:"symbol"`
+	Definition string `json:"definition"`
+}
+
+// Define the SensorThings ObservedProperty structure
+type STObservedProperty struct {
+	Name        string `json:"name"`
+	Definition  string `json:"definition"`
+	Description string `json:"description"`
+}
+
+// Define the SensorThings Sensor structure
+type STSensor struct {
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	EncodingType string `json:"encodingType"`
+	Metadata     string `json:"metadata"`
+}
+
+// Define the SensorThings Datastream structure, the readings of one quantity of a device
+type STDatastream struct {
+	Id                string              `json:"@iot.id"`
+	Name              string              `json:"name"`
+	Description       string              `json:"description"`
+	ObservationType   string              `json:"observationType"`
+	UnitOfMeasurement STUnitOfMeasurement `json:"unitOfMeasurement"`
+	ObservedProperty  STObservedProperty  `json:"ObservedProperty"`
+	Sensor            STSensor            `json:"Sensor"`
+	Observations      []STObservation     `json:"Observations"`
+}
+
+// Define the SensorThings Observation structure, one value of a measurement
+type STObservation struct {
+	Id             string            `json:"@iot.id"`
+	PhenomenonTime string            `json:"phenomenonTime"`
+	ResultTime     *string           `json:"resultTime"`
+	Result         float64           `json:"result"`
+	ResultQuality  string            `json:"resultQuality"`
+	Parameters     map[string]string `json:"parameters"`
+}
+
+// Define the measurement record structure, a decoded measurement and its key
+type measurementRecord struct {
+	Key  string
+	Data SensorData
+}
+
+// returns the channel value in the export unit
+func exportValue(channel Channel) (float64, ExportUnit, bool) {
+	unit, ok := exportUnits[channel.Unit]
+	if !ok {
+		return 0, ExportUnit{}, false
+	}
+	return channel.Value * unit.Factor, unit, true
+}
+
+// renders the measurements as SenML pack
+func measurementsToSenML(measurements []measurementRecord) []SenMLRecord {
+	pack := []SenMLRecord{}
+	for _, measurement := range measurements {
+		data := measurement.Data
+		records := []SenMLRecord{}
+		for _, channel := range measurementChannels(data) {
+			value, unit, ok := exportValue(channel)
+			if !ok || channel.QualityFlag == "invalid" {
+				continue
+			}
+			records = append(records, SenMLRecord{Name: channel.Quantity, Unit: unit.SenML, Value: &value})
+		}
+		lat, lon := data.Lat, data.Lon
+		records = append(records, SenMLRecord{Name: "lat", Unit: "lat", Value: &lat}, SenMLRecord{Name: "lon", Unit: "lon", Value: &lon})
+		records[0].BaseName = data.DeviceId + ":"
+		records[0].BaseTime = float64(data.TSdevice.Unix())
+		pack = append(pack, records...)
+	}
+	return pack
+}
+
+// formats a time for SensorThings, nil for the zero time
+func sensorThingsTime(t time.Time) *string {
+	if t.IsZero() {
+		return nil
+	}
+	str := t.UTC().Format(time.RFC3339)
+	return &str
+}
+
+// renders the devices of the measurements as Things with their Datastreams and Observations
+// the location of a Thing is the location of its latest measurement
+func measurementsToSensorThings(measurements []measurementRecord, devices map[string]DeviceInfo) []STThing {
+	things := make(map[string]*STThing)
+	datastreams := make(map[string]map[string]*STDatastream)
+	for _, measurement := range measurements {
+		data := measurement.Data
+		thing, ok := things[data.DeviceId]
+		if !ok {
+			device := devices[data.DeviceId]
+			thing = &STThing{
+				Id:          data.DeviceId,
+				Name:        data.DeviceId,
+				Description: "Air quality sensor " + data.DeviceId,
+				Properties:  map[string]string{"owner": device.Owner},
+				Datastreams: []STDatastream{},
+			}
+			things[data.DeviceId] = thing
+			datastreams[data.DeviceId] = make(map[string]*STDatastream)
+		}
+		thing.Locations = []STLocation{{
+			Name:         "Location of " + data.DeviceId,
+			Description:  "Location of the latest measurement",
+			EncodingType: "application/geo+json",
+			Location:     GeoJSON{Type: "Point", Coordinates: []float64{data.Lon, data.Lat}},
+		}}
+		for _, channel := range measurementChannels(data) {
+			value, unit, ok := exportValue(channel)
+			quantity, known := quantityByName(channel.Quantity)
+			if !ok || !known {
+				continue
+			}
+			datastream, ok := datastreams[data.DeviceId][channel.Quantity]
+			if !ok {
+				device := devices[data.DeviceId]
+				datastream = &STDatastream{
+					Id:                data.DeviceId + ":" + channel.Quantity,
+					Name:              quantity.Description + " at " + data.DeviceId,
+					Description:       quantity.Description + " measured by " + data.DeviceId,
+					ObservationType:   sensorThingsMeasurement,
+					UnitOfMeasurement: STUnitOfMeasurement{Name: unit.Name, Symbol: unit.Symbol, Definition: unit.Definition},
+					ObservedProperty:  STObservedProperty{Name: quantity.Quantity, Definition: quantity.Definition, Description: quantity.Description},
+					Sensor: STSensor{
+						Name:         data.DeviceId,
+						Description:  "Sensor of " + data.DeviceId,
+						EncodingType: "text/plain",
+						Metadata:     fmt.Sprintf("encoding scheme %d, signature algorithm %s", device.EncodingScheme, deviceSignatureAlgorithm(device)),
+					},
+					Observations: []STObservation{},
+				}
+				datastreams[data.DeviceId][channel.Quantity] = datastream
+			}
+			datastream.Observations = append(datastream.Observations, STObservation{
+				Id:             measurement.Key + ":" + channel.Quantity,
+				PhenomenonTime: data.TSdevice.UTC().Format(time.RFC3339),
+				ResultTime:     sensorThingsTime(data.TSgw),
+				Result:         value,
+				ResultQuality:  channel.QualityFlag,
+				Parameters:     map[string]string{"measurementId": measurement.Key, "submittedBy": data.SubmittedBy},
+			})
+		}
+	}
+
+	result := []STThing{}
+	for deviceId, thing := range things {
+		// Datastreams in the order of the quantity registry
+		for _, quantity := range quantityRegistry {
+			if datastream, ok := datastreams[deviceId][quantity.Quantity]; ok {
+				thing.Datastreams = append(thing.Datastreams, *datastream)
+			}
+		}
+		result = append(result, *thing)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return deviceNumber(result[i].Id) < deviceNumber(result[j].Id)
+	})
+	return result
+}
+
+/*
+ * Expects the format (senml or sensorthings) and a JSON object with the MeasurementQuery fields,
+ * see queryMeasurements
+ */
+func (s *SmartContract) exportMeasurements(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if args[0] != "senml" && args[0] != "sensorthings" {
+		return shim.Error("Invalid format " + args[0] + ". Expecting senml or sensorthings")
+	}
+	query, err := parseMeasurementQuery(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	records, err := queryMeasurementRecords(APIstub, query)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	measurements := []measurementRecord{}
+	devices := make(map[string]DeviceInfo)
+	for _, record := range records {
+		data := SensorData{}
+		if json.Unmarshal(record.Record, &data) != nil {
+			continue
+		}
+		measurements = append(measurements, measurementRecord{Key: record.Key, Data: data})
+		if _, ok := devices[data.DeviceId]; ok {
+			continue
+		}
+		device := DeviceInfo{}
+		deviceAsBytes, err := APIstub.GetState(data.DeviceId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		json.Unmarshal(deviceAsBytes, &device)
+		devices[data.DeviceId] = device
+	}
+
+	var exportAsBytes []byte
+	if args[0] == "senml" {
+		exportAsBytes, _ = json.Marshal(measurementsToSenML(measurements))
+	} else {
+		exportAsBytes, _ = json.Marshal(map[string]interface{}{"value": measurementsToSensorThings(measurements, devices)})
+	}
+	fmt.Printf("- exportMeasurements:\n%s\n", exportAsBytes)
+	return shim.Success(exportAsBytes)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// validates the JSON value against a subset of JSON Schema: type, required, properties, items, pattern and enum
+func validateSchema(value interface{}, schema map[string]interface{}, path string) []string {
+	errors := []string{}
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{path + " is not an object"}
+		}
+		for _, required := range schema["required"].([]interface{}) {
+			if _, ok := object[required.(string)]; !ok {
+				errors = append(errors, path+" lacks "+required.(string))
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, property := range properties {
+			if propertyValue, ok := object[name]; ok {
+				errors = append(errors, validateSchema(propertyValue, property.(map[string]interface{}), path+"."+name)...)
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []string{path + " is not an array"}
+		}
+		for i, item := range array {
+			errors = append(errors, validateSchema(item, schema["items"].(map[string]interface{}), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return []string{path + " is not a string"}
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(str) {
+			errors = append(errors, path+" does not match "+pattern)
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, allowed := range enum {
+				found = found || allowed == str
+			}
+			if !found {
+				errors = append(errors, path+" is not one of the allowed values: "+str)
+			}
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return []string{path + " is not a number"}
+		}
+	}
+	return errors
+}
+
+// SenML JSON records (RFC 8428 section 4 and 5), units of the SenML units registry
+const testSenMLSchema = `{
+	"type": "array",
+	"items": {
+		"type": "object",
+		"required": ["n", "v"],
+		"properties": {
+			"bn": {"type": "string", "pattern": "^[A-Za-z0-9][-:./_A-Za-z0-9]*$"},
+			"bt": {"type": "number"},
+			"n": {"type": "string", "pattern": "^[-:./_A-Za-z0-9]+$"},
+			"u": {"type": "string", "enum": ["ug/m3", "Cel", "%RH", "ppm", "dB", "lat", "lon"]},
+			"v": {"type": "number"},
+			"t": {"type": "number"}
+		}
+	}
+}`
+
+// mandatory properties of the SensorThings API 1.1 entities
+const testSensorThingsSchema = `{
+	"type": "object",
+	"required": ["value"],
+	"properties": {"value": {"type": "array", "items": {
+		"type": "object",
+		"required": ["@iot.id", "name", "description", "Locations", "Datastreams"],
+		"properties": {
+			"name": {"type": "string"},
+			"description": {"type": "string"},
+			"Locations": {"type": "array", "items": {
+				"type": "object",
+				"required": ["name", "description", "encodingType", "location"],
+				"properties": {
+					"encodingType": {"type": "string", "enum": ["application/geo+json", "application/vnd.geo+json"]},
+					"location": {"type": "object", "required": ["type", "coordinates"], "properties": {
+						"type": {"type": "string", "enum": ["Point"]},
+						"coordinates": {"type": "array", "items": {"type": "number"}}
+					}}
+				}
+			}},
+			"Datastreams": {"type": "array", "items": {
+				"type": "object",
+				"required": ["name", "description", "observationType", "unitOfMeasurement", "ObservedProperty", "Sensor", "Observations"],
+				"properties": {
+					"observationType": {"type": "string", "pattern": "^http://www.opengis.net/def/observationType/OGC-OM/2.0/"},
+					"unitOfMeasurement": {"type": "object", "required": ["name", "symbol", "definition"], "properties": {
+						"definition": {"type": "string", "pattern": "^https?://"}
+					}},
+					"ObservedProperty": {"type": "object", "required": ["name", "definition", "description"], "properties": {
+						"definition": {"type": "string", "pattern": "^https?://"}
+					}},
+					"Sensor": {"type": "object", "required": ["name", "description", "encodingType", "metadata"]},
+					"Observations": {"type": "array", "items": {
+						"type": "object",
+						"required": ["phenomenonTime", "result", "resultTime"],
+						"properties": {
+							"phenomenonTime": {"type": "string", "pattern": "^\\d{4}-\\d{2}-\\d{2}T\\d{2}:\\d{2}:\\d{2}(Z|[+-]\\d{2}:\\d{2})$"},
+							"result": {"type": "number"}
+						}
+					}}
+				}
+			}}
+		}
+	}}}
+}`
+
+func testExportMeasurements() []measurementRecord {
+	ts := time.Date(2019, 7, 6, 17, 45, 0, 0, time.UTC)
+	return []measurementRecord{
+		{Key: "8017480121707248c4601288a1543101", Data: SensorData{DeviceId: "DEVICE1", Pm10: 5.4, Pm25: 2.5, Temp: 21.5, Humidity: 48, TSdevice: ts, TSgw: ts.Add(10 * time.Second), Lat: 49.005604, Lon: 8.4255186}},
+		{Key: "8017480121707248c4601288a1543102", Data: SensorData{DeviceId: "DEVICE12", TSdevice: ts.Add(time.Minute), Lat: 49.1, Lon: 8.5, Channels: []Channel{
+			{Quantity: "pm10", Unit: "ug/m3", Value: 12.5, QualityFlag: "ok"},
+			{Quantity: "co", Unit: "mg/m3", Value: 0.4, QualityFlag: "ok"},
+			{Quantity: "no2", Unit: "ug/m3", Value: 900, QualityFlag: "invalid"},
+			{Quantity: "noise", Unit: "dB(A)", Value: 63.5, QualityFlag: "suspect"},
+		}}},
+		{Key: "8017480121707248c4601288a1543103", Data: SensorData{DeviceId: "DEVICE1", Pm10: 7, Pm25: 3, Temp: 22, Humidity: 47, TSdevice: ts.Add(time.Hour), Lat: 49.2, Lon: 8.6}},
+	}
+}
+
+func TestSenMLExport(t *testing.T) {
+	pack := measurementsToSenML(testExportMeasurements())
+	packAsBytes, _ := json.Marshal(pack)
+	var value interface{}
+	json.Unmarshal(packAsBytes, &value)
+	schema := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(testSenMLSchema), &schema); err != nil {
+		t.Fatalf("Invalid schema: %s", err)
+	}
+	for _, err := range validateSchema(value, schema, "$") {
+		t.Errorf("SenML pack does not match the schema: %s", err)
+	}
+
+	// resolve the records as described in RFC 8428 section 4.6
+	resolved := make(map[string]float64)
+	baseName, baseTime := "", 0.0
+	for _, record := range pack {
+		if record.BaseName != "" {
+			baseName, baseTime = record.BaseName, record.BaseTime
+		}
+		name := baseName + record.Name
+		if !regexp.MustCompile(`^[A-Za-z0-9][-:./_A-Za-z0-9]*$`).MatchString(name) {
+			t.Errorf("Invalid resolved name %s", name)
+		}
+		resolved[fmt.Sprintf("%s@%g", name, baseTime)] = *record.Value
+	}
+	expected := map[string]float64{
+		"DEVICE1:temp@1.5624351e+09":    21.5,
+		"DEVICE1:lat@1.5624351e+09":     49.005604,
+		"DEVICE12:co@1.56243516e+09":    400,
+		"DEVICE12:noise@1.56243516e+09": 63.5,
+		"DEVICE1:pm10@1.5624387e+09":    7,
+	}
+	for name, value := range expected {
+		if resolved[name] != value {
+			t.Errorf("Resolved record %s was incorrect, got: %g, want: %g", name, resolved[name], value)
+		}
+	}
+	if _, ok := resolved["DEVICE12:no2@1.56243516e+09"]; ok {
+		t.Errorf("Expected the invalid channel to be left out")
+	}
+	if len(resolved) != 6+5+6 {
+		t.Errorf("Expected 17 records, got: %d", len(resolved))
+	}
+}
+
+func TestSensorThingsExport(t *testing.T) {
+	devices := map[string]DeviceInfo{"DEVICE1": {Owner: "org1", EncodingScheme: 0}, "DEVICE12": {Owner: "org2", EncodingScheme: 4, SignatureAlgorithm: algorithmECDSAP256}}
+	things := measurementsToSensorThings(testExportMeasurements(), devices)
+	thingsAsBytes, _ := json.Marshal(map[string]interface{}{"value": things})
+	var value interface{}
+	json.Unmarshal(thingsAsBytes, &value)
+	schema := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(testSensorThingsSchema), &schema); err != nil {
+		t.Fatalf("Invalid schema: %s", err)
+	}
+	for _, err := range validateSchema(value, schema, "$") {
+		t.Errorf("SensorThings export does not match the schema: %s", err)
+	}
+
+	if len(things) != 2 || things[0].Id != "DEVICE1" || things[1].Id != "DEVICE12" {
+		t.Fatalf("Expected DEVICE1 and DEVICE12, got: %s", thingsAsBytes)
+	}
+	if coordinates := things[0].Locations[0].Location.Coordinates; coordinates[0] != 8.6 || coordinates[1] != 49.2 {
+		t.Errorf("Expected the location of the latest measurement in GeoJSON order, got: %v", coordinates)
+	}
+	pm10 := things[0].Datastreams[0]
+	if len(things[0].Datastreams) != 4 || pm10.ObservedProperty.Name != "pm10" || len(pm10.Observations) != 2 || pm10.Observations[1].Result != 7 {
+		t.Errorf("Datastreams of DEVICE1 were incorrect, got: %+v", things[0].Datastreams)
+	}
+	if pm10.Observations[0].ResultTime == nil || *pm10.Observations[0].ResultTime != "2019-07-06T17:45:10Z" || pm10.Observations[1].ResultTime != nil {
+		t.Errorf("Result times were incorrect, got: %+v", pm10.Observations)
+	}
+	co := things[1].Datastreams[2]
+	if co.ObservedProperty.Name != "co" || co.UnitOfMeasurement.Symbol != "µg/m³" || co.Observations[0].Result != 400 {
+		t.Errorf("Carbon monoxide was incorrect, got: %+v", co)
+	}
+	if no2 := things[1].Datastreams[1]; no2.Observations[0].ResultQuality != "invalid" {
+		t.Errorf("Expected the quality flag as result quality, got: %+v", no2)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+/*
+ * Geospatial index for measurements.
+ * Every measurement is indexed by the geohash of its location, with each geohash character
+ * stored as a separate composite key attribute. This way all measurements within a geohash
+ * cell of any precision can be found with a single partial composite key query.
+ * Additionally the last known location of every device is kept for nearest-device lookups.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	geohashIndex        = "geohash~uuid"
+	deviceLocationKey   = "location~deviceId"
+	geohashPrecision    = 8
+	maxBoundingBoxCells = 64
+	earthRadiusMeters   = 6371008.8
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Define the device location structure, holding the location of the newest measurement of a device
+type DeviceLocation struct {
+	DeviceId string    `json:"deviceId"`
+	Lat      float64   `json:"lat"`
+	Lon      float64   `json:"lon"`
+	Geohash  string    `json:"geohash"`
+	TSdevice time.Time `json:"tsdevice"`
+}
+
+// Define the nearest device structure, returned by getNearestDevices
+type NearbyDevice struct {
+	DeviceLocation
+	Distance float64 `json:"distance"`
+}
+
+// encodes the coordinate as geohash with the given number of characters
+func encodeGeohash(lat, lon float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	var hash strings.Builder
+	bit, ch := 0, 0
+	even := true
+	for hash.Len() < precision {
+		if even {
+			mid := (lonRange[0] + lonRange[1]) / 2
+			if lon >= mid {
+				ch = ch<<1 | 1
+				lonRange[0] = mid
+			} else {
+				ch = ch << 1
+				lonRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if lat >= mid {
+				ch = ch<<1 | 1
+				latRange[0] = mid
+			} else {
+				ch = ch << 1
+				latRange[1] = mid
+			}
+		}
+		even = !even
+		bit = bit + 1
+		if bit == 5 {
+			hash.WriteByte(geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return hash.String()
+}
+
+// returns the coordinate of the center of the geohash cell
+func decodeGeohashCenter(hash string) (float64, float64) {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	even := true
+	for i := 0; i < len(hash); i++ {
+		ch := strings.IndexByte(geohashAlphabet, hash[i])
+		for bit := 4; bit >= 0; bit-- {
+			set := ch>>uint(bit)&1 == 1
+			if even {
+				mid := (lonRange[0] + lonRange[1]) / 2
+				if set {
+					lonRange[0] = mid
+				} else {
+					lonRange[1] = mid
+				}
+			} else {
+				mid := (latRange[0] + latRange[1]) / 2
+				if set {
+					latRange[0] = mid
+				} else {
+					latRange[1] = mid
+				}
+			}
+			even = !even
+		}
+	}
+	return (latRange[0] + latRange[1]) / 2, (lonRange[0] + lonRange[1]) / 2
+}
+
+// returns the width (longtitude) and height (latitude) of a geohash cell in degrees
+func geohashCellSize(precision int) (float64, float64) {
+	bits := 5 * precision
+	lonBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 360 / math.Pow(2, float64(lonBits)), 180 / math.Pow(2, float64(latBits))
+}
+
+// returns the geohash cells of the highest precision which cover the bounding box with at most maxBoundingBoxCells cells
+func geohashCellsInBoundingBox(minLat, minLon, maxLat, maxLon float64) []string {
+	for precision := geohashPrecision; precision > 0; precision-- {
+		width, height := geohashCellSize(precision)
+		firstLon := math.Floor((minLon + 180) / width)
+		lastLon := math.Min(math.Floor((maxLon+180)/width), 360/width-1)
+		firstLat := math.Floor((minLat + 90) / height)
+		lastLat := math.Min(math.Floor((maxLat+90)/height), 180/height-1)
+		if (lastLon-firstLon+1)*(lastLat-firstLat+1) > maxBoundingBoxCells && precision > 1 {
+			continue
+		}
+		cells := []string{}
+		for i := firstLat; i <= lastLat; i++ {
+			for j := firstLon; j <= lastLon; j++ {
+				// the center of the cell is encoded, so floating point errors at the edges do not matter
+				cells = append(cells, encodeGeohash((i+0.5)*height-90, (j+0.5)*width-180, precision))
+			}
+		}
+		return cells
+	}
+	return nil
+}
+
+// great-circle distance between two coordinates in meters
+func haversineDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	toRadians := math.Pi / 180
+	dLat := (lat2 - lat1) * toRadians
+	dLon := (lon2 - lon1) * toRadians
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*toRadians)*math.Cos(lat2*toRadians)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// writes the geohash index entry of the measurement and updates the last known location of the device
+func indexMeasurementLocation(APIstub shim.ChaincodeStubInterface, txId string, data SensorData) error {
+	attributes := append(strings.Split(data.Geohash, ""), txId)
+	indexKey, err := APIstub.CreateCompositeKey(geohashIndex, attributes)
+	if err != nil {
+		return err
+	}
+	// Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the measurement.
+	if err := APIstub.PutState(indexKey, []byte{0x00}); err != nil {
+		return err
+	}
+
+	locationKey, err := APIstub.CreateCompositeKey(deviceLocationKey, []string{data.DeviceId})
+	if err != nil {
+		return err
+	}
+	locationAsBytes, err := APIstub.GetState(locationKey)
+	if err != nil {
+		return err
+	}
+	if locationAsBytes != nil {
+		location := DeviceLocation{}
+		if err := json.Unmarshal(locationAsBytes, &location); err == nil && !data.TSdevice.After(location.TSdevice) {
+			return nil
+		}
+	}
+	location := DeviceLocation{DeviceId: data.DeviceId, Lat: data.Lat, Lon: data.Lon, Geohash: data.Geohash, TSdevice: data.TSdevice}
+	locationAsBytes, _ = json.Marshal(location)
+	return APIstub.PutState(locationKey, locationAsBytes)
+}
+
+/*
+ * Returns all measurements within the bounding box and the time window.
+ * Expects minLat, minLon, maxLat, maxLon in decimal degrees and from, to as timestamps (empty for no limit),
+ * optionally followed by true to leave out invalidated measurements.
+ */
+func (s *SmartContract) getMeasurementsInBoundingBox(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 6 && len(args) != 7 {
+		return shim.Error("Incorrect number of arguments. Expecting 6 or 7")
+	}
+	excludeInvalidated, err := parseExcludeInvalidated(args, 6)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bounds := make([]float64, 4)
+	for i := 0; i < 4; i++ {
+		value, err := strconv.ParseFloat(args[i], 64)
+		if err != nil {
+			return shim.Error("Invalid coordinate " + args[i])
+		}
+		bounds[i] = value
+	}
+	minLat, minLon, maxLat, maxLon := bounds[0], bounds[1], bounds[2], bounds[3]
+	if minLat < -90 || maxLat > 90 || minLat > maxLat {
+		return shim.Error("Invalid latitude range. Expecting -90 <= minLat <= maxLat <= 90")
+	}
+	if minLon < -180 || maxLon > 180 || minLon > maxLon {
+		return shim.Error("Invalid longtitude range. Expecting -180 <= minLon <= maxLon <= 180")
+	}
+	from, err := parseTimeArg(args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := parseTimeArg(args[5])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	cells := geohashCellsInBoundingBox(minLat, minLon, maxLat, maxLon)
+	// measurements of devices with a private location are only indexed with a coarse geohash,
+	// so the coarse cells have to be searched as well
+	if len(cells) > 0 && len(cells[0]) > publicGeohashPrecision {
+		coarseCells := make(map[string]bool)
+		for _, cell := range cells {
+			coarseCells[cell[:publicGeohashPrecision]] = true
+		}
+		for cell := range coarseCells {
+			cells = append(cells, cell)
+		}
+		sort.Strings(cells[len(cells)-len(coarseCells):])
+	}
+
+	records := []queryRecord{}
+	found := make(map[string]bool)
+	for _, cell := range cells {
+		resultsIterator, err := APIstub.GetStateByPartialCompositeKey(geohashIndex, strings.Split(cell, ""))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return shim.Error(err.Error())
+			}
+			_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+			if err != nil || len(attributes) == 0 {
+				continue
+			}
+			txId := attributes[len(attributes)-1]
+			if found[txId] {
+				continue
+			}
+			found[txId] = true
+			dataAsBytes, err := APIstub.GetState(txId)
+			if err != nil {
+				resultsIterator.Close()
+				return shim.Error(err.Error())
+			}
+			data := SensorData{}
+			if json.Unmarshal(dataAsBytes, &data) != nil {
+				continue
+			}
+			if data.Lat < minLat || data.Lat > maxLat || data.Lon < minLon || data.Lon > maxLon {
+				continue
+			}
+			if !isWithinTimeWindow(data.TSdevice, from, to) {
+				continue
+			}
+			records = append(records, queryRecord{Key: txId, Record: dataAsBytes})
+		}
+		resultsIterator.Close()
+	}
+	if excludeInvalidated {
+		if records, err = filterInvalidated(APIstub, records); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	buffer := recordsToJSON(records)
+	fmt.Printf("- getMeasurementsInBoundingBox:\n%s\n", buffer)
+	return shim.Success(buffer)
+}
+
+/*
+ * Returns the k devices whose last known location is closest to the given coordinate,
+ * ordered by their distance in meters.
+ */
+func (s *SmartContract) getNearestDevices(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	lat, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return shim.Error("Invalid latitude " + args[0])
+	}
+	lon, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return shim.Error("Invalid longtitude " + args[1])
+	}
+	k, err := strconv.Atoi(args[2])
+	if err != nil || k < 1 {
+		return shim.Error("Invalid number of devices " + args[2] + ". Expecting a positive integer")
+	}
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(deviceLocationKey, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	devices := []NearbyDevice{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		location := DeviceLocation{}
+		if json.Unmarshal(queryResponse.Value, &location) != nil {
+			continue
+		}
+		distance := haversineDistance(lat, lon, location.Lat, location.Lon)
+		devices = append(devices, NearbyDevice{DeviceLocation: location, Distance: math.Round(distance*10) / 10})
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].Distance < devices[j].Distance
+	})
+	if len(devices) > k {
+		devices = devices[:k]
+	}
+
+	devicesAsBytes, _ := json.Marshal(devices)
+	fmt.Printf("- getNearestDevices:\n%s\n", devicesAsBytes)
+	return shim.Success(devicesAsBytes)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestGeohashEncoding(t *testing.T) {
+	tests := []struct {
+		lat, lon  float64
+		precision int
+		expected  string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{49.005604, 8.4218527, 8, "u0tyz9hw"},
+		{-33.8688, 151.2093, 6, "r3gx2f"},
+		{0, 0, 4, "s000"},
+		{-90, -180, 3, "000"},
+	}
+	for _, test := range tests {
+		output := encodeGeohash(test.lat, test.lon, test.precision)
+		if output != test.expected {
+			t.Errorf("Geohash of %g,%g was incorrect, got: %s, want: %s", test.lat, test.lon, output, test.expected)
+		}
+	}
+}
+
+func TestGeohashCellsInBoundingBox(t *testing.T) {
+	cells := geohashCellsInBoundingBox(48.99, 8.38, 49.03, 8.45)
+	if len(cells) == 0 || len(cells) > maxBoundingBoxCells {
+		t.Fatalf("Unexpected number of cells: %d", len(cells))
+	}
+	covered := false
+	for _, cell := range cells {
+		if len(cell) != len(cells[0]) {
+			t.Errorf("Cells have different precisions: %v", cells)
+		}
+		if cell == encodeGeohash(49.005604, 8.4218527, len(cell)) {
+			covered = true
+		}
+	}
+	if !covered {
+		t.Errorf("Cells %v do not cover the point inside the bounding box", cells)
+	}
+
+	world := geohashCellsInBoundingBox(-90, -180, 90, 180)
+	if len(world) != 32 {
+		t.Errorf("Expected the 32 cells of precision 1 for the whole world, got: %d", len(world))
+	}
+}
+
+func TestHaversineDistance(t *testing.T) {
+	// Karlsruhe palace to Stuttgart main station, about 62 km
+	distance := haversineDistance(49.0135, 8.4044, 48.7840, 9.1817)
+	if math.Abs(distance-61800) > 1000 {
+		t.Errorf("Distance was incorrect, got: %g", distance)
+	}
+	if haversineDistance(49, 8, 49, 8) != 0 {
+		t.Errorf("Distance to the same point should be 0")
+	}
+}
+
+func TestBoundingBoxAndNearestQueries(t *testing.T) {
+	stub := newTestStub()
+	priv1 := registerTestDevice(stub, 1, "org1")
+	priv2 := registerTestDevice(stub, 2, "org2")
+	ts := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+	// DEVICE1 in Karlsruhe, DEVICE2 in Stuttgart
+	responses := []string{
+		stub.invoke("tx1", buildTestMeasurement(priv1, 1, 1, 54, ts, "0490033624N", "00082531116E")).Message,
+		stub.invoke("tx2", buildTestMeasurement(priv1, 1, 2, 60, ts.Add(-time.Hour), "0490100000N", "00082400000E")).Message,
+		stub.invoke("tx3", buildTestMeasurement(priv2, 2, 3, 70, ts, "0484704000N", "00091090200E")).Message,
+	}
+	for _, message := range responses {
+		if message != "" {
+			t.Fatalf("registerMeasurement failed: %s", message)
+		}
+	}
+
+	response := stub.invoke("q1", [][]byte{[]byte("getMeasurementsInBoundingBox"), []byte("48.9"), []byte("8.3"), []byte("49.1"), []byte("8.5"), []byte(""), []byte("")})
+	records := []struct {
+		Key    string
+		Record SensorData
+	}{}
+	if err := json.Unmarshal(response.Payload, &records); err != nil {
+		t.Fatalf("Invalid query result %s: %s", string(response.Payload), err)
+	}
+	if len(records) != 2 {
+		t.Errorf("Expected both Karlsruhe measurements, got: %s", string(response.Payload))
+	}
+	for _, record := range records {
+		if record.Record.DeviceId != "DEVICE1" || len(record.Record.Geohash) != geohashPrecision {
+			t.Errorf("Unexpected record in bounding box: %+v", record)
+		}
+	}
+
+	from := ts.Add(-10 * time.Minute).Format(time.RFC3339)
+	response = stub.invoke("q2", [][]byte{[]byte("getMeasurementsInBoundingBox"), []byte("48.9"), []byte("8.3"), []byte("49.1"), []byte("8.5"), []byte(from), []byte("")})
+	json.Unmarshal(response.Payload, &records)
+	if len(records) != 1 || records[0].Record.Pm10 != 5.4 {
+		t.Errorf("Expected only the newer measurement, got: %s", string(response.Payload))
+	}
+
+	response = stub.invoke("q3", [][]byte{[]byte("getMeasurementsInBoundingBox"), []byte("49.1"), []byte("8.3"), []byte("48.9"), []byte("8.5"), []byte(""), []byte("")})
+	if response.Status == shim.OK {
+		t.Errorf("Expected an inverted bounding box to be rejected")
+	}
+
+	response = stub.invoke("q4", [][]byte{[]byte("getNearestDevices"), []byte("48.78"), []byte("9.18"), []byte("2")})
+	nearest := []NearbyDevice{}
+	if err := json.Unmarshal(response.Payload, &nearest); err != nil {
+		t.Fatalf("Invalid query result %s: %s", string(response.Payload), err)
+	}
+	if len(nearest) != 2 || nearest[0].DeviceId != "DEVICE2" || nearest[1].DeviceId != "DEVICE1" {
+		t.Errorf("Unexpected nearest devices: %s", string(response.Payload))
+	}
+	// the location of DEVICE1 must be the one of its newest measurement
+	if nearest[1].Lat != 49.005604 || nearest[0].Distance > nearest[1].Distance {
+		t.Errorf("Unexpected location for DEVICE1: %+v", nearest[1])
+	}
+}
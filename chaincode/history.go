@@ -0,0 +1,95 @@
+package main
+
+/*
+ * History queries for device and measurement keys.
+ * The ledger history only provides the transaction ID and timestamp of each version, so the
+ * MSP which submitted a version is taken from the record itself (see DeviceInfo.UpdatedBy and
+ * SensorData.SubmittedBy). Versions written before these fields existed report an empty MSP ID.
+ */
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Define the history entry structure, one version of a key
+type HistoryEntry struct {
+	TxId      string          `json:"txId"`
+	Timestamp time.Time       `json:"timestamp"`
+	IsDelete  bool            `json:"isDelete"`
+	MspId     string          `json:"mspId"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// reads all versions of the key, oldest first. mspOf extracts the submitting MSP from a version.
+func getKeyHistory(APIstub shim.ChaincodeStubInterface, key string, mspOf func([]byte) string) ([]HistoryEntry, error) {
+	resultsIterator, err := APIstub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	entries := []HistoryEntry{}
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		entry := HistoryEntry{TxId: modification.TxId, IsDelete: modification.IsDelete}
+		if modification.Timestamp != nil {
+			entry.Timestamp = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC()
+		}
+		if !modification.IsDelete && len(modification.Value) > 0 {
+			entry.Value = json.RawMessage(modification.Value)
+			entry.MspId = mspOf(modification.Value)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *SmartContract) getDeviceHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if !strings.HasPrefix(args[0], "DEVICE") {
+		return shim.Error("Invalid device ID " + args[0] + ". Expecting DEVICE<n>")
+	}
+	entries, err := getKeyHistory(APIstub, args[0], func(value []byte) string {
+		device := DeviceInfo{}
+		json.Unmarshal(value, &device)
+		return device.UpdatedBy
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	entriesAsBytes, _ := json.Marshal(entries)
+	fmt.Printf("- getDeviceHistory:\n%s\n", entriesAsBytes)
+	return shim.Success(entriesAsBytes)
+}
+
+func (s *SmartContract) getMeasurementHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if uuid, err := hex.DecodeString(args[0]); err != nil || len(uuid) != 16 {
+		return shim.Error("Invalid measurement UUID " + args[0] + ". Expecting 32 hex characters")
+	}
+	entries, err := getKeyHistory(APIstub, args[0], func(value []byte) string {
+		data := SensorData{}
+		json.Unmarshal(value, &data)
+		return data.SubmittedBy
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	entriesAsBytes, _ := json.Marshal(entries)
+	fmt.Printf("- getMeasurementHistory:\n%s\n", entriesAsBytes)
+	return shim.Success(entriesAsBytes)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDeviceHistory(t *testing.T) {
+	stub := newTestStub()
+	response := stub.invoke("tx1", [][]byte{[]byte("registerDevice"), []byte("pQBakw2oxXklWGruTdMVnbbNsNG+nsojdlusAiaRVLU"), []byte("0"), []byte("org1"), []byte("true")})
+	if response.Message != "" {
+		t.Fatalf("registerDevice failed: %s", response.Message)
+	}
+	stub.setCaller("Org2MSP", "Admin@org2.example.com")
+	if response := stub.invoke("tx2", [][]byte{[]byte("revokeDevice"), []byte("DEVICE1")}); response.Message != "Only the owner of DEVICE1 may revoke it" {
+		t.Errorf("Expected another organization not to revoke the device, got: %s", response.Message)
+	}
+	if response := stub.invoke("tx3", [][]byte{[]byte("revokeDevice"), []byte("DEVICE2")}); response.Message != "Device DEVICE2 does not exist" {
+		t.Errorf("Expected a missing device not to be revoked, got: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "User1@org1.example.com")
+	response = stub.invoke("tx4", [][]byte{[]byte("revokeDevice"), []byte("DEVICE1")})
+	if response.Message != "" {
+		t.Fatalf("revokeDevice failed: %s", response.Message)
+	}
+
+	response = stub.invoke("q1", [][]byte{[]byte("getDeviceHistory"), []byte("DEVICE1")})
+	entries := []HistoryEntry{}
+	if err := json.Unmarshal(response.Payload, &entries); err != nil {
+		t.Fatalf("Invalid history %s: %s", string(response.Payload), err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 versions, got: %s", string(response.Payload))
+	}
+	if entries[0].TxId != "tx1" || entries[0].MspId != "Org1MSP" || entries[1].TxId != "tx4" || entries[1].MspId != "Org1MSP" {
+		t.Errorf("Unexpected history: %s", string(response.Payload))
+	}
+	versions := make([]DeviceInfo, 2)
+	json.Unmarshal(entries[0].Value, &versions[0])
+	json.Unmarshal(entries[1].Value, &versions[1])
+	if !versions[0].ValidationFlag || versions[1].ValidationFlag || versions[0].PublicKey != versions[1].PublicKey {
+		t.Errorf("Unexpected device versions: %+v", versions)
+	}
+	if entries[0].Timestamp.IsZero() {
+		t.Errorf("Expected the transaction timestamp in the history")
+	}
+
+	response = stub.invoke("q2", [][]byte{[]byte("getDeviceHistory"), []byte("8017480121707248c4601288a154313f")})
+	if response.Message == "" {
+		t.Errorf("Expected a non-device key to be rejected")
+	}
+}
+
+func TestMeasurementHistory(t *testing.T) {
+	stub := newTestStub()
+	priv := registerTestDevice(stub, 1, "org1")
+	ts := time.Now().UTC().Truncate(time.Second)
+	stub.invoke("tx1", buildTestMeasurement(priv, 1, 1, 54, ts, "0490033624N", "00082531116E"))
+	stub.setCaller("Org2MSP", "User1@org2.example.com")
+	if response := stub.invoke("tx2", buildTestMeasurement(priv, 1, 1, 60, ts, "0490033624N", "00082531116E")); response.Message == "" {
+		t.Errorf("Expected the measurement not to be overwritten")
+	}
+
+	response := stub.invoke("q1", [][]byte{[]byte("getMeasurementHistory"), []byte("8017480121707248c4601288a1543101")})
+	entries := []HistoryEntry{}
+	if err := json.Unmarshal(response.Payload, &entries); err != nil {
+		t.Fatalf("Invalid history %s: %s", string(response.Payload), err)
+	}
+	if len(entries) != 1 || entries[0].TxId != "tx1" || entries[0].MspId != "Org1MSP" {
+		t.Errorf("Expected the registration as only version, got: %s", string(response.Payload))
+	}
+
+	response = stub.invoke("q2", [][]byte{[]byte("getMeasurementHistory"), []byte("DEVICE1")})
+	if response.Message == "" {
+		t.Errorf("Expected an invalid UUID to be rejected")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+/*
+ * Helpers for the identity of the client submitting the transaction.
+ */
+
+import (
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// returns the MSP ID of the client submitting the transaction, e.g. Org1MSP
+func getClientMSPID(APIstub shim.ChaincodeStubInterface) (string, error) {
+	return cid.GetMSPID(APIstub)
+}
+
+// maps the owner stored on a device to the MSP ID of the organization
+// owners are either given as MSP ID (Org1MSP) or as organization name (org1)
+func ownerMSPID(owner string) string {
+	if owner == "" || strings.HasSuffix(owner, "MSP") {
+		return owner
+	}
+	return strings.ToUpper(owner[:1]) + owner[1:] + "MSP"
+}
+
+// checks whether the client submitting the transaction belongs to the organization owning the device
+func isDeviceOwner(APIstub shim.ChaincodeStubInterface, device DeviceInfo) (bool, error) {
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return false, err
+	}
+	return mspId == ownerMSPID(device.Owner), nil
+}
+
+// checks whether the client submitting the transaction is an administrator of its organization
+// the MSPs are configured without node OUs, so admins are recognized by the hf.Type attribute
+// of Fabric CA certificates or by the Admin@ common name of cryptogen certificates
+func isClientAdmin(APIstub shim.ChaincodeStubInterface) (bool, error) {
+	clientType, found, err := cid.GetAttributeValue(APIstub, "hf.Type")
+	if err != nil {
+		return false, err
+	}
+	if found {
+		return clientType == "admin", nil
+	}
+	certificate, err := cid.GetX509Certificate(APIstub)
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(certificate.Subject.CommonName, "Admin@"), nil
+}
+
+// checks whether the client submitting the transaction is an administrator of the given organization
+func isOrganizationAdmin(APIstub shim.ChaincodeStubInterface, owner string) (bool, error) {
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return false, err
+	}
+	if mspId != ownerMSPID(owner) {
+		return false, nil
+	}
+	return isClientAdmin(APIstub)
+}
+
+// checks whether the client submitting the transaction has the manufacturer role,
+// given as attribute role=manufacturer in its Fabric CA certificate
+func isManufacturer(APIstub shim.ChaincodeStubInterface) (bool, error) {
+	role, _, err := cid.GetAttributeValue(APIstub, "role")
+	if err != nil {
+		return false, err
+	}
+	return role == "manufacturer", nil
+}
+
+// maps the MSP ID to the owner name used on devices, e.g. Org1MSP to org1
+func organizationName(mspId string) string {
+	name := strings.TrimSuffix(mspId, "MSP")
+	if name == "" {
+		return name
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
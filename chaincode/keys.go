@@ -0,0 +1,249 @@
+package main
+
+/*
+ * Device public keys and signature verification.
+ * Devices sign with ed25519 or, with a secure element like the ATECC608, with ECDSA P-256.
+ * Keys are accepted as standard, raw or URL-safe base64 or as hex, P-256 keys also in PEM form,
+ * and are stored in canonical form: the raw key (ed25519) or the uncompressed SEC 1 point (P-256)
+ * as standard base64 without padding.
+ */
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"golang.org/x/crypto/ed25519"
+)
+
+// signature algorithms of devices, devices registered without algorithm use ed25519
+const (
+	algorithmEd25519   = "ed25519"
+	algorithmECDSAP256 = "ecdsa-p256"
+)
+
+// sizes of P-256 public keys in SEC 1 encoding and of raw r||s signatures
+const (
+	p256CompressedKeySize   = 33
+	p256UncompressedKeySize = 65
+	p256RawSignatureSize    = 64
+)
+
+// encodings of public keys, tried in this order
+var publicKeyEncodings = []*base64.Encoding{
+	base64.RawStdEncoding,
+	base64.StdEncoding,
+	base64.RawURLEncoding,
+	base64.URLEncoding,
+}
+
+// Define the device key structure, a public key in canonical form with its signature algorithm
+type DeviceKey struct {
+	PublicKey          string
+	SignatureAlgorithm string
+}
+
+// returns the signature algorithm of the device
+func deviceSignatureAlgorithm(device DeviceInfo) string {
+	if device.SignatureAlgorithm == "" {
+		return algorithmEd25519
+	}
+	return device.SignatureAlgorithm
+}
+
+// decodes a compressed or uncompressed SEC 1 point and returns it uncompressed, nil if it is not on the P-256 curve
+func decodeP256Point(point []byte) []byte {
+	curve := elliptic.P256()
+	if len(point) == p256UncompressedKeySize && point[0] == 0x04 {
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil
+		}
+		return elliptic.Marshal(curve, x, y)
+	}
+	if len(point) != p256CompressedKeySize || (point[0] != 0x02 && point[0] != 0x03) {
+		return nil
+	}
+	// y² = x³ - 3x + b
+	params := curve.Params()
+	x := new(big.Int).SetBytes(point[1:])
+	if x.Cmp(params.P) >= 0 {
+		return nil
+	}
+	y2 := new(big.Int).Exp(x, big.NewInt(3), params.P)
+	y2.Sub(y2, new(big.Int).Mul(x, big.NewInt(3)))
+	y2.Add(y2, params.B)
+	y2.Mod(y2, params.P)
+	y := new(big.Int).ModSqrt(y2, params.P)
+	if y == nil {
+		return nil
+	}
+	if y.Bit(0) != uint(point[0]&1) {
+		y.Sub(params.P, y)
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil
+	}
+	return elliptic.Marshal(curve, x, y)
+}
+
+// decodes a PEM encoded PKIX P-256 public key
+func decodeP256PEM(key string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, errors.New("Public key is not valid PEM")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("Public key is not a valid PKIX key: " + err.Error())
+	}
+	ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok || ecdsaKey.Curve != elliptic.P256() {
+		return nil, errors.New("PEM public key is not an ECDSA P-256 key")
+	}
+	return elliptic.Marshal(ecdsaKey.Curve, ecdsaKey.X, ecdsaKey.Y), nil
+}
+
+// decodes the public key of a device in any of the accepted encodings
+// returns the signature algorithm and the key in its canonical binary form
+func decodePublicKey(key string) (string, []byte, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", nil, errors.New("Public key must not be empty")
+	}
+	if strings.HasPrefix(key, "-----BEGIN") {
+		keyAsBytes, err := decodeP256PEM(key)
+		if err != nil {
+			return "", nil, err
+		}
+		return algorithmECDSAP256, keyAsBytes, nil
+	}
+	candidates := [][]byte{}
+	// 64 hex characters are valid base64 as well, but decode to 48 bytes
+	if keyAsBytes, err := hex.DecodeString(key); err == nil {
+		candidates = append(candidates, keyAsBytes)
+	}
+	for _, encoding := range publicKeyEncodings {
+		if keyAsBytes, err := encoding.DecodeString(key); err == nil {
+			candidates = append(candidates, keyAsBytes)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", nil, errors.New("Public key is neither valid base64 nor hex")
+	}
+	for _, keyAsBytes := range candidates {
+		switch len(keyAsBytes) {
+		case ed25519.PublicKeySize:
+			return algorithmEd25519, keyAsBytes, nil
+		case p256CompressedKeySize, p256UncompressedKeySize:
+			if point := decodeP256Point(keyAsBytes); point != nil {
+				return algorithmECDSAP256, point, nil
+			}
+			return "", nil, errors.New("Public key is not a point on the P-256 curve")
+		}
+	}
+	return "", nil, fmt.Errorf("Public key has %d bytes. Expecting %d (ed25519), %d or %d (ECDSA P-256)", len(candidates[0]), ed25519.PublicKeySize, p256CompressedKeySize, p256UncompressedKeySize)
+}
+
+// returns the public key in its canonical form
+func canonicalPublicKey(key string) (DeviceKey, error) {
+	algorithm, keyAsBytes, err := decodePublicKey(key)
+	if err != nil {
+		return DeviceKey{}, err
+	}
+	return DeviceKey{PublicKey: base64.RawStdEncoding.EncodeToString(keyAsBytes), SignatureAlgorithm: algorithm}, nil
+}
+
+// returns the canonical public keys of all registered devices, mapped to their device ID
+func registeredPublicKeys(APIstub shim.ChaincodeStubInterface) (map[string]string, error) {
+	resultsIterator, err := APIstub.GetStateByRange(deviceRangeStartKey, deviceRangeEndKey)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	keys := make(map[string]string)
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		device := DeviceInfo{}
+		if json.Unmarshal(queryResponse.Value, &device) != nil {
+			continue
+		}
+		// keys registered before validation existed may not be decodable
+		if key, err := canonicalPublicKey(device.PublicKey); err == nil {
+			keys[key.PublicKey] = queryResponse.Key
+		}
+	}
+	return keys, nil
+}
+
+// canonicalises the public keys of devices to be registered together
+// rejects invalid keys and keys which are registered already or appear twice in the list
+func canonicalNewPublicKeys(APIstub shim.ChaincodeStubInterface, keys []string) ([]DeviceKey, error) {
+	registered, err := registeredPublicKeys(APIstub)
+	if err != nil {
+		return nil, err
+	}
+	canonicalKeys := []DeviceKey{}
+	for i, key := range keys {
+		canonicalKey, err := canonicalPublicKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid public key of device %d: %s", i, err)
+		}
+		if deviceId, ok := registered[canonicalKey.PublicKey]; ok {
+			return nil, fmt.Errorf("Public key of device %d is already registered for %s", i, deviceId)
+		}
+		registered[canonicalKey.PublicKey] = fmt.Sprintf("device %d of this list", i)
+		canonicalKeys = append(canonicalKeys, canonicalKey)
+	}
+	return canonicalKeys, nil
+}
+
+// parses an ECDSA signature, either DER encoded or as raw r||s
+func parseECDSASignature(signature []byte) (*big.Int, *big.Int, error) {
+	if len(signature) > 0 && signature[0] == 0x30 {
+		der := struct{ R, S *big.Int }{}
+		if rest, err := asn1.Unmarshal(signature, &der); err == nil && len(rest) == 0 {
+			return der.R, der.S, nil
+		}
+	}
+	if len(signature) == p256RawSignatureSize {
+		return new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]), nil
+	}
+	return nil, nil, errors.New("Signature is neither DER encoded nor raw r||s")
+}
+
+// verifies the signature of the message with the public key of the device
+func verifyDeviceSignature(device DeviceInfo, message, signature []byte) bool {
+	algorithm, keyAsBytes, err := decodePublicKey(device.PublicKey)
+	if err != nil || algorithm != deviceSignatureAlgorithm(device) {
+		return false
+	}
+	switch algorithm {
+	case algorithmEd25519:
+		return ed25519.Verify(ed25519.PublicKey(keyAsBytes), message, signature)
+	case algorithmECDSAP256:
+		r, s, err := parseECDSASignature(signature)
+		if err != nil {
+			return false
+		}
+		x, y := elliptic.Unmarshal(elliptic.P256(), keyAsBytes)
+		digest := sha256.Sum256(message)
+		return ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, digest[:], r, s)
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCanonicalPublicKey(t *testing.T) {
+	expected := "pQBakw2oxXklWGruTdMVnbbNsNG+nsojdlusAiaRVLU"
+	keyAsBytes, _ := base64.RawStdEncoding.DecodeString(expected)
+	encodings := []string{
+		expected,
+		base64.StdEncoding.EncodeToString(keyAsBytes),
+		base64.RawURLEncoding.EncodeToString(keyAsBytes),
+		base64.URLEncoding.EncodeToString(keyAsBytes),
+		hex.EncodeToString(keyAsBytes),
+		strings.ToUpper(hex.EncodeToString(keyAsBytes)),
+	}
+	for _, key := range encodings {
+		canonicalKey, err := canonicalPublicKey(key)
+		if err != nil || canonicalKey.PublicKey != expected || canonicalKey.SignatureAlgorithm != algorithmEd25519 {
+			t.Errorf("Canonical form of %s was incorrect, got: %+v %v, want: %s", key, canonicalKey, err, expected)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"pQBakw2oxXklWGruTdMVnbbNsNG",
+		"pQBakw2oxXklWGruTdMVnbbNsNG+nsojdlusAiaRVLU!",
+		base64.RawStdEncoding.EncodeToString(make([]byte, 33)),
+		hex.EncodeToString(make([]byte, 31)),
+	}
+	for _, key := range invalid {
+		if _, err := canonicalPublicKey(key); err == nil {
+			t.Errorf("Expected an error for key %q", key)
+		}
+	}
+}
+
+func TestRegisterDeviceValidation(t *testing.T) {
+	stub := newTestStub()
+	key := "pQBakw2oxXklWGruTdMVnbbNsNG+nsojdlusAiaRVLU"
+	keyAsBytes, _ := base64.RawStdEncoding.DecodeString(key)
+	tests := []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"pQBakw2oxXklWGruTdMVnbbNsNG", "0", "org1", "true"}, "Invalid public key: Public key has 20 bytes. Expecting 32 (ed25519), 33 or 65 (ECDSA P-256)"},
+		{[]string{key, "zero", "org1", "true"}, "Invalid encoding scheme zero. Expecting an integer"},
+		{[]string{key, "0", "org1", "yes"}, "Invalid validation flag yes. Expecting true or false"},
+		{[]string{base64.URLEncoding.EncodeToString(keyAsBytes), "0", "org1", "true"}, ""},
+		{[]string{hex.EncodeToString(keyAsBytes), "1", "org2", "true"}, "Public key is already registered for DEVICE1"},
+	}
+	for i, test := range tests {
+		args := [][]byte{[]byte("registerDevice")}
+		for _, arg := range test.args {
+			args = append(args, []byte(arg))
+		}
+		response := stub.invoke("tx"+strconv.Itoa(i), args)
+		if response.Message != test.message {
+			t.Errorf("Unexpected result for %v, got: %s, want: %s", test.args, response.Message, test.message)
+		}
+	}
+	if !strings.Contains(string(stub.State["DEVICE1"]), `"pubKey":"`+key+`"`) {
+		t.Errorf("Expected the key to be stored in canonical form, got: %s", string(stub.State["DEVICE1"]))
+	}
+	if stub.State["DEVICE2"] != nil {
+		t.Errorf("Expected the duplicate key not to be registered")
+	}
+}
+
+// P-256 key and signatures of "sample" with SHA-256 from RFC 6979, appendix A.2.5
+const (
+	testP256UncompressedKey = "0460fed4ba255a9d31c961eb74c6356d68c049b8923b61fa6ce669622e60f29fb67903fe1008b8bc99a41ae9e95628bc64f2f1b20c2d7e9f5177a3c294d4462299"
+	testP256CompressedKey   = "0360fed4ba255a9d31c961eb74c6356d68c049b8923b61fa6ce669622e60f29fb6"
+	testP256PEMKey          = "-----BEGIN PUBLIC KEY-----\nMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEYP7UuiVanTHJYet0xjVtaMBJuJI7\nYfps5mliLmDyn7Z5A/4QCLi8maQa6elWKLxk8vGyDC1+n1F3o8KU1EYimQ==\n-----END PUBLIC KEY-----\n"
+	testP256RawSignature    = "efd48b2aacb6a8fd1140dd9cd45e81d69d2c877b56aaf991c34d0ea84eaf3716f7cb1c942d657c41d436c7a1b6e29f65f3e900dbb9aff4064dc4ab2f843acda8"
+	testP256DERSignature    = "3046022100efd48b2aacb6a8fd1140dd9cd45e81d69d2c877b56aaf991c34d0ea84eaf3716022100f7cb1c942d657c41d436c7a1b6e29f65f3e900dbb9aff4064dc4ab2f843acda8"
+)
+
+func TestCanonicalP256PublicKey(t *testing.T) {
+	uncompressed, _ := hex.DecodeString(testP256UncompressedKey)
+	expected := base64.RawStdEncoding.EncodeToString(uncompressed)
+	compressed, _ := hex.DecodeString(testP256CompressedKey)
+	encodings := []string{
+		testP256UncompressedKey,
+		testP256CompressedKey,
+		base64.StdEncoding.EncodeToString(uncompressed),
+		base64.RawURLEncoding.EncodeToString(compressed),
+		testP256PEMKey,
+	}
+	for _, key := range encodings {
+		canonicalKey, err := canonicalPublicKey(key)
+		if err != nil || canonicalKey.PublicKey != expected || canonicalKey.SignatureAlgorithm != algorithmECDSAP256 {
+			t.Errorf("Canonical form of %s was incorrect, got: %+v %v, want: %s", key, canonicalKey, err, expected)
+		}
+	}
+
+	// flipping the parity selects the other point with the same x coordinate
+	compressed[0] = 0x02
+	canonicalKey, err := canonicalPublicKey(hex.EncodeToString(compressed))
+	if err != nil || canonicalKey.PublicKey == expected {
+		t.Errorf("Expected a different point for the even y coordinate, got: %+v %v", canonicalKey, err)
+	}
+	offCurve := append([]byte{}, uncompressed...)
+	offCurve[64] ^= 1
+	if _, err := canonicalPublicKey(hex.EncodeToString(offCurve)); err == nil {
+		t.Errorf("Expected a point off the curve to be rejected")
+	}
+	ed25519PEM := "-----BEGIN PUBLIC KEY-----\nMCowBQYDK2VwAyEAGb9ECWmEzf6FQbrBZ9w7lshQhqowtrbLDFw4rXAxZuE=\n-----END PUBLIC KEY-----\n"
+	if _, err := canonicalPublicKey(ed25519PEM); err == nil {
+		t.Errorf("Expected a PEM key of another type to be rejected")
+	}
+}
+
+func TestVerifyP256Signature(t *testing.T) {
+	uncompressed, _ := hex.DecodeString(testP256UncompressedKey)
+	device := DeviceInfo{PublicKey: base64.RawStdEncoding.EncodeToString(uncompressed), SignatureAlgorithm: algorithmECDSAP256}
+	for _, signature := range []string{testP256RawSignature, testP256DERSignature} {
+		signatureAsBytes, _ := hex.DecodeString(signature)
+		if !verifyDeviceSignature(device, []byte("sample"), signatureAsBytes) {
+			t.Errorf("Signature %s was not verified", signature)
+		}
+		if verifyDeviceSignature(device, []byte("sample!"), signatureAsBytes) {
+			t.Errorf("Signature %s was verified for another message", signature)
+		}
+		// the algorithm must match the key, an ed25519 device never accepts an ECDSA signature
+		if verifyDeviceSignature(DeviceInfo{PublicKey: device.PublicKey}, []byte("sample"), signatureAsBytes) {
+			t.Errorf("Signature %s was verified without the device algorithm", signature)
+		}
+	}
+	truncated, _ := hex.DecodeString(testP256RawSignature[:126])
+	if verifyDeviceSignature(device, []byte("sample"), truncated) {
+		t.Errorf("Truncated signature was verified")
+	}
+}
+
+func TestP256DeviceMeasurement(t *testing.T) {
+	stub := newTestStub()
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pkix, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	key := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix})
+	response := stub.invoke("tx1", [][]byte{[]byte("registerDevice"), key, []byte("1"), []byte("org1"), []byte("true")})
+	if response.Message != "" {
+		t.Fatalf("registerDevice failed: %s", response.Message)
+	}
+	device := DeviceInfo{}
+	json.Unmarshal(stub.State["DEVICE1"], &device)
+	if device.SignatureAlgorithm != algorithmECDSAP256 {
+		t.Errorf("Signature algorithm was incorrect, got: %s, want: %s", device.SignatureAlgorithm, algorithmECDSAP256)
+	}
+
+	ts := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	args := buildTestMeasurement(nil, 1, 1, 54, ts, "0490033624N", "00082531116E")
+	frame, _ := base64.StdEncoding.DecodeString(string(args[1]))
+	digest := sha256.Sum256(frame)
+	r, s, _ := ecdsa.Sign(rand.Reader, priv, digest[:])
+	signature, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	args[2] = []byte(base64.StdEncoding.EncodeToString(signature))
+	response = stub.invoke("tx2", args)
+	if response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	if stub.State["8017480121707248c4601288a1543101"] == nil {
+		t.Errorf("Measurement was not stored")
+	}
+}
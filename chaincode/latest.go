@@ -0,0 +1,115 @@
+package main
+
+/*
+ * Latest reading of every device, maintained by registerMeasurement, so live maps need not
+ * scan all measurements. The record is only replaced by measurements with a newer device
+ * timestamp, readings buffered on the device and submitted late leave it untouched.
+ * Confidential measurements are not tracked, they are not readable by everyone. Invalidating the
+ * latest reading removes it, see annotations.go.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const latestReadingKey = "latest~deviceId"
+
+// Define the latest reading structure, the newest measurement of a device
+type LatestReading struct {
+	DeviceId      string     `json:"deviceId"`
+	MeasurementId string     `json:"measurementId"`
+	Measurement   SensorData `json:"measurement"`
+}
+
+// returns the latest reading of the device, nil if it has not reported yet
+func getLatestReading(APIstub shim.ChaincodeStubInterface, deviceId string) (*LatestReading, string, error) {
+	latestKey, err := APIstub.CreateCompositeKey(latestReadingKey, []string{deviceId})
+	if err != nil {
+		return nil, "", err
+	}
+	latestAsBytes, err := APIstub.GetState(latestKey)
+	if err != nil {
+		return nil, "", err
+	}
+	if latestAsBytes == nil {
+		return nil, latestKey, nil
+	}
+	latest := LatestReading{}
+	if err := json.Unmarshal(latestAsBytes, &latest); err != nil {
+		return nil, "", err
+	}
+	return &latest, latestKey, nil
+}
+
+// replaces the latest reading of the device if the measurement is newer
+func updateLatestReading(APIstub shim.ChaincodeStubInterface, txId string, data SensorData) error {
+	latest, latestKey, err := getLatestReading(APIstub, data.DeviceId)
+	if err != nil {
+		return err
+	}
+	if latest != nil && !data.TSdevice.After(latest.Measurement.TSdevice) {
+		return nil
+	}
+	latestAsBytes, _ := json.Marshal(LatestReading{DeviceId: data.DeviceId, MeasurementId: txId, Measurement: data})
+	return APIstub.PutState(latestKey, latestAsBytes)
+}
+
+// expects an optional owner, returns the latest reading of every active device ordered by device ID
+func (s *SmartContract) getLatestReadings(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting at most 1")
+	}
+	owner := ""
+	if len(args) == 1 {
+		owner = args[0]
+	}
+	resultsIterator, err := APIstub.GetStateByRange(deviceRangeStartKey, deviceRangeEndKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	readings := []LatestReading{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		device := DeviceInfo{}
+		if json.Unmarshal(queryResponse.Value, &device) != nil {
+			continue
+		}
+		if !device.ValidationFlag || device.Status == deviceProvisioned {
+			continue
+		}
+		if owner != "" && ownerMSPID(device.Owner) != ownerMSPID(owner) {
+			continue
+		}
+		latest, _, err := getLatestReading(APIstub, queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if latest == nil {
+			continue
+		}
+		invalidated, err := isInvalidated(APIstub, latest.MeasurementId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !invalidated {
+			readings = append(readings, *latest)
+		}
+	}
+	sort.Slice(readings, func(i, j int) bool {
+		return deviceNumber(readings[i].DeviceId) < deviceNumber(readings[j].DeviceId)
+	})
+
+	readingsAsBytes, _ := json.Marshal(readings)
+	fmt.Printf("- getLatestReadings:\n%s\n", readingsAsBytes)
+	return shim.Success(readingsAsBytes)
+}
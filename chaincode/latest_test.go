@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLatestReadings(t *testing.T) {
+	stub := newTestStub()
+	priv1 := registerTestDevice(stub, 1, "org1")
+	priv2 := registerTestDevice(stub, 2, "org2")
+	priv3 := registerTestDevice(stub, 3, "org1")
+	ts := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	measurements := [][][]byte{
+		buildTestMeasurement(priv1, 1, 1, 20, ts, "0490033624N", "00082531116E"),
+		buildTestMeasurement(priv1, 1, 2, 30, ts.Add(time.Hour), "0490033624N", "00082531116E"),
+		// submitted late, older than the latest reading
+		buildTestMeasurement(priv1, 1, 3, 40, ts.Add(30*time.Minute), "0490033624N", "00082531116E"),
+		buildTestMeasurement(priv2, 2, 4, 50, ts, "0490033624N", "00082531116E"),
+		buildTestMeasurement(priv3, 3, 5, 60, ts, "0490033624N", "00082531116E"),
+	}
+	for i, measurement := range measurements {
+		if response := stub.invoke("m"+strconv.Itoa(i), measurement); response.Message != "" {
+			t.Fatalf("registerMeasurement %d failed: %s", i, response.Message)
+		}
+	}
+	stub.invoke("tx1", [][]byte{[]byte("revokeDevice"), []byte("DEVICE3")})
+
+	response := stub.invoke("q1", [][]byte{[]byte("getLatestReadings")})
+	readings := []LatestReading{}
+	json.Unmarshal(response.Payload, &readings)
+	if len(readings) != 2 || readings[0].DeviceId != "DEVICE1" || readings[1].DeviceId != "DEVICE2" {
+		t.Fatalf("Expected the readings of DEVICE1 and DEVICE2, got: %s %s", response.Message, response.Payload)
+	}
+	if readings[0].MeasurementId != "8017480121707248c4601288a1543102" || readings[0].Measurement.Pm10 != 3 || !readings[0].Measurement.TSdevice.Equal(ts.Add(time.Hour)) {
+		t.Errorf("Latest reading of DEVICE1 was incorrect, got: %+v", readings[0])
+	}
+
+	response = stub.invoke("q2", [][]byte{[]byte("getLatestReadings"), []byte("Org2MSP")})
+	readings = []LatestReading{}
+	json.Unmarshal(response.Payload, &readings)
+	if len(readings) != 1 || readings[0].DeviceId != "DEVICE2" {
+		t.Errorf("Expected only the reading of DEVICE2, got: %s", response.Payload)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+/*
+ * Cayenne LPP encoding scheme (encoding scheme 3) for LoRaWAN field nodes.
+ * The LPP payload of the uplink is wrapped like the other frames:
+ *	Byte 1:		Header: 10101010
+ *	Byte 2-3:	Device Id: (1-65535)
+ *	Byte 4-19:	UUID of the transaction
+ *	Byte 20-n:	Cayenne LPP payload, a sequence of channel, type, value
+ *	Last 64 bytes:	Signature of all preceding bytes
+ *
+ * Mapping to SensorData:
+ *	analog input (2) on channel 1: Pm10, on channel 2: Pm25 (µg/m³, at most 327.67)
+ *	temperature (103): Temp, relative humidity (104): Humidity
+ *	GPS (136): latitude and longtitude (0.0001° resolution)
+ *	unix time (133, extended LPP): device timestamp, the transaction time if missing
+ * The PM channels and GPS are required, other known types are skipped.
+ */
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const lppEncodingScheme = 3
+
+// Cayenne LPP data types
+const (
+	lppDigitalInput  = 0
+	lppDigitalOutput = 1
+	lppAnalogInput   = 2
+	lppAnalogOutput  = 3
+	lppIlluminance   = 101
+	lppPresence      = 102
+	lppTemperature   = 103
+	lppHumidity      = 104
+	lppAccelerometer = 113
+	lppBarometer     = 115
+	lppUnixTime      = 133
+	lppGyrometer     = 134
+	lppGPS           = 136
+)
+
+// analog input channels of the PM sensors
+const (
+	lppChannelPm10 = 1
+	lppChannelPm25 = 2
+)
+
+const lppSignatureLength = 64
+
+// value sizes of the LPP data types in bytes
+var lppTypeSizes = map[byte]int{
+	lppDigitalInput:  1,
+	lppDigitalOutput: 1,
+	lppAnalogInput:   2,
+	lppAnalogOutput:  2,
+	lppIlluminance:   2,
+	lppPresence:      1,
+	lppTemperature:   2,
+	lppHumidity:      1,
+	lppAccelerometer: 6,
+	lppBarometer:     2,
+	lppUnixTime:      4,
+	lppGyrometer:     6,
+	lppGPS:           9,
+}
+
+// Define the LPP value structure, one decoded value of the payload
+type LPPValue struct {
+	Channel byte
+	Type    byte
+	Data    []byte
+}
+
+// reads a big endian signed integer of 2 or 3 bytes
+func lppSigned(b []byte) int32 {
+	value := int32(0)
+	for _, c := range b {
+		value = value<<8 | int32(c)
+	}
+	shift := uint(32 - 8*len(b))
+	return value << shift >> shift
+}
+
+// splits the payload into its values
+func parseLPPPayload(b []byte) ([]LPPValue, error) {
+	values := []LPPValue{}
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, errors.New("Truncated LPP value")
+		}
+		size, ok := lppTypeSizes[b[1]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown LPP type %d on channel %d", b[1], b[0])
+		}
+		if len(b) < 2+size {
+			return nil, fmt.Errorf("Truncated LPP value of type %d on channel %d", b[1], b[0])
+		}
+		values = append(values, LPPValue{Channel: b[0], Type: b[1], Data: b[2 : 2+size]})
+		b = b[2+size:]
+	}
+	return values, nil
+}
+
+// maps the LPP values to a measurement, the timestamp defaults to the given time
+func lppValuesToSensorData(values []LPPValue, defaultTime time.Time) (SensorData, error) {
+	data := SensorData{TSdevice: defaultTime}
+	seen := make(map[[2]byte]bool)
+	for _, value := range values {
+		if seen[[2]byte{value.Channel, value.Type}] {
+			return SensorData{}, fmt.Errorf("Duplicate LPP value of type %d on channel %d", value.Type, value.Channel)
+		}
+		seen[[2]byte{value.Channel, value.Type}] = true
+		switch value.Type {
+		case lppAnalogInput:
+			switch value.Channel {
+			case lppChannelPm10:
+				data.Pm10 = float32(lppSigned(value.Data)) / 100
+			case lppChannelPm25:
+				data.Pm25 = float32(lppSigned(value.Data)) / 100
+			}
+		case lppTemperature:
+			data.Temp = float32(lppSigned(value.Data)) / 10
+		case lppHumidity:
+			data.Humidity = float32(value.Data[0]) / 2
+		case lppUnixTime:
+			data.TSdevice = convertEpochToDate(value.Data)
+		case lppGPS:
+			lat := float64(lppSigned(value.Data[0:3])) / 10000
+			lon := float64(lppSigned(value.Data[3:6])) / 10000
+			if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+				return SensorData{}, fmt.Errorf("Coordinate %g,%g out of range", lat, lon)
+			}
+			data.Lat, data.Lon = lat, lon
+			data.Latitude = formatCoordinate(lat, 'N', 'S')
+			data.Longtitude = formatCoordinate(lon, 'E', 'W')
+		}
+	}
+	for _, required := range [][2]byte{{lppChannelPm10, lppAnalogInput}, {lppChannelPm25, lppAnalogInput}} {
+		if !seen[required] {
+			return SensorData{}, fmt.Errorf("Missing analog input on channel %d", required[0])
+		}
+	}
+	if data.Latitude == "" {
+		return SensorData{}, errors.New("Missing GPS location")
+	}
+	return data, nil
+}
+
+func decodeMessageWithLPPEncodingScheme(b []byte, device DeviceInfo, deviceId uint16, txTime time.Time) (SensorData, string) {
+	if len(b) < 19+lppSignatureLength {
+		return SensorData{}, ""
+	}
+	message, signature := b[:len(b)-lppSignatureLength], b[len(b)-lppSignatureLength:]
+	if !verifyDeviceSignature(device, message, signature) {
+		return SensorData{}, ""
+	}
+	values, err := parseLPPPayload(message[19:])
+	if err != nil {
+		return SensorData{}, ""
+	}
+	data, err := lppValuesToSensorData(values, txTime)
+	if err != nil {
+		return SensorData{}, ""
+	}
+	data.DeviceId = "DEVICE" + strconv.Itoa(int(deviceId))
+	return data, hex.EncodeToString(b[3:19])
+}
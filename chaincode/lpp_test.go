@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// PM channels, temperature and GPS values are the examples of the Cayenne LPP documentation
+const testLPPPayload = "0102021c" + "020200fa" + "03670110" + "046860" + "0588" + "06765ff2960a0003e8" + "0685" + "5d20de1c" + "0773277f"
+
+func TestLPPPayloadDecoding(t *testing.T) {
+	payload, _ := hex.DecodeString(testLPPPayload)
+	values, err := parseLPPPayload(payload)
+	if err != nil || len(values) != 7 {
+		t.Fatalf("Parsing the payload failed: %v %v", values, err)
+	}
+	data, err := lppValuesToSensorData(values, time.Time{})
+	if err != nil {
+		t.Fatalf("Mapping the payload failed: %s", err)
+	}
+	expected := SensorData{Pm10: 5.4, Pm25: 2.5, Temp: 27.2, Humidity: 48, TSdevice: time.Date(2019, 7, 6, 17, 45, 0, 0, time.UTC), Lat: 42.3519, Lon: -87.9094, Latitude: "42°21.11400'N", Longtitude: "87°54.56400'W"}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("Decoding was incorrect, got: %+v, want: %+v", data, expected)
+	}
+
+	negative, _ := hex.DecodeString("0367ff38")
+	values, _ = parseLPPPayload(negative)
+	if temp := float32(lppSigned(values[0].Data)) / 10; temp != -20 {
+		t.Errorf("Negative temperature was incorrect, got: %g, want: -20", temp)
+	}
+
+	invalid := map[string]string{
+		"0102021c020200fa03":                             "truncated value",
+		"0102021c020200fa0399":                           "unknown type",
+		"0102021c058806765ff2960a0003e8":                 "missing PM2.5",
+		"0102021c020200fa":                               "missing GPS",
+		"0102021c0102021c020200fa058806765ff2960a0003e8": "duplicate channel",
+		"0102021c020200fa05880fffff000000000000":         "latitude out of range",
+	}
+	for payloadAsHex, reason := range invalid {
+		payload, _ := hex.DecodeString(payloadAsHex)
+		values, err := parseLPPPayload(payload)
+		if err == nil {
+			_, err = lppValuesToSensorData(values, time.Time{})
+		}
+		if err == nil {
+			t.Errorf("Expected an error for %s (%s)", payloadAsHex, reason)
+		}
+	}
+}
+
+func TestLPPEncodingScheme(t *testing.T) {
+	stub := newTestStub()
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	stub.invoke("tx1", [][]byte{[]byte("registerDevice"), []byte(base64.RawStdEncoding.EncodeToString(pub)), []byte("3"), []byte("org1"), []byte("true")})
+
+	payload, _ := hex.DecodeString("0102021c020200fa058806765ff2960a0003e8")
+	frame := []byte{170, 0, 1, 128, 23, 72, 1, 33, 112, 114, 72, 196, 96, 18, 136, 161, 84, 49, 1}
+	frame = append(frame, payload...)
+	frame = append(frame, ed25519.Sign(priv, frame)...)
+	response := stub.invoke("tx2", [][]byte{[]byte("registerMeasurement"), []byte(base64.StdEncoding.EncodeToString(frame)), []byte(""), []byte("2019-07-06 19:45:10+02:00")})
+	if response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	data := SensorData{}
+	json.Unmarshal(stub.State["8017480121707248c4601288a1543101"], &data)
+	txTime, _ := getTxTime(stub)
+	if data.DeviceId != "DEVICE1" || data.Pm10 != 5.4 || data.Lat != 42.3519 || !data.TSdevice.Equal(txTime) {
+		t.Errorf("Measurement was incorrect, got: %+v", data)
+	}
+
+	frame[len(frame)-1] ^= 1
+	frame[18] = 2
+	response = stub.invoke("tx3", [][]byte{[]byte("registerMeasurement"), []byte(base64.StdEncoding.EncodeToString(frame)), []byte(""), []byte("2019-07-06 19:45:10+02:00")})
+	if response.Message == "" {
+		t.Errorf("Expected an invalid signature to be rejected")
+	}
+}
@@ -1,11 +1,29 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/attrmgr"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	sc "github.com/hyperledger/fabric/protos/peer"
+	"golang.org/x/crypto/ed25519"
 )
 
 func TestPMCalculation(t *testing.T) {
@@ -37,21 +55,133 @@ func TestHumidityCalculation(t *testing.T) {
 }
 
 func TestLatitudeConversion(t *testing.T) {
-	expectedResult := "049°00'33624\"N"
+	expectedResult := "49°00.33624'N"
 	b := []byte{'0', '4', '9', '0', '0', '3', '3', '6', '2', '4', 'N'}
-	output := calculateLatitudeFromCharBytes(b)
+	value, output, err := parseLatitudeFromCharBytes(b)
+	if err != nil {
+		t.Errorf("Latitude conversion failed: %s", err)
+	}
 	if output != expectedResult {
 		t.Errorf("Latitude conversion was incorrect, got: %s, want: %s", output, expectedResult)
 	}
+	if value != 49.005604 {
+		t.Errorf("Latitude conversion was incorrect, got: %g, want: %g", value, 49.005604)
+	}
 }
 
 func TestLongtitudeConversion(t *testing.T) {
-	expectedResult := "0008°25'31116\"E"
+	expectedResult := "8°25.31116'E"
 	b := []byte{'0', '0', '0', '8', '2', '5', '3', '1', '1', '1', '6', 'E'}
-	output := calculateLongtitudeFromCharBytes(b)
+	value, output, err := parseLongtitudeFromCharBytes(b)
+	if err != nil {
+		t.Errorf("Longtitude conversion failed: %s", err)
+	}
 	if output != expectedResult {
 		t.Errorf("Longtitude conversion was incorrect, got: %s, want: %s", output, expectedResult)
 	}
+	if value != 8.4218527 {
+		t.Errorf("Longtitude conversion was incorrect, got: %g, want: %g", value, 8.4218527)
+	}
+}
+
+func TestCoordinateHemispheres(t *testing.T) {
+	lat, _, _ := parseLatitudeFromCharBytes([]byte("0333000000S"))
+	if lat != -33.5 {
+		t.Errorf("Southern latitude was incorrect, got: %g, want: -33.5", lat)
+	}
+	lon, display, _ := parseLongtitudeFromCharBytes([]byte("01203000000W"))
+	if lon != -120.5 || display != "120°30.00000'W" {
+		t.Errorf("Western longtitude was incorrect, got: %g (%s), want: -120.5", lon, display)
+	}
+	lat, _, _ = parseLatitudeFromCharBytes([]byte("0900000000N"))
+	if lat != 90 {
+		t.Errorf("Pole latitude was incorrect, got: %g, want: 90", lat)
+	}
+}
+
+func TestFormatCoordinate(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{49.005604, "49°00.33624'N"},
+		{-33.8688197, "33°52.12918'S"},
+		{0, "0°00.00000'N"},
+		{59.9999999999, "60°00.00000'N"},
+	}
+	for _, test := range tests {
+		if result := formatCoordinate(test.value, 'N', 'S'); result != test.expected {
+			t.Errorf("Formatting of %g was incorrect, got: %s, want: %s", test.value, result, test.expected)
+		}
+	}
+}
+
+func TestCoordinateValidation(t *testing.T) {
+	invalidLatitudes := []string{"0910000000N", "0906000000N", "0496000000N", "049003362xN", "04900 3362N", "0490033624E", "0490033624", "-490033624N"}
+	for _, latitude := range invalidLatitudes {
+		if _, _, err := parseLatitudeFromCharBytes([]byte(latitude)); err == nil {
+			t.Errorf("Expected an error for latitude %q", latitude)
+		}
+	}
+	invalidLongtitudes := []string{"01810000000E", "01800000001W", "00086000000E", "0008253111?E", "00082531116N", "0008253111E"}
+	for _, longtitude := range invalidLongtitudes {
+		if _, _, err := parseLongtitudeFromCharBytes([]byte(longtitude)); err == nil {
+			t.Errorf("Expected an error for longtitude %q", longtitude)
+		}
+	}
+}
+
+func TestMigrateCoordinates(t *testing.T) {
+	stub := newTestStub()
+	legacy := SensorData{DeviceId: "DEVICE1", Pm10: 5.4, Latitude: "049°00'33624\"N", Longtitude: "0008°25'31116\"E"}
+	broken := SensorData{DeviceId: "DEVICE2", Pm10: 5.4, Latitude: "049°00'3362x\"N", Longtitude: "0008°25'31116\"E"}
+	// decimal degrees, written before measurements were indexed by geohash
+	unindexed := SensorData{DeviceId: "DEVICE3", Pm10: 5.4, Latitude: "48°46.5'N", Longtitude: "9°10.8'E", Lat: 48.775, Lon: 9.18, TSdevice: time.Date(2019, 7, 6, 12, 0, 0, 0, time.UTC)}
+	// indexed, but written before the numeric device timestamp existed
+	undated := SensorData{DocType: measurementDocType, DeviceId: "DEVICE3", Pm10: 5.4, Latitude: "48°46.5'N", Longtitude: "9°10.8'E", Lat: 48.775, Lon: 9.18, Geohash: encodeGeohash(48.775, 9.18, geohashPrecision), TSdevice: time.Date(2019, 7, 6, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60))}
+	legacyAsBytes, _ := json.Marshal(legacy)
+	undatedAsBytes, _ := json.Marshal(undated)
+	brokenAsBytes, _ := json.Marshal(broken)
+	unindexedAsBytes, _ := json.Marshal(unindexed)
+	stub.MockTransactionStart("setup")
+	stub.PutState("8017480121707248c4601288a154313f", legacyAsBytes)
+	stub.PutState("ad0bfa98167b062b98671e0e5e0f0595", brokenAsBytes)
+	stub.PutState("9017480121707248c4601288a1543140", unindexedAsBytes)
+	stub.PutState("9017480121707248c4601288a1543141", undatedAsBytes)
+	stub.PutState("DEVICE1", []byte("{\"pubKey\":\"\",\"code\":0,\"owner\":\"org1\",\"valid\":true}"))
+	stub.MockTransactionEnd("setup")
+
+	if response := stub.invoke("migrate0", [][]byte{[]byte("migrateCoordinates")}); response.Message != "Only admins may migrate measurements" {
+		t.Errorf("Expected a non-admin to be rejected, got: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "Admin@org1.example.com")
+	response := stub.invoke("migrate1", [][]byte{[]byte("migrateCoordinates")})
+	if string(response.Payload) != "{\"migrated\":3,\"skipped\":0,\"failed\":1}" {
+		t.Errorf("Unexpected migration result: %s %s", response.Message, string(response.Payload))
+	}
+	migrated := SensorData{}
+	json.Unmarshal(stub.State["8017480121707248c4601288a154313f"], &migrated)
+	if migrated.Lat != 49.005604 || migrated.Lon != 8.4218527 || migrated.Latitude != "49°00.33624'N" || migrated.Longtitude != "8°25.31116'E" || migrated.DocType != measurementDocType {
+		t.Errorf("Migrated record was incorrect, got: %+v", migrated)
+	}
+	json.Unmarshal(stub.State["9017480121707248c4601288a1543140"], &migrated)
+	indexKey, _ := stub.CreateCompositeKey(geohashIndex, append(strings.Split(encodeGeohash(48.775, 9.18, geohashPrecision), ""), "9017480121707248c4601288a1543140"))
+	locationKey, _ := stub.CreateCompositeKey(deviceLocationKey, []string{"DEVICE3"})
+	if migrated.Geohash != encodeGeohash(48.775, 9.18, geohashPrecision) || stub.State[indexKey] == nil || stub.State[locationKey] == nil {
+		t.Errorf("Expected the migrated record to be indexed by geohash, got: %+v", migrated)
+	}
+	if migrated.TSdeviceEpoch != 1562414400 {
+		t.Errorf("Expected the numeric device timestamp to be set, got: %d", migrated.TSdeviceEpoch)
+	}
+	json.Unmarshal(stub.State["9017480121707248c4601288a1543141"], &migrated)
+	if migrated.TSdeviceEpoch != 1562414400 {
+		t.Errorf("Expected the numeric device timestamp of an indexed record to be set, got: %d", migrated.TSdeviceEpoch)
+	}
+
+	response = stub.invoke("migrate2", [][]byte{[]byte("migrateCoordinates")})
+	if string(response.Payload) != "{\"migrated\":0,\"skipped\":3,\"failed\":1}" {
+		t.Errorf("Migration should be idempotent, got: %s", string(response.Payload))
+	}
 }
 
 func TestBase64Conversion(t *testing.T) {
@@ -67,7 +197,10 @@ func TestTimeToDateConversion(t *testing.T) {
 	expectedResult := "2019-07-06 19:43:00 +0200 CEST"
 	b := []byte{'1', '7', '4', '3', '0', '0'}
 	current_time, _ := time.Parse("2006-01-02 15:04:05", "2019-07-06 17:45:02")
-	output := convertTimestampToDate(b, current_time)
+	output, err := convertTimestampToDate(b, current_time)
+	if err != nil {
+		t.Errorf("Time conversion failed: %s", err)
+	}
 	if output.Local().String() != expectedResult {
 		t.Errorf("Time conversion was incorrect, got: %s, want: %s", output.Local().String(), expectedResult)
 	}
@@ -75,12 +208,119 @@ func TestTimeToDateConversion(t *testing.T) {
 	edgeCaseExpectation := "2019-07-06 23:59:59 +0000 UTC"
 	edgeCase := []byte{'2', '3', '5', '9', '5', '9'}
 	timeWithLatency, _ := time.Parse("2006-01-02 15:04:05", "2019-07-07 00:01:02")
-	edgeCaseOutput := convertTimestampToDate(edgeCase, timeWithLatency)
+	edgeCaseOutput, err := convertTimestampToDate(edgeCase, timeWithLatency)
+	if err != nil {
+		t.Errorf("Time conversion for edge case failed: %s", err)
+	}
 	if edgeCaseOutput.UTC().String() != edgeCaseExpectation {
 		t.Errorf("Time conversion for edge cas was incorrect, got: %s, want: %s", edgeCaseOutput.UTC().String(), expectedResult)
 	}
 }
 
+func TestTimeToDateConversionRollover(t *testing.T) {
+	tests := []struct {
+		name      string
+		timestamp string
+		reference string
+		expected  string
+	}{
+		{"same hour", "174300", "2019-07-06 17:45:02", "2019-07-06 17:43:00"},
+		{"buffered for hours", "091500", "2019-07-06 17:45:02", "2019-07-06 09:15:00"},
+		{"buffered for almost a day", "175100", "2019-07-06 17:45:02", "2019-07-05 17:51:00"},
+		{"device clock slightly ahead", "174900", "2019-07-06 17:45:02", "2019-07-06 17:49:00"},
+		{"midnight from 23h", "235959", "2019-07-07 00:01:02", "2019-07-06 23:59:59"},
+		{"midnight from 22h", "225000", "2019-07-07 00:10:00", "2019-07-06 22:50:00"},
+		{"midnight buffered for hours", "180000", "2019-07-07 02:00:00", "2019-07-06 18:00:00"},
+		{"exactly midnight", "000000", "2019-07-07 00:00:00", "2019-07-07 00:00:00"},
+		{"device ahead across midnight", "000030", "2019-07-06 23:59:00", "2019-07-07 00:00:30"},
+		{"end of month", "235500", "2019-08-01 00:03:00", "2019-07-31 23:55:00"},
+		{"end of 30 day month", "210000", "2019-10-01 01:00:00", "2019-09-30 21:00:00"},
+		{"end of february", "230000", "2019-03-01 00:30:00", "2019-02-28 23:00:00"},
+		{"leap day", "230000", "2020-03-01 00:30:00", "2020-02-29 23:00:00"},
+		{"device ahead into leap day", "000100", "2020-02-28 23:58:00", "2020-02-29 00:01:00"},
+		{"end of year", "235959", "2020-01-01 00:00:01", "2019-12-31 23:59:59"},
+		{"end of year buffered for hours", "120000", "2020-01-01 11:00:00", "2019-12-31 12:00:00"},
+		{"device ahead into new year", "000200", "2019-12-31 23:59:30", "2020-01-01 00:02:00"},
+	}
+	for _, test := range tests {
+		reference, _ := time.Parse("2006-01-02 15:04:05", test.reference)
+		output, err := convertTimestampToDate([]byte(test.timestamp), reference)
+		if err != nil {
+			t.Errorf("%s: time conversion failed: %s", test.name, err)
+			continue
+		}
+		if output.Format("2006-01-02 15:04:05") != test.expected {
+			t.Errorf("%s: time conversion was incorrect, got: %s, want: %s", test.name, output.Format("2006-01-02 15:04:05"), test.expected)
+		}
+		if output.Location() != time.UTC {
+			t.Errorf("%s: expected UTC result, got: %s", test.name, output.Location())
+		}
+	}
+}
+
+func TestTimeToDateConversionInvalidInput(t *testing.T) {
+	reference, _ := time.Parse("2006-01-02 15:04:05", "2019-07-06 17:45:02")
+	invalid := []string{"240000", "236000", "235960", "2a0000", "+10000", "-10000", "1743", "17430000"}
+	for _, timestamp := range invalid {
+		if _, err := convertTimestampToDate([]byte(timestamp), reference); err == nil {
+			t.Errorf("Expected an error for timestamp %q", timestamp)
+		}
+	}
+}
+
+func TestEpochToDateConversion(t *testing.T) {
+	tests := []struct {
+		seconds  uint32
+		expected string
+	}{
+		{1562435100, "2019-07-06 17:45:00"},
+		{1577836799, "2019-12-31 23:59:59"},
+		{1577836800, "2020-01-01 00:00:00"},
+		{1582934400, "2020-02-29 00:00:00"},
+	}
+	for _, test := range tests {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, test.seconds)
+		output := convertEpochToDate(b)
+		if output.Format("2006-01-02 15:04:05") != test.expected || output.Location() != time.UTC {
+			t.Errorf("Epoch conversion was incorrect, got: %s, want: %s UTC", output.String(), test.expected)
+		}
+	}
+}
+
+func TestAlternateDecoding(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	device := DeviceInfo{PublicKey: base64.RawStdEncoding.EncodeToString(pub), EncodingScheme: 1, Owner: "org1", ValidationFlag: true}
+	frame := []byte{170, 0, 7}
+	frame = append(frame, []byte{128, 23, 72, 1, 33, 112, 114, 72, 196, 96, 18, 136, 161, 84, 49, 63}...)
+	frame = append(frame, 54, 0, 43, 0, 188, 1, 43, 0)
+	frame = append(frame, 0x5d, 0x20, 0xde, 0x1c)
+	frame = append(frame, []byte("0490033624N00082531116E")...)
+	signature := ed25519.Sign(priv, frame)
+
+	data, txId := decodeMessageWithAlternateEncodingScheme(frame, signature, device, 7)
+	if txId != "8017480121707248c4601288a154313f" {
+		t.Errorf("Decoded UUID was not correct, got: %s", txId)
+	}
+	if data.DeviceId != "DEVICE7" {
+		t.Errorf("Decoded device ID was not correct, got: %s, want: DEVICE7", data.DeviceId)
+	}
+	if data.Pm10 != 5.4 || data.Pm25 != 4.3 || data.Humidity != 44.4 || data.Temp != 4.3 || data.Lat != 49.005604 || data.Lon != 8.4218527 {
+		t.Errorf("Decoded values were not correct, got: %+v", data)
+	}
+	if data.TSdevice.String() != "2019-07-06 17:45:00 +0000 UTC" {
+		t.Errorf("Decoded Timestamp value was not correct, got: %s", data.TSdevice.String())
+	}
+
+	if _, txId := decodeMessageWithAlternateEncodingScheme(frame[:40], signature, device, 7); txId != "" {
+		t.Errorf("Expected truncated frame to be rejected")
+	}
+	frame[20] = 1
+	if _, txId := decodeMessageWithAlternateEncodingScheme(frame, signature, device, 7); txId != "" {
+		t.Errorf("Expected tampered frame to be rejected")
+	}
+}
+
 func TestDateStringToTime(t *testing.T) {
 	output := convertDateStringToTime("2019-07-15 13:59:39+02:00")
 	if output.String() != "dsd" {
@@ -90,12 +330,13 @@ func TestDateStringToTime(t *testing.T) {
 
 func TestDecoding(t *testing.T) {
 	/*** expected Values ***/
-	expectedTimeResult := "2019-07-06 19:43:00 +0200 CEST"
-	expectedLatitudeResult := "049°00'33624\"N"
-	expectedLongtitudeResult := "0008°25'31116\"E"
+	expectedTimeResult := "2019-07-06 17:43:00 +0000 UTC"
+	expectedLatitudeResult := "49°00.33624'N"
+	expectedLongtitudeResult := "8°25.31116'E"
 	/*** test ***/
-	encodedString := "qgABrQv6mBZ7BiuYZx4OXg8FlU4CdgCvAtUAMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDAwMDA="
-	sig := "AfldAtf39XTim33H3mWlEz85SBi0k0GCOhQYMGtbSoOLDKyKx9SvE1NMNWYUdzN8he2A3UPeyACHDSchTo/7Ag=="
+	// signed with the ed25519 key whose seed is the SHA-256 hash of "TestDecoding"
+	encodedString := "qgABgBdIASFwckjEYBKIoVQxPzYAKwC8ASsAMTc0MzAwMDQ5MDAzMzYyNE4wMDA4MjUzMTExNkU="
+	sig := "+I/RcMxsmxpbfFbTmrUiKbolmUV9wv6IJHN3xQQsPYFGebk2XARA+RuUpFdTTfTo0VwQOFZb9E3l7yG6507LDQ=="
 	signature, err := base64.StdEncoding.DecodeString(sig)
 	input, err := base64.StdEncoding.DecodeString(encodedString)
 	if err != nil {
@@ -108,18 +349,19 @@ func TestDecoding(t *testing.T) {
 	if deviceId != 1 {
 		t.Errorf("conversion from byte 2-3 to integer failed")
 	}
-	device := DeviceInfo{PublicKey: "RakaJDXqkmm0YzwKxTo4BVVko5T/7oElNdP2FGrUHu8", EncodingScheme: 0, Owner: "org1", ValidationFlag: true}
+	device := DeviceInfo{PublicKey: "zcOJPjafFU1ThRhhXA+dPoadwB29Sf4LlbS8Mo+RrP0", EncodingScheme: 0, Owner: "org1", ValidationFlag: true}
 	uuidBytes := []byte{128, 23, 72, 1, 33, 112, 114, 72, 196, 96, 18, 136, 161, 84, 49, 63}
 	expectedUUID := hex.EncodeToString(uuidBytes)
-	data, txId := decodeMessageWithDefaultEncodingScheme(input, signature, device, 1)
+	reference, _ := time.Parse("2006-01-02 15:04:05", "2019-07-06 17:45:02")
+	data, txId := decodeMessageWithDefaultEncodingScheme(input, signature, device, 1, reference)
 	if txId == "" {
 		t.Errorf("Signature Verification failed")
 	}
 	if txId != expectedUUID {
 		t.Errorf("Decoded UUID was not correct, got: %s, want: %s", txId, expectedUUID)
 	}
-	if data.DeviceId != "Device1" {
-		t.Errorf("Decoded device ID was not correct, got: %s, want: Device1", data.DeviceId)
+	if data.DeviceId != "DEVICE1" {
+		t.Errorf("Decoded device ID was not correct, got: %s, want: DEVICE1", data.DeviceId)
 	}
 	if data.Pm10 != 5.4 {
 		t.Errorf("Decoded Pm10 value was not correct, got: %g, want: 5.4", data.Pm10)
@@ -144,3 +386,148 @@ func TestDecoding(t *testing.T) {
 	}
 
 }
+
+// testStub extends the MockStub with the client identity, transient data and key history,
+// which the MockStub of Fabric 1.4 does not provide
+type testStub struct {
+	*shim.MockStub
+	args      [][]byte
+	creator   []byte
+	transient map[string][]byte
+	history   map[string][]*queryresult.KeyModification
+}
+
+func newTestStub() *testStub {
+	stub := &testStub{MockStub: shim.NewMockStub("sensor-network", new(SmartContract)), history: make(map[string][]*queryresult.KeyModification)}
+	stub.setCaller("Org1MSP", "User1@org1.example.com")
+	return stub
+}
+
+// sets the identity used for the following invocations
+func (stub *testStub) setCaller(mspId, commonName string) {
+	stub.setCallerWithAttributes(mspId, commonName, nil)
+}
+
+// sets the identity used for the following invocations, with Fabric CA attributes in its certificate
+func (stub *testStub) setCallerWithAttributes(mspId, commonName string, attributes map[string]string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{mspId}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if attributes != nil {
+		attributesAsBytes, _ := json.Marshal(&attrmgr.Attributes{Attrs: attributes})
+		template.ExtraExtensions = []pkix.Extension{{Id: attrmgr.AttrOID, Value: attributesAsBytes}}
+	}
+	certificate, _ := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+	stub.creator, _ = proto.Marshal(&msp.SerializedIdentity{Mspid: mspId, IdBytes: certificatePEM})
+}
+
+// invokes the chaincode within a transaction, like MockInvoke does
+func (stub *testStub) invoke(txId string, args [][]byte) sc.Response {
+	stub.args = args
+	stub.MockTransactionStart(txId)
+	response := new(SmartContract).Invoke(stub)
+	stub.MockTransactionEnd(txId)
+	return response
+}
+
+func (stub *testStub) GetArgs() [][]byte {
+	return stub.args
+}
+
+func (stub *testStub) GetStringArgs() []string {
+	strargs := make([]string, 0, len(stub.args))
+	for _, barg := range stub.args {
+		strargs = append(strargs, string(barg))
+	}
+	return strargs
+}
+
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	allargs := stub.GetStringArgs()
+	if len(allargs) == 0 {
+		return "", []string{}
+	}
+	return allargs[0], allargs[1:]
+}
+
+func (stub *testStub) GetCreator() ([]byte, error) {
+	return stub.creator, nil
+}
+
+func (stub *testStub) GetTransient() (map[string][]byte, error) {
+	return stub.transient, nil
+}
+
+func (stub *testStub) PutState(key string, value []byte) error {
+	stub.history[key] = append(stub.history[key], &queryresult.KeyModification{TxId: stub.TxID, Value: value, Timestamp: stub.TxTimestamp})
+	return stub.MockStub.PutState(key, value)
+}
+
+func (stub *testStub) DelState(key string) error {
+	stub.history[key] = append(stub.history[key], &queryresult.KeyModification{TxId: stub.TxID, IsDelete: true, Timestamp: stub.TxTimestamp})
+	return stub.MockStub.DelState(key)
+}
+
+func (stub *testStub) DelPrivateData(collection string, key string) error {
+	delete(stub.PvtState[collection], key)
+	return nil
+}
+
+func (stub *testStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &testHistoryIterator{modifications: stub.history[key]}, nil
+}
+
+type testHistoryIterator struct {
+	modifications []*queryresult.KeyModification
+}
+
+func (iter *testHistoryIterator) HasNext() bool {
+	return len(iter.modifications) > 0
+}
+
+func (iter *testHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	modification := iter.modifications[0]
+	iter.modifications = iter.modifications[1:]
+	return modification, nil
+}
+
+func (iter *testHistoryIterator) Close() error {
+	return nil
+}
+
+// stores a valid device with a fresh ed25519 key pair under DEVICE<id>
+func registerTestDevice(stub *testStub, id int, owner string) ed25519.PrivateKey {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	device := DeviceInfo{PublicKey: base64.RawStdEncoding.EncodeToString(pub), EncodingScheme: 1, Owner: owner, ValidationFlag: true}
+	deviceAsBytes, _ := json.Marshal(device)
+	stub.MockTransactionStart("register-device")
+	stub.PutState("DEVICE"+strconv.Itoa(id), deviceAsBytes)
+	stub.MockTransactionEnd("register-device")
+	return priv
+}
+// builds a signed alternate encoding frame and returns the registerMeasurement arguments
+func buildTestMeasurement(priv ed25519.PrivateKey, deviceId uint16, uuid byte, pm10 byte, ts time.Time, latitude, longtitude string) [][]byte {
+	frame := []byte{170, byte(deviceId >> 8), byte(deviceId)}
+	frame = append(frame, 128, 23, 72, 1, 33, 112, 114, 72, 196, 96, 18, 136, 161, 84, 49, uuid)
+	frame = append(frame, pm10, 0, 43, 0, 188, 1, 43, 0)
+	epoch := make([]byte, 4)
+	binary.BigEndian.PutUint32(epoch, uint32(ts.Unix()))
+	frame = append(frame, epoch...)
+	frame = append(frame, []byte(latitude+longtitude)...)
+	// without key the signature is left empty for the caller to fill in
+	signature := []byte{}
+	if priv != nil {
+		signature = ed25519.Sign(priv, frame)
+	}
+	return [][]byte{
+		[]byte("registerMeasurement"),
+		[]byte(base64.StdEncoding.EncodeToString(frame)),
+		[]byte(base64.StdEncoding.EncodeToString(signature)),
+		[]byte(ts.Format("2006-01-02 15:04:05-07:00")),
+	}
+}
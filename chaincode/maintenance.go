@@ -0,0 +1,254 @@
+package main
+
+/*
+ * Maintenance log of devices.
+ * The owner of a device records maintenance like filter replacements or recalibrations together
+ * with the window in which the device was serviced. Events are stored under the device, keyed by
+ * the start of their window, so they can be queried by device and date range.
+ * registerMeasurement flags measurements taken within a declared window with the event ID. They
+ * are left out of the daily aggregates, see compliance.go. Windows last at most 7 days and may
+ * be declared after the fact, but must not start more than 7 days before they are recorded. Measurements registered before the event was recorded are not
+ * modified, but the daily aggregates which counted readings within the window are marked with
+ * the event and yield no valid daily mean, since those readings cannot be taken out again.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const maintenanceKey = "maintenance~deviceId~start~txId"
+
+const (
+	// window of events recorded without start and end, starting at the transaction time
+	defaultMaintenanceWindow = time.Hour
+	maxMaintenanceWindow     = 7 * 24 * time.Hour
+)
+
+var maintenanceTypes = []string{"filter_replacement", "recalibration", "sensor_replacement", "repair", "cleaning", "inspection", "other"}
+
+// Define the maintenance event structure
+type MaintenanceEvent struct {
+	Id          string    `json:"id"`
+	DeviceId    string    `json:"deviceId"`
+	Type        string    `json:"type"`
+	Notes       string    `json:"notes"`
+	Technician  string    `json:"technician"`
+	WindowStart time.Time `json:"windowStart"`
+	WindowEnd   time.Time `json:"windowEnd"`
+	RecordedAt  time.Time `json:"recordedAt"`
+	RecordedBy  string    `json:"recordedBy"`
+}
+
+// checks whether the time lies within the maintenance window, the window includes its start
+func (event MaintenanceEvent) covers(t time.Time) bool {
+	return !t.Before(event.WindowStart) && t.Before(event.WindowEnd)
+}
+
+// returns the maintenance events of the device ordered by the start of their window
+func getMaintenanceEvents(APIstub shim.ChaincodeStubInterface, deviceId string) ([]MaintenanceEvent, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(maintenanceKey, []string{deviceId})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	events := []MaintenanceEvent{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		event := MaintenanceEvent{}
+		if json.Unmarshal(queryResponse.Value, &event) != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// flags the measurement if it was taken within a maintenance window of its device
+func flagMaintenance(APIstub shim.ChaincodeStubInterface, data *SensorData) error {
+	events, err := getMaintenanceEvents(APIstub, data.DeviceId)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if event.covers(data.TSdevice) {
+			data.Maintenance = event.Id
+			return nil
+		}
+	}
+	return nil
+}
+
+// returns the hours of the day covered by the maintenance window, bit n is set for hour n
+func (event MaintenanceEvent) hoursOf(day time.Time) uint32 {
+	hours := uint32(0)
+	for hour := 0; hour < 24; hour++ {
+		start := day.Add(time.Duration(hour) * time.Hour)
+		if start.Before(event.WindowEnd) && start.Add(time.Hour).After(event.WindowStart) {
+			hours |= 1 << uint(hour)
+		}
+	}
+	return hours
+}
+
+// marks the daily aggregates of the device which already counted readings within the window
+func markMaintenanceAggregates(APIstub shim.ChaincodeStubInterface, event MaintenanceEvent) error {
+	for day := event.WindowStart.Truncate(24 * time.Hour); day.Before(event.WindowEnd); day = day.Add(24 * time.Hour) {
+		aggregateKey, err := APIstub.CreateCompositeKey(dailyAggregateKey, []string{event.DeviceId, day.UTC().Format(dailyDateLayout)})
+		if err != nil {
+			return err
+		}
+		aggregateAsBytes, err := APIstub.GetState(aggregateKey)
+		if err != nil {
+			return err
+		}
+		if aggregateAsBytes == nil {
+			continue
+		}
+		aggregate := DailyAggregate{}
+		if err := json.Unmarshal(aggregateAsBytes, &aggregate); err != nil {
+			return err
+		}
+		if aggregate.Hours&event.hoursOf(day) == 0 {
+			continue
+		}
+		aggregate.Maintenance = append(aggregate.Maintenance, event.Id)
+		aggregateAsBytes, _ = json.Marshal(aggregate)
+		if err := APIstub.PutState(aggregateKey, aggregateAsBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checks whether the maintenance type is known
+func isMaintenanceType(maintenanceType string) bool {
+	for _, t := range maintenanceTypes {
+		if t == maintenanceType {
+			return true
+		}
+	}
+	return false
+}
+
+// parses the optional maintenance window, defaults to an hour from the transaction time
+func parseMaintenanceWindow(start, end string, txTime time.Time) (time.Time, time.Time, error) {
+	if start == "" && end == "" {
+		return txTime, txTime.Add(defaultMaintenanceWindow), nil
+	}
+	windowStart, err := parseTimeArg(start)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	windowEnd, err := parseTimeArg(end)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if windowStart.IsZero() || !windowEnd.After(windowStart) {
+		return time.Time{}, time.Time{}, errors.New("Invalid maintenance window. Expecting a start before the end")
+	}
+	if windowEnd.Sub(windowStart) > maxMaintenanceWindow {
+		return time.Time{}, time.Time{}, errors.New("Invalid maintenance window. Expecting at most 7 days")
+	}
+	if windowStart.After(txTime.Add(maxDeviceClockSkew)) {
+		return time.Time{}, time.Time{}, errors.New("Maintenance windows cannot be declared in advance")
+	}
+	// older windows could void days which are already covered by compliance reports
+	if windowStart.Before(txTime.Add(-maxMaintenanceWindow)) {
+		return time.Time{}, time.Time{}, errors.New("Maintenance windows must start within 7 days before they are recorded")
+	}
+	return windowStart.UTC(), windowEnd.UTC(), nil
+}
+
+/*
+ * Expects deviceId, type, notes, technician and optionally the start and end of the maintenance
+ * window as timestamps. Types are filter_replacement, recalibration, sensor_replacement, repair,
+ * cleaning, inspection and other. Only the owner of the device may record maintenance.
+ */
+func (s *SmartContract) recordMaintenance(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 4 && len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 or 6")
+	}
+	if !isMaintenanceType(args[1]) {
+		return shim.Error("Unknown maintenance type " + args[1])
+	}
+	if args[3] == "" {
+		return shim.Error("Expecting a technician")
+	}
+	device, err := getDevice(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owner, err := isDeviceOwner(APIstub, device)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !owner {
+		return shim.Error("Only the owner of " + args[0] + " may record its maintenance")
+	}
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	start, end := "", ""
+	if len(args) == 6 {
+		start, end = args[4], args[5]
+	}
+	windowStart, windowEnd, err := parseMaintenanceWindow(start, end, txTime)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	mspId, _ := getClientMSPID(APIstub)
+	event := MaintenanceEvent{Id: APIstub.GetTxID(), DeviceId: args[0], Type: args[1], Notes: args[2], Technician: args[3], WindowStart: windowStart, WindowEnd: windowEnd, RecordedAt: txTime, RecordedBy: mspId}
+	key, err := APIstub.CreateCompositeKey(maintenanceKey, []string{event.DeviceId, event.WindowStart.Format(time.RFC3339), event.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	eventAsBytes, _ := json.Marshal(event)
+	if err := APIstub.PutState(key, eventAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := markMaintenanceAggregates(APIstub, event); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- recordMaintenance:\n%s\n", eventAsBytes)
+	return shim.Success(eventAsBytes)
+}
+
+// expects deviceId and from, to as timestamps (empty for no limit), returns the events whose window overlaps the range
+func (s *SmartContract) getMaintenance(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	from, err := parseTimeArg(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := parseTimeArg(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	events, err := getMaintenanceEvents(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	matching := []MaintenanceEvent{}
+	for _, event := range events {
+		if (to.IsZero() || !event.WindowStart.After(to)) && (from.IsZero() || event.WindowEnd.After(from)) {
+			matching = append(matching, event)
+		}
+	}
+	eventsAsBytes, _ := json.Marshal(matching)
+	fmt.Printf("- getMaintenance:\n%s\n", eventsAsBytes)
+	return shim.Success(eventsAsBytes)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	txTime := time.Date(2019, 7, 6, 12, 0, 0, 0, time.UTC)
+	start, end, err := parseMaintenanceWindow("", "", txTime)
+	if err != nil || !start.Equal(txTime) || !end.Equal(txTime.Add(defaultMaintenanceWindow)) {
+		t.Errorf("Default window was incorrect, got: %v %v %v", start, end, err)
+	}
+	start, end, err = parseMaintenanceWindow("2019-07-06T10:00:00+02:00", "2019-07-06T11:30:00Z", txTime)
+	if err != nil || !start.Equal(time.Date(2019, 7, 6, 8, 0, 0, 0, time.UTC)) || !end.Equal(time.Date(2019, 7, 6, 11, 30, 0, 0, time.UTC)) {
+		t.Errorf("Window was incorrect, got: %v %v %v", start, end, err)
+	}
+	if _, _, err := parseMaintenanceWindow("2019-07-06T11:00:00Z", "2019-07-06T10:00:00Z", txTime); err == nil {
+		t.Errorf("Expected a window ending before its start to be rejected")
+	}
+	if _, _, err := parseMaintenanceWindow("2019-07-07T10:00:00Z", "2019-07-07T11:00:00Z", txTime); err == nil {
+		t.Errorf("Expected a window in the future to be rejected")
+	}
+	if _, _, err := parseMaintenanceWindow("2019-06-29T13:00:00Z", "2019-07-06T13:00:01Z", txTime); err == nil {
+		t.Errorf("Expected a window longer than 7 days to be rejected")
+	}
+	if _, _, err := parseMaintenanceWindow("2019-06-29T12:00:00Z", "2019-06-29T13:00:00Z", txTime); err != nil {
+		t.Errorf("Expected a window starting 7 days before the transaction to be accepted, got: %v", err)
+	}
+	if _, _, err := parseMaintenanceWindow("2019-06-29T11:59:59Z", "2019-06-29T13:00:00Z", txTime); err == nil || err.Error() != "Maintenance windows must start within 7 days before they are recorded" {
+		t.Errorf("Expected a window starting more than 7 days before the transaction to be rejected, got: %v", err)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	stub := newTestStub()
+	priv := registerTestDevice(stub, 1, "org1")
+	ts := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	start, end := ts.Add(-10*time.Minute).Format(time.RFC3339), ts.Add(10*time.Minute).Format(time.RFC3339)
+
+	stub.setCaller("Org2MSP", "User1@org2.example.com")
+	if response := stub.invoke("tx1", [][]byte{[]byte("recordMaintenance"), []byte("DEVICE1"), []byte("filter_replacement"), []byte(""), []byte("J. Doe"), []byte(start), []byte(end)}); response.Message != "Only the owner of DEVICE1 may record its maintenance" {
+		t.Errorf("Expected another organization to be rejected, got: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "User1@org1.example.com")
+	if response := stub.invoke("tx2", [][]byte{[]byte("recordMaintenance"), []byte("DEVICE1"), []byte("painting"), []byte(""), []byte("J. Doe")}); response.Message != "Unknown maintenance type painting" {
+		t.Errorf("Expected an unknown type to be rejected, got: %s", response.Message)
+	}
+	if response := stub.invoke("tx3", [][]byte{[]byte("recordMaintenance"), []byte("DEVICE1"), []byte("filter_replacement"), []byte("replaced inlet filter"), []byte("J. Doe"), []byte(start), []byte(end)}); response.Message != "" {
+		t.Fatalf("recordMaintenance failed: %s", response.Message)
+	}
+	if response := stub.invoke("tx4", [][]byte{[]byte("recordMaintenance"), []byte("DEVICE1"), []byte("inspection"), []byte(""), []byte("J. Doe")}); response.Message != "" {
+		t.Fatalf("recordMaintenance failed: %s", response.Message)
+	}
+
+	if response := stub.invoke("m1", buildTestMeasurement(priv, 1, 1, 20, ts, "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	if response := stub.invoke("m2", buildTestMeasurement(priv, 1, 2, 20, ts.Add(20*time.Minute), "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	for i, expected := range []string{"tx3", ""} {
+		data := SensorData{}
+		json.Unmarshal(stub.State["8017480121707248c4601288a154310"+strconv.Itoa(i+1)], &data)
+		if data.Maintenance != expected {
+			t.Errorf("Maintenance flag of measurement %d was incorrect, got: %q, want: %q", i+1, data.Maintenance, expected)
+		}
+	}
+	aggregateKey, _ := stub.CreateCompositeKey(dailyAggregateKey, []string{"DEVICE1", ts.Add(20 * time.Minute).Format(dailyDateLayout)})
+	aggregate := DailyAggregate{}
+	json.Unmarshal(stub.State[aggregateKey], &aggregate)
+	if aggregate.Quantities[quantityPm10] == nil || aggregate.Quantities[quantityPm10].Count != 1 {
+		t.Errorf("Expected the measurement during maintenance to be left out of the daily aggregate, got: %s", stub.State[aggregateKey])
+	}
+
+	response := stub.invoke("q1", [][]byte{[]byte("getMaintenance"), []byte("DEVICE1"), []byte(""), []byte("")})
+	events := []MaintenanceEvent{}
+	json.Unmarshal(response.Payload, &events)
+	if len(events) != 2 || events[0].Id != "tx3" || events[0].Technician != "J. Doe" || events[0].RecordedBy != "Org1MSP" || events[1].Type != "inspection" {
+		t.Errorf("Maintenance events were incorrect, got: %s", response.Payload)
+	}
+	response = stub.invoke("q2", [][]byte{[]byte("getMaintenance"), []byte("DEVICE1"), []byte(ts.Add(30 * time.Minute).Format(time.RFC3339)), []byte("")})
+	events = []MaintenanceEvent{}
+	json.Unmarshal(response.Payload, &events)
+	if len(events) != 1 || events[0].Id != "tx4" {
+		t.Errorf("Expected only the later event, got: %s", response.Payload)
+	}
+
+	// declared after the measurement within its window had been counted
+	retroStart, retroEnd := ts.Add(15*time.Minute).Format(time.RFC3339), ts.Add(25*time.Minute).Format(time.RFC3339)
+	if response := stub.invoke("tx5", [][]byte{[]byte("recordMaintenance"), []byte("DEVICE1"), []byte("repair"), []byte(""), []byte("J. Doe"), []byte(retroStart), []byte(retroEnd)}); response.Message != "" {
+		t.Fatalf("recordMaintenance failed: %s", response.Message)
+	}
+	aggregate = DailyAggregate{}
+	json.Unmarshal(stub.State[aggregateKey], &aggregate)
+	if len(aggregate.Maintenance) != 1 || aggregate.Maintenance[0] != "tx5" {
+		t.Errorf("Expected the daily aggregate to be marked with the later declared window, got: %s", stub.State[aggregateKey])
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+/*
+ * Private data for devices on private premises.
+ * Each organization has an explicit collection (see collections_config.json) which only its
+ * own peers can read. For devices with PrivateLocation set, the precise location of every
+ * measurement and the personal details of the owner are stored in the collection of the
+ * owning organization, while the public SensorData only keeps a coarsened location.
+ * Owner details are passed in the transient map, so they never appear in the proposal.
+ * Frames of these devices carry the precise location as well, so registerMeasurement rejects
+ * them and they are submitted in the transient map to registerConfidentialMeasurement.
+ *
+ * Confidential measurements are submitted in the transient map as well. Their decoded record
+ * only goes to the collection of the owning organization, the public ledger just keeps a hash
+ * of the signed frame under the measurement UUID.
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	ownerDetailsTransientKey = "ownerDetails"
+	frameTransientKey        = "frame"
+	signatureTransientKey    = "signature"
+	measurementHashKey       = "hash~uuid"
+	// a geohash of 5 characters is a cell of about 4.9km x 4.9km
+	publicGeohashPrecision = 5
+)
+
+// Define the owner details structure, the personal information of a device owner
+type OwnerDetails struct {
+	Name    string  `json:"name"`
+	Contact string  `json:"contact"`
+	Address string  `json:"address"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+}
+
+// Define the private location structure, the precise location of a measurement
+type PrivateLocation struct {
+	DeviceId   string  `json:"deviceId"`
+	Longtitude string  `json:"longtitude"`
+	Latitude   string  `json:"latitude"`
+	Lon        float64 `json:"lon"`
+	Lat        float64 `json:"lat"`
+	Geohash    string  `json:"geohash"`
+}
+
+// Define the measurement hash structure, the public trace of a confidential measurement
+type MeasurementHash struct {
+	Hash       string `json:"hash"`
+	Collection string `json:"collection"`
+}
+
+// returns the private data collection of the organization, e.g. collectionOrg1Private for Org1MSP
+func privateCollectionName(mspId string) string {
+	return "collection" + strings.TrimSuffix(mspId, "MSP") + "Private"
+}
+
+// moves the precise location into the private location and coarsens the public one
+// the public coordinates are set to the center of the coarse geohash cell
+func splitPrivateLocation(data SensorData) (SensorData, PrivateLocation) {
+	location := PrivateLocation{DeviceId: data.DeviceId, Longtitude: data.Longtitude, Latitude: data.Latitude, Lon: data.Lon, Lat: data.Lat, Geohash: data.Geohash}
+	if len(data.Geohash) > publicGeohashPrecision {
+		data.Geohash = data.Geohash[:publicGeohashPrecision]
+	}
+	data.Lat, data.Lon = decodeGeohashCenter(data.Geohash)
+	data.Latitude = ""
+	data.Longtitude = ""
+	return data, location
+}
+
+// replaces the precise public location and latest reading of the device by coarsened ones,
+// for devices whose location has just become private
+func coarsenPublicLocation(APIstub shim.ChaincodeStubInterface, deviceId string) error {
+	locationKey, err := APIstub.CreateCompositeKey(deviceLocationKey, []string{deviceId})
+	if err != nil {
+		return err
+	}
+	locationAsBytes, err := APIstub.GetState(locationKey)
+	if err != nil {
+		return err
+	}
+	location := DeviceLocation{}
+	if locationAsBytes != nil && json.Unmarshal(locationAsBytes, &location) == nil && len(location.Geohash) > publicGeohashPrecision {
+		location.Geohash = location.Geohash[:publicGeohashPrecision]
+		location.Lat, location.Lon = decodeGeohashCenter(location.Geohash)
+		locationAsBytes, _ = json.Marshal(location)
+		if err := APIstub.PutState(locationKey, locationAsBytes); err != nil {
+			return err
+		}
+	}
+
+	latest, latestKey, err := getLatestReading(APIstub, deviceId)
+	if err != nil || latest == nil || len(latest.Measurement.Geohash) <= publicGeohashPrecision {
+		return err
+	}
+	latest.Measurement, _ = splitPrivateLocation(latest.Measurement)
+	latestAsBytes, _ := json.Marshal(latest)
+	return APIstub.PutState(latestKey, latestAsBytes)
+}
+
+// reads and validates the owner details from the transient map, returns nil if there are none
+func getTransientOwnerDetails(APIstub shim.ChaincodeStubInterface) (*OwnerDetails, []byte, error) {
+	transientMap, err := APIstub.GetTransient()
+	if err != nil {
+		return nil, nil, err
+	}
+	detailsAsBytes, ok := transientMap[ownerDetailsTransientKey]
+	if !ok {
+		return nil, nil, nil
+	}
+	details := OwnerDetails{}
+	if err := json.Unmarshal(detailsAsBytes, &details); err != nil {
+		return nil, nil, fmt.Errorf("Invalid owner details in transient map: %s", err)
+	}
+	if details.Lat < -90 || details.Lat > 90 || details.Lon < -180 || details.Lon > 180 {
+		return nil, nil, fmt.Errorf("Invalid owner location %g,%g", details.Lat, details.Lon)
+	}
+	detailsAsBytes, _ = json.Marshal(details)
+	return &details, detailsAsBytes, nil
+}
+
+/*
+ * Stores the owner details from the transient map for an existing device and marks its location as private.
+ * The public location of the device is coarsened. Only the organization owning the device may do so.
+ */
+func (s *SmartContract) setDeviceOwnerDetails(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	deviceAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if deviceAsBytes == nil {
+		return shim.Error("Device " + args[0] + " does not exist")
+	}
+	device := DeviceInfo{}
+	json.Unmarshal(deviceAsBytes, &device)
+	owner, err := isDeviceOwner(APIstub, device)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !owner {
+		return shim.Error("Only the owner of " + args[0] + " may set its owner details")
+	}
+	details, detailsAsBytes, err := getTransientOwnerDetails(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if details == nil {
+		return shim.Error("Owner details must be passed in the transient map as " + ownerDetailsTransientKey)
+	}
+	if err := APIstub.PutPrivateData(privateCollectionName(ownerMSPID(device.Owner)), args[0], detailsAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	if !device.PrivateLocation {
+		mspId, err := getClientMSPID(APIstub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		device.PrivateLocation = true
+		device.UpdatedBy = mspId
+		deviceAsBytes, _ = json.Marshal(device)
+		if err := APIstub.PutState(args[0], deviceAsBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := coarsenPublicLocation(APIstub, args[0]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return shim.Success(nil)
+}
+
+// returns the owner details of the device, only readable by the owning organization
+func (s *SmartContract) getDeviceOwnerDetails(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	deviceAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if deviceAsBytes == nil {
+		return shim.Error("Device " + args[0] + " does not exist")
+	}
+	device := DeviceInfo{}
+	json.Unmarshal(deviceAsBytes, &device)
+	detailsAsBytes, err := APIstub.GetPrivateData(privateCollectionName(ownerMSPID(device.Owner)), args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if detailsAsBytes == nil {
+		return shim.Error("No owner details for " + args[0])
+	}
+	return shim.Success(detailsAsBytes)
+}
+
+// returns the precise location of the measurement, only readable by the organization owning the device
+func (s *SmartContract) getPrivateMeasurementLocation(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	dataAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if dataAsBytes == nil {
+		return shim.Error("Measurement " + args[0] + " does not exist")
+	}
+	data := SensorData{}
+	json.Unmarshal(dataAsBytes, &data)
+	deviceAsBytes, err := APIstub.GetState(data.DeviceId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	device := DeviceInfo{}
+	json.Unmarshal(deviceAsBytes, &device)
+	// the location was stored in the collection of the owner at the time of the measurement
+	locationAsBytes, err := APIstub.GetPrivateData(privateCollectionName(ownerMSPID(measurementOwner(data, device))), args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if locationAsBytes == nil {
+		return shim.Error("No private location for " + args[0])
+	}
+	return shim.Success(locationAsBytes)
+}
+
+/*
+ * Registers a measurement whose frame and signature are passed in the transient map
+ * (keys frame and signature, raw bytes). Frames which carry their own signature need no signature entry.
+ * Expects the gateway timestamp as only argument.
+ * Measurements of devices with a private location are stored like those of registerMeasurement
+ * with a coarsened public location, all others only leave a hash on the public ledger.
+ */
+func (s *SmartContract) registerConfidentialMeasurement(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	transientMap, err := APIstub.GetTransient()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	b, ok := transientMap[frameTransientKey]
+	if !ok || len(b) == 0 {
+		return shim.Error("Frame must be passed in the transient map as " + frameTransientKey)
+	}
+	// optional, COSE and LPP frames carry their signature
+	b2 := transientMap[signatureTransientKey]
+
+	data, txId, device, err := decodeMeasurement(APIstub, b, b2)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	data.TSgw = convertDateStringToTime(args[0])
+
+	if device.PrivateLocation {
+		var location PrivateLocation
+		data, location = splitPrivateLocation(data)
+		locationAsBytes, _ := json.Marshal(location)
+		if err := APIstub.PutPrivateData(privateCollectionName(ownerMSPID(device.Owner)), txId, locationAsBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := storeMeasurement(APIstub, txId, data, device); err != nil {
+			return shim.Error(err.Error())
+		}
+		fmt.Printf("- registerConfidentialMeasurement:\n%s\n", txId)
+		return shim.Success(nil)
+	}
+
+	// the UUID must not have been registered through either path
+	if err := checkMeasurementUnregistered(APIstub, txId); err != nil {
+		return shim.Error(err.Error())
+	}
+	hashKey, err := APIstub.CreateCompositeKey(measurementHashKey, []string{txId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	collection := privateCollectionName(ownerMSPID(device.Owner))
+	dataAsBytes, _ := json.Marshal(data)
+	if err := APIstub.PutPrivateData(collection, txId, dataAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	hash := sha256.Sum256(append(append([]byte{}, b...), b2...))
+	hashAsBytes, _ := json.Marshal(MeasurementHash{Hash: hex.EncodeToString(hash[:]), Collection: collection})
+	if err := APIstub.PutState(hashKey, hashAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := recordDeviceMeasurement(APIstub, data); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- registerConfidentialMeasurement:\n%s\n", txId)
+	return shim.Success(nil)
+}
+
+// returns the decoded confidential measurement, only readable by the organization owning the device
+func (s *SmartContract) getConfidentialMeasurement(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	hashKey, err := APIstub.CreateCompositeKey(measurementHashKey, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	hashAsBytes, err := APIstub.GetState(hashKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if hashAsBytes == nil {
+		return shim.Error("Confidential measurement " + args[0] + " does not exist")
+	}
+	measurementHash := MeasurementHash{}
+	json.Unmarshal(hashAsBytes, &measurementHash)
+	dataAsBytes, err := APIstub.GetPrivateData(measurementHash.Collection, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if dataAsBytes == nil {
+		return shim.Error("Confidential measurement " + args[0] + " is not readable by this peer")
+	}
+	return shim.Success(dataAsBytes)
+}
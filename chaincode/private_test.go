@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitPrivateLocation(t *testing.T) {
+	data := SensorData{DeviceId: "DEVICE1", Latitude: "49°00.33624'N", Longtitude: "8°25.31116'E", Lat: 49.005604, Lon: 8.4218527, Geohash: "u0tyz9hw"}
+	public, location := splitPrivateLocation(data)
+	if public.Geohash != "u0tyz" || public.Latitude != "" || public.Longtitude != "" {
+		t.Errorf("Public location was not coarsened: %+v", public)
+	}
+	if haversineDistance(public.Lat, public.Lon, data.Lat, data.Lon) > 5000 || public.Lat == data.Lat {
+		t.Errorf("Public coordinates should be the center of the coarse cell, got: %g,%g", public.Lat, public.Lon)
+	}
+	if location.Lat != data.Lat || location.Lon != data.Lon || location.Geohash != data.Geohash || location.Latitude != data.Latitude {
+		t.Errorf("Private location is not precise: %+v", location)
+	}
+}
+
+func TestPrivateDeviceLocation(t *testing.T) {
+	stub := newTestStub()
+	priv := registerTestDevice(stub, 1, "org1")
+	ts := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	// reported before the location became private
+	if response := stub.invoke("tx0", buildTestMeasurement(priv, 1, 0, 54, ts.Add(-time.Minute), "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	stub.transient = map[string][]byte{ownerDetailsTransientKey: []byte(`{"name":"Jane Doe","address":"Kaiserstr. 12","lat":49.0056,"lon":8.4218}`)}
+
+	stub.setCaller("Org2MSP", "Admin@org2.example.com")
+	if response := stub.invoke("tx1", [][]byte{[]byte("setDeviceOwnerDetails"), []byte("DEVICE1")}); response.Message == "" {
+		t.Errorf("Expected another organization to be rejected")
+	}
+	stub.setCaller("Org1MSP", "Admin@org1.example.com")
+	if response := stub.invoke("tx2", [][]byte{[]byte("setDeviceOwnerDetails"), []byte("DEVICE1")}); response.Message != "" {
+		t.Fatalf("setDeviceOwnerDetails failed: %s", response.Message)
+	}
+	if stub.PvtState["collectionOrg2Private"] != nil {
+		t.Errorf("Owner details must only be stored in the collection of the owner")
+	}
+	details := OwnerDetails{}
+	json.Unmarshal(stub.PvtState["collectionOrg1Private"]["DEVICE1"], &details)
+	if details.Name != "Jane Doe" {
+		t.Errorf("Owner details were not stored, got: %+v", details)
+	}
+	device := DeviceInfo{}
+	json.Unmarshal(stub.State["DEVICE1"], &device)
+	if !device.PrivateLocation || device.UpdatedBy != "Org1MSP" {
+		t.Errorf("Device location should be private, got: %+v", device)
+	}
+	if strings.Contains(string(stub.State["DEVICE1"]), "Jane") {
+		t.Errorf("Owner details leaked into the public device record")
+	}
+
+	locationKey, _ := stub.CreateCompositeKey(deviceLocationKey, []string{"DEVICE1"})
+	deviceLocation := DeviceLocation{}
+	json.Unmarshal(stub.State[locationKey], &deviceLocation)
+	latest, _, _ := getLatestReading(stub, "DEVICE1")
+	if deviceLocation.Geohash != "u0tyz" || deviceLocation.Lat == 49.005604 || latest.Measurement.Geohash != "u0tyz" || latest.Measurement.Latitude != "" {
+		t.Errorf("The precise location of the device is still public: %+v %+v", deviceLocation, latest.Measurement)
+	}
+
+	stub.transient = nil
+	args := buildTestMeasurement(priv, 1, 1, 54, ts, "0490033624N", "00082531116E")
+	if response := stub.invoke("tx3", args); response.Message == "" {
+		t.Errorf("Expected the frame of a private device to be rejected as public argument")
+	}
+	frame, _ := base64.StdEncoding.DecodeString(string(args[1]))
+	signature, _ := base64.StdEncoding.DecodeString(string(args[2]))
+	stub.transient = map[string][]byte{frameTransientKey: frame, signatureTransientKey: signature}
+	if response := stub.invoke("tx4", [][]byte{[]byte("registerConfidentialMeasurement"), args[3]}); response.Message != "" {
+		t.Fatalf("registerConfidentialMeasurement failed: %s", response.Message)
+	}
+	uuid := "8017480121707248c4601288a1543101"
+	public := SensorData{}
+	json.Unmarshal(stub.State[uuid], &public)
+	if public.Geohash != "u0tyz" || public.Latitude != "" || public.Lat == 49.005604 {
+		t.Errorf("Public measurement carries the precise location: %+v", public)
+	}
+	response := stub.invoke("q1", [][]byte{[]byte("getPrivateMeasurementLocation"), []byte(uuid)})
+	location := PrivateLocation{}
+	json.Unmarshal(response.Payload, &location)
+	if location.Lat != 49.005604 || location.Lon != 8.4218527 || location.Geohash != "u0tyz9hw" {
+		t.Errorf("Private location was incorrect, got: %s %s", response.Message, string(response.Payload))
+	}
+
+	// the coarse index entry is still found by a small bounding box around the cell
+	response = stub.invoke("q2", [][]byte{[]byte("getMeasurementsInBoundingBox"), []byte("48.99"), []byte("8.40"), []byte("49.03"), []byte("8.45"), []byte(""), []byte("")})
+	records := []struct{ Key string }{}
+	json.Unmarshal(response.Payload, &records)
+	if len(records) != 2 {
+		t.Errorf("Expected the measurements of the private device in the bounding box, got: %s", string(response.Payload))
+	}
+}
+
+func TestConfidentialMeasurement(t *testing.T) {
+	stub := newTestStub()
+	priv := registerTestDevice(stub, 1, "org2")
+	ts := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	args := buildTestMeasurement(priv, 1, 1, 54, ts, "0490033624N", "00082531116E")
+	frame, _ := base64.StdEncoding.DecodeString(string(args[1]))
+	signature, _ := base64.StdEncoding.DecodeString(string(args[2]))
+	tsgw := args[3]
+
+	stub.transient = map[string][]byte{frameTransientKey: frame}
+	if response := stub.invoke("tx1", [][]byte{[]byte("registerConfidentialMeasurement"), tsgw}); response.Message == "" {
+		t.Errorf("Expected a missing signature to be rejected")
+	}
+	tampered := append([]byte{}, frame...)
+	tampered[20] = 99
+	stub.transient = map[string][]byte{frameTransientKey: tampered, signatureTransientKey: signature}
+	if response := stub.invoke("tx2", [][]byte{[]byte("registerConfidentialMeasurement"), tsgw}); response.Message == "" {
+		t.Errorf("Expected an invalid signature to be rejected")
+	}
+
+	stub.transient = map[string][]byte{frameTransientKey: frame, signatureTransientKey: signature}
+	if response := stub.invoke("tx3", [][]byte{[]byte("registerConfidentialMeasurement"), tsgw}); response.Message != "" {
+		t.Fatalf("registerConfidentialMeasurement failed: %s", response.Message)
+	}
+	uuid := "8017480121707248c4601288a1543101"
+	if stub.State[uuid] != nil {
+		t.Errorf("The decoded measurement must not be stored on the public ledger")
+	}
+	hashKey, _ := stub.CreateCompositeKey(measurementHashKey, []string{uuid})
+	measurementHash := MeasurementHash{}
+	json.Unmarshal(stub.State[hashKey], &measurementHash)
+	expectedHash := sha256.Sum256(append(append([]byte{}, frame...), signature...))
+	if measurementHash.Hash != hex.EncodeToString(expectedHash[:]) || measurementHash.Collection != "collectionOrg2Private" {
+		t.Errorf("Unexpected public hash record: %s", string(stub.State[hashKey]))
+	}
+	for key := range stub.State {
+		if strings.HasPrefix(key, "\x00"+geohashIndex) || strings.HasPrefix(key, "\x00"+deviceLocationKey) {
+			t.Errorf("Confidential measurement leaked into the public index %q", key)
+		}
+	}
+	private := SensorData{}
+	json.Unmarshal(stub.PvtState["collectionOrg2Private"][uuid], &private)
+	if private.DeviceId != "DEVICE1" || private.Pm10 != 5.4 || private.Lat != 49.005604 || !private.TSdevice.Equal(ts) {
+		t.Errorf("Unexpected private record: %+v", private)
+	}
+
+	response := stub.invoke("q1", [][]byte{[]byte("getConfidentialMeasurement"), []byte(uuid)})
+	if response.Message != "" || string(response.Payload) != string(stub.PvtState["collectionOrg2Private"][uuid]) {
+		t.Errorf("getConfidentialMeasurement failed: %s", response.Message)
+	}
+	if response := stub.invoke("tx4", [][]byte{[]byte("registerConfidentialMeasurement"), tsgw}); response.Message == "" {
+		t.Errorf("Expected a replayed measurement to be rejected")
+	}
+
+	// a UUID must not be registered both publicly and confidentially
+	stub.transient = nil
+	if response := stub.invoke("tx5", args); response.Message != "Measurement "+uuid+" has already been registered" {
+		t.Errorf("Expected a confidential measurement not to be registered publicly, got: %s", response.Message)
+	}
+	public := buildTestMeasurement(priv, 1, 2, 54, ts.Add(time.Second), "0490033624N", "00082531116E")
+	if response := stub.invoke("tx6", public); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	frame, _ = base64.StdEncoding.DecodeString(string(public[1]))
+	signature, _ = base64.StdEncoding.DecodeString(string(public[2]))
+	stub.transient = map[string][]byte{frameTransientKey: frame, signatureTransientKey: signature}
+	if response := stub.invoke("tx7", [][]byte{[]byte("registerConfidentialMeasurement"), public[3]}); response.Message != "Measurement 8017480121707248c4601288a1543102 has already been registered" {
+		t.Errorf("Expected a public measurement not to be registered confidentially, got: %s", response.Message)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+/*
+ * Manufacturer provisioning and device claims.
+ * A manufacturer (client with the attribute role=manufacturer) registers devices in bulk in
+ * the provisioned state, each with the SHA-256 hash of a one-time claim code. The claim code
+ * is shipped with the device. An operator organization claims the device with the code, which
+ * makes it the owner and activates the device. Claim codes should carry at least 128 bits of
+ * entropy, as their hashes are public. The claim code is passed in the transient map, so it
+ * never appears in a block and cannot be taken from a pending claim to front-run it.
+ */
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const claimCodeTransientKey = "claimCode"
+
+// device states
+const (
+	deviceProvisioned = "provisioned"
+	deviceActive      = "active"
+)
+
+// Define the provisioned device structure, one entry of the provisionDevices argument
+type ProvisionedDevice struct {
+	PublicKey      string `json:"pubKey"`
+	EncodingScheme int    `json:"code"`
+	ClaimCodeHash  string `json:"claimCodeHash"`
+	Model          string `json:"model,omitempty"`
+}
+
+// returns the hex encoded SHA-256 hash of the claim code
+func hashClaimCode(claimCode string) string {
+	hash := sha256.Sum256([]byte(claimCode))
+	return hex.EncodeToString(hash[:])
+}
+
+/*
+ * Expects a JSON array of provisioned devices, e.g.
+ * [{"pubKey":"pQBakw2oxXklWGruTdMVnbbNsNG+nsojdlusAiaRVLU","code":1,"claimCodeHash":"<hex sha256 of the claim code>","model":"SDS011"}]
+ * The sensor model is optional.
+ * Returns the assigned device IDs in the order of the array.
+ */
+func (s *SmartContract) provisionDevices(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	manufacturer, err := isManufacturer(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !manufacturer {
+		return shim.Error("Only manufacturers may provision devices")
+	}
+	devices := []ProvisionedDevice{}
+	if err := json.Unmarshal([]byte(args[0]), &devices); err != nil {
+		return shim.Error("Invalid device list: " + err.Error())
+	}
+	if len(devices) == 0 {
+		return shim.Error("Device list must not be empty")
+	}
+	keys := []string{}
+	for i, device := range devices {
+		keys = append(keys, device.PublicKey)
+		if hash, err := hex.DecodeString(device.ClaimCodeHash); err != nil || len(hash) != sha256.Size {
+			return shim.Error("Invalid claim code hash of device " + strconv.Itoa(i) + ". Expecting a hex encoded SHA-256 hash")
+		}
+	}
+	deviceKeys, err := canonicalNewPublicKeys(APIstub, keys)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	next, err := nextDeviceNumber(APIstub, len(devices))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	deviceIds := []string{}
+	for i, device := range devices {
+		deviceIdAsString := "DEVICE" + strconv.Itoa(next+i)
+		data := DeviceInfo{PublicKey: deviceKeys[i].PublicKey, SignatureAlgorithm: deviceKeys[i].SignatureAlgorithm, EncodingScheme: device.EncodingScheme, Status: deviceProvisioned, Manufacturer: mspId, ClaimCodeHash: device.ClaimCodeHash, Model: device.Model, UpdatedBy: mspId}
+		dataAsBytes, _ := json.Marshal(data)
+		if err := APIstub.PutState(deviceIdAsString, dataAsBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+		// until the device is claimed, only the organization of the manufacturer may endorse changes
+		if err := setDeviceEndorsementPolicy(APIstub, deviceIdAsString, mspId); err != nil {
+			return shim.Error(err.Error())
+		}
+		deviceIds = append(deviceIds, deviceIdAsString)
+	}
+	deviceIdsAsBytes, _ := json.Marshal(deviceIds)
+	fmt.Printf("- provisionDevices:\n%s\n", deviceIdsAsBytes)
+	return shim.Success(deviceIdsAsBytes)
+}
+
+// expects deviceId and the claim code in the transient map, makes the organization of the client the owner of the provisioned device
+func (s *SmartContract) claimDevice(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	transientMap, err := APIstub.GetTransient()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	claimCode, ok := transientMap[claimCodeTransientKey]
+	if !ok {
+		return shim.Error("Claim code must be passed in the transient map as " + claimCodeTransientKey)
+	}
+	deviceAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if deviceAsBytes == nil {
+		return shim.Error("Device " + args[0] + " does not exist")
+	}
+	device := DeviceInfo{}
+	json.Unmarshal(deviceAsBytes, &device)
+	if device.Status != deviceProvisioned {
+		return shim.Error("Device " + args[0] + " is not available for claiming")
+	}
+	if subtle.ConstantTimeCompare([]byte(hashClaimCode(string(claimCode))), []byte(device.ClaimCodeHash)) != 1 {
+		return shim.Error("Invalid claim code for " + args[0])
+	}
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	device.Owner = organizationName(mspId)
+	device.Status = deviceActive
+	device.ValidationFlag = true
+	// the claim code is single-use
+	device.ClaimCodeHash = ""
+	device.UpdatedBy = mspId
+	deviceAsBytes, _ = json.Marshal(device)
+	if err := APIstub.PutState(args[0], deviceAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := setDeviceEndorsementPolicy(APIstub, args[0], mspId); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- claimDevice:\n%s\n", deviceAsBytes)
+	return shim.Success(deviceAsBytes)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestProvisionAndClaimDevice(t *testing.T) {
+	stub := newTestStub()
+	registerTestDevice(stub, 1, "org1")
+	devices := `[{"pubKey":"pQBakw2oxXklWGruTdMVnbbNsNG+nsojdlusAiaRVLU","code":1,"claimCodeHash":"` + hashClaimCode("first-claim-code") + `"},` +
+		`{"pubKey":"RakaJDXqkmm0YzwKxTo4BVVko5T/7oElNdP2FGrUHu8","code":1,"claimCodeHash":"` + hashClaimCode("second-claim-code") + `"}]`
+
+	response := stub.invoke("tx1", [][]byte{[]byte("provisionDevices"), []byte(devices)})
+	if response.Message != "Only manufacturers may provision devices" {
+		t.Errorf("Expected clients without manufacturer role to be rejected, got: %s", response.Message)
+	}
+	stub.setCallerWithAttributes("Org1MSP", "factory", map[string]string{"role": "manufacturer"})
+	response = stub.invoke("tx2", [][]byte{[]byte("provisionDevices"), []byte(`[{"pubKey":"pQBakw2oxXklWGruTdMVnbbNsNG+nsojdlusAiaRVLU","code":1,"claimCodeHash":"first-claim-code"}]`)})
+	if !strings.HasPrefix(response.Message, "Invalid claim code hash") {
+		t.Errorf("Expected a plain claim code to be rejected, got: %s", response.Message)
+	}
+	response = stub.invoke("tx3", [][]byte{[]byte("provisionDevices"), []byte(devices)})
+	if string(response.Payload) != `["DEVICE2","DEVICE3"]` {
+		t.Fatalf("Unexpected device IDs: %s %s", response.Message, string(response.Payload))
+	}
+	device := DeviceInfo{}
+	json.Unmarshal(stub.State["DEVICE2"], &device)
+	if device.Status != deviceProvisioned || device.ValidationFlag || device.Owner != "" || device.Manufacturer != "Org1MSP" {
+		t.Errorf("Device was not provisioned correctly, got: %+v", device)
+	}
+
+	stub.setCaller("Org2MSP", "User1@org2.example.com")
+	response = stub.invoke("tx4a", [][]byte{[]byte("claimDevice"), []byte("DEVICE2"), []byte("first-claim-code")})
+	if !strings.HasPrefix(response.Message, "Incorrect number of arguments") {
+		t.Errorf("Expected a claim code in the arguments to be rejected, got: %s", response.Message)
+	}
+	response = stub.invoke("tx4b", [][]byte{[]byte("claimDevice"), []byte("DEVICE2")})
+	if !strings.HasPrefix(response.Message, "Claim code must be passed in the transient map") {
+		t.Errorf("Expected a missing claim code to be rejected, got: %s", response.Message)
+	}
+	stub.transient = map[string][]byte{claimCodeTransientKey: []byte("second-claim-code")}
+	response = stub.invoke("tx4", [][]byte{[]byte("claimDevice"), []byte("DEVICE2")})
+	if response.Message != "Invalid claim code for DEVICE2" {
+		t.Errorf("Expected the claim code of another device to be rejected, got: %s", response.Message)
+	}
+	stub.transient = map[string][]byte{claimCodeTransientKey: []byte("first-claim-code")}
+	response = stub.invoke("tx5", [][]byte{[]byte("claimDevice"), []byte("DEVICE2")})
+	if response.Message != "" {
+		t.Fatalf("claimDevice failed: %s", response.Message)
+	}
+	device = DeviceInfo{}
+	json.Unmarshal(stub.State["DEVICE2"], &device)
+	if device.Status != deviceActive || !device.ValidationFlag || device.Owner != "org2" || device.ClaimCodeHash != "" {
+		t.Errorf("Device was not claimed correctly, got: %+v", device)
+	}
+	orgs, _ := getDeviceEndorsementOrgs(stub, "DEVICE2")
+	if len(orgs) != 1 || orgs[0] != "Org2MSP" {
+		t.Errorf("Expected the endorsement policy to require the claiming organization, got: %v", orgs)
+	}
+
+	stub.setCaller("Org1MSP", "User1@org1.example.com")
+	stub.transient = map[string][]byte{claimCodeTransientKey: []byte("first-claim-code")}
+	response = stub.invoke("tx6", [][]byte{[]byte("claimDevice"), []byte("DEVICE2")})
+	if response.Message != "Device DEVICE2 is not available for claiming" {
+		t.Errorf("Expected the claim code to be single-use, got: %s", response.Message)
+	}
+	stub.transient = map[string][]byte{claimCodeTransientKey: []byte("")}
+	response = stub.invoke("tx7", [][]byte{[]byte("claimDevice"), []byte("DEVICE1")})
+	if response.Message != "Device DEVICE1 is not available for claiming" {
+		t.Errorf("Expected registered devices not to be claimable, got: %s", response.Message)
+	}
+}
+
+func TestOrganizationName(t *testing.T) {
+	for mspId, expected := range map[string]string{"Org1MSP": "org1", "Org2MSP": "org2", "": ""} {
+		if name := organizationName(mspId); name != expected || (name != "" && ownerMSPID(name) != mspId) {
+			t.Errorf("Organization name of %q was incorrect, got: %s, want: %s", mspId, name, expected)
+		}
+	}
+}
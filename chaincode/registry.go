@@ -0,0 +1,157 @@
+package main
+
+/*
+ * Bulk registration and export of the device registry.
+ * registerDevicesBulk registers a whole rollout within one transaction, exportDeviceRegistry
+ * returns the registry as CSV or JSON for the firmware provisioning pipeline.
+ */
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// maximum number of devices registered within one transaction
+const maxBulkDevices = 1000
+
+// Define the device registration structure, one entry of the registerDevicesBulk argument
+type DeviceRegistration struct {
+	PublicKey      string `json:"pubKey"`
+	EncodingScheme int    `json:"code"`
+	Owner          string `json:"owner"`
+	// defaults to true
+	ValidationFlag *bool `json:"valid,omitempty"`
+}
+
+// Define the device registry entry structure, one device of exportDeviceRegistry
+type DeviceRegistryEntry struct {
+	DeviceId       string `json:"deviceId"`
+	PublicKey      string `json:"pubKey"`
+	EncodingScheme int    `json:"code"`
+	Owner          string `json:"owner"`
+	ValidationFlag bool   `json:"valid"`
+	Status         string `json:"status,omitempty"`
+	Algorithm      string `json:"alg"`
+}
+
+// returns the number of the device ID, e.g. 12 for DEVICE12
+func deviceNumber(deviceId string) int {
+	number, err := strconv.Atoi(strings.TrimPrefix(deviceId, "DEVICE"))
+	if err != nil {
+		return 0
+	}
+	return number
+}
+
+/*
+ * Expects a JSON array of device registrations, e.g.
+ * [{"pubKey":"pQBakw2oxXklWGruTdMVnbbNsNG+nsojdlusAiaRVLU","code":1,"owner":"org1"}]
+ * Keys are canonicalised like in registerDevice and all devices are validated before any is registered. Returns the assigned device IDs in the order of the array.
+ */
+func (s *SmartContract) registerDevicesBulk(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	registrations := []DeviceRegistration{}
+	if err := json.Unmarshal([]byte(args[0]), &registrations); err != nil {
+		return shim.Error("Invalid device list: " + err.Error())
+	}
+	if len(registrations) == 0 || len(registrations) > maxBulkDevices {
+		return shim.Error("Invalid number of devices. Expecting 1 to " + strconv.Itoa(maxBulkDevices))
+	}
+	keys := []string{}
+	for i, registration := range registrations {
+		if registration.Owner == "" {
+			return shim.Error("Missing owner of device " + strconv.Itoa(i))
+		}
+		keys = append(keys, registration.PublicKey)
+	}
+	deviceKeys, err := canonicalNewPublicKeys(APIstub, keys)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	next, err := nextDeviceNumber(APIstub, len(registrations))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	deviceIds := []string{}
+	for i, registration := range registrations {
+		deviceIdAsString := "DEVICE" + strconv.Itoa(next+i)
+		data := DeviceInfo{PublicKey: deviceKeys[i].PublicKey, SignatureAlgorithm: deviceKeys[i].SignatureAlgorithm, EncodingScheme: registration.EncodingScheme, Owner: registration.Owner, ValidationFlag: true, UpdatedBy: mspId}
+		if registration.ValidationFlag != nil {
+			data.ValidationFlag = *registration.ValidationFlag
+		}
+		dataAsBytes, _ := json.Marshal(data)
+		if err := APIstub.PutState(deviceIdAsString, dataAsBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := setDeviceEndorsementPolicy(APIstub, deviceIdAsString, ownerMSPID(data.Owner)); err != nil {
+			return shim.Error(err.Error())
+		}
+		deviceIds = append(deviceIds, deviceIdAsString)
+	}
+	deviceIdsAsBytes, _ := json.Marshal(deviceIds)
+	fmt.Printf("- registerDevicesBulk:\n%s\n", deviceIdsAsBytes)
+	return shim.Success(deviceIdsAsBytes)
+}
+
+// expects the format, csv or json, and returns all devices ordered by device ID
+func (s *SmartContract) exportDeviceRegistry(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if args[0] != "csv" && args[0] != "json" {
+		return shim.Error("Invalid format " + args[0] + ". Expecting csv or json")
+	}
+	resultsIterator, err := APIstub.GetStateByRange(deviceRangeStartKey, deviceRangeEndKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	entries := []DeviceRegistryEntry{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		device := DeviceInfo{}
+		if json.Unmarshal(queryResponse.Value, &device) != nil {
+			continue
+		}
+		entries = append(entries, DeviceRegistryEntry{DeviceId: queryResponse.Key, PublicKey: device.PublicKey, EncodingScheme: device.EncodingScheme, Owner: device.Owner, ValidationFlag: device.ValidationFlag, Status: device.Status, Algorithm: deviceSignatureAlgorithm(device)})
+	}
+	// keys are ordered lexicographically, DEVICE10 would come before DEVICE2
+	sort.SliceStable(entries, func(i, j int) bool {
+		return deviceNumber(entries[i].DeviceId) < deviceNumber(entries[j].DeviceId)
+	})
+
+	if args[0] == "json" {
+		entriesAsBytes, _ := json.Marshal(entries)
+		return shim.Success(entriesAsBytes)
+	}
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Write([]string{"deviceId", "pubKey", "code", "owner", "valid", "status", "alg"})
+	for _, entry := range entries {
+		writer.Write([]string{entry.DeviceId, entry.PublicKey, strconv.Itoa(entry.EncodingScheme), entry.Owner, strconv.FormatBool(entry.ValidationFlag), entry.Status, entry.Algorithm})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(buffer.Bytes())
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestRegisterDevicesBulkAndExport(t *testing.T) {
+	stub := newTestStub()
+	registrations := []DeviceRegistration{}
+	for i := 0; i < 11; i++ {
+		pub, _, _ := ed25519.GenerateKey(nil)
+		registrations = append(registrations, DeviceRegistration{PublicKey: base64.RawStdEncoding.EncodeToString(pub), EncodingScheme: 1, Owner: "org1"})
+	}
+	invalid := append([]DeviceRegistration{}, registrations...)
+	invalid[5].PublicKey = "pQBakw2oxXklWGruTdMVnbbNsNG"
+	invalidAsBytes, _ := json.Marshal(invalid)
+	response := stub.invoke("tx1", [][]byte{[]byte("registerDevicesBulk"), invalidAsBytes})
+	if !strings.HasPrefix(response.Message, "Invalid public key of device 5") {
+		t.Errorf("Expected the invalid key to be rejected, got: %s", response.Message)
+	}
+	if stub.State["DEVICE1"] != nil {
+		t.Errorf("Expected no device to be registered if one is invalid")
+	}
+
+	valid := false
+	registrations[10].ValidationFlag = &valid
+	registrationsAsBytes, _ := json.Marshal(registrations)
+	response = stub.invoke("tx2", [][]byte{[]byte("registerDevicesBulk"), registrationsAsBytes})
+	deviceIds := []string{}
+	json.Unmarshal(response.Payload, &deviceIds)
+	if len(deviceIds) != 11 || deviceIds[0] != "DEVICE1" || deviceIds[10] != "DEVICE11" {
+		t.Fatalf("Unexpected device IDs: %s %s", response.Message, string(response.Payload))
+	}
+
+	response = stub.invoke("q1", [][]byte{[]byte("exportDeviceRegistry"), []byte("json")})
+	entries := []DeviceRegistryEntry{}
+	json.Unmarshal(response.Payload, &entries)
+	if len(entries) != 11 || entries[1].DeviceId != "DEVICE2" || entries[10].DeviceId != "DEVICE11" || entries[10].ValidationFlag || !entries[0].ValidationFlag {
+		t.Errorf("Unexpected JSON export: %s", string(response.Payload))
+	}
+	if entries[0].PublicKey != registrations[0].PublicKey {
+		t.Errorf("Exported public key was incorrect, got: %s, want: %s", entries[0].PublicKey, registrations[0].PublicKey)
+	}
+
+	response = stub.invoke("q2", [][]byte{[]byte("exportDeviceRegistry"), []byte("csv")})
+	lines := strings.Split(strings.TrimSpace(string(response.Payload)), "\n")
+	if len(lines) != 12 || lines[0] != "deviceId,pubKey,code,owner,valid,status,alg" {
+		t.Fatalf("Unexpected CSV export: %s", string(response.Payload))
+	}
+	expected := "DEVICE11," + registrations[10].PublicKey + ",1,org1,false,,ed25519"
+	if lines[11] != expected {
+		t.Errorf("CSV row was incorrect, got: %s, want: %s", lines[11], expected)
+	}
+
+	response = stub.invoke("q3", [][]byte{[]byte("exportDeviceRegistry"), []byte("xml")})
+	if response.Message != "Invalid format xml. Expecting csv or json" {
+		t.Errorf("Expected an invalid format to be rejected, got: %s", response.Message)
+	}
+}
+
+func TestRegisterDevicesBulkRejectsDuplicates(t *testing.T) {
+	stub := newTestStub()
+	registerTestDevice(stub, 1, "org1")
+	pub, _, _ := ed25519.GenerateKey(nil)
+	key := base64.RawStdEncoding.EncodeToString(pub)
+
+	registrations := `[{"pubKey":"` + key + `","code":1,"owner":"org1"},{"pubKey":"` + key + `=","code":1,"owner":"org2"}]`
+	response := stub.invoke("tx1", [][]byte{[]byte("registerDevicesBulk"), []byte(registrations)})
+	if response.Message != "Public key of device 1 is already registered for device 0 of this list" {
+		t.Errorf("Expected a duplicate within the list to be rejected, got: %s", response.Message)
+	}
+
+	device := DeviceInfo{}
+	json.Unmarshal(stub.State["DEVICE1"], &device)
+	registrations = `[{"pubKey":"` + key + `","code":1,"owner":"org1"},{"pubKey":"` + device.PublicKey + `","code":1,"owner":"org2"}]`
+	response = stub.invoke("tx2", [][]byte{[]byte("registerDevicesBulk"), []byte(registrations)})
+	if response.Message != "Public key of device 1 is already registered for DEVICE1" {
+		t.Errorf("Expected a registered key to be rejected, got: %s", response.Message)
+	}
+}
+
+func TestRegisterDevicesBulkBeyondDEVICE9999(t *testing.T) {
+	stub := newTestStub()
+	registerTestDevice(stub, 1, "org1")
+	registerTestDevice(stub, 9999, "org1")
+	registrations := []DeviceRegistration{}
+	for i := 0; i < 2; i++ {
+		pub, _, _ := ed25519.GenerateKey(nil)
+		registrations = append(registrations, DeviceRegistration{PublicKey: base64.RawStdEncoding.EncodeToString(pub), EncodingScheme: 1, Owner: "org1"})
+	}
+	registrationsAsBytes, _ := json.Marshal(registrations)
+	existing := string(stub.State["DEVICE9999"])
+	response := stub.invoke("tx1", [][]byte{[]byte("registerDevicesBulk"), registrationsAsBytes})
+	if string(response.Payload) != `["DEVICE10000","DEVICE10001"]` || string(stub.State["DEVICE9999"]) != existing {
+		t.Errorf("Expected the numbering to continue after DEVICE9999, got: %s %s", response.Message, string(response.Payload))
+	}
+	response = stub.invoke("q1", [][]byte{[]byte("exportDeviceRegistry"), []byte("json")})
+	entries := []DeviceRegistryEntry{}
+	json.Unmarshal(response.Payload, &entries)
+	if len(entries) != 4 {
+		t.Errorf("Expected all 4 devices in the registry, got: %s", string(response.Payload))
+	}
+
+	registerTestDevice(stub, maxDeviceNumber, "org1")
+	pub, _, _ := ed25519.GenerateKey(nil)
+	registrationsAsBytes, _ = json.Marshal([]DeviceRegistration{{PublicKey: base64.RawStdEncoding.EncodeToString(pub), EncodingScheme: 1, Owner: "org1"}})
+	response = stub.invoke("tx2", [][]byte{[]byte("registerDevicesBulk"), registrationsAsBytes})
+	if !strings.HasPrefix(response.Message, "Device IDs are exhausted") {
+		t.Errorf("Expected device IDs beyond 65535 to be rejected, got: %s", response.Message)
+	}
+}
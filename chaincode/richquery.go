@@ -0,0 +1,345 @@
+package main
+
+/*
+ * CouchDB rich queries.
+ * Selectors are never taken from the client. Clients pass structured parameters, which are
+ * validated and marshalled into a Mango selector, so values always end up as JSON literals
+ * and cannot introduce operators of their own.
+ * The index definitions used here are shipped in META-INF/statedb/couchdb/indexes.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Define the measurement query structure, all fields are optional and combined with AND
+type MeasurementQuery struct {
+	DeviceIds []string `json:"deviceIds,omitempty"`
+	Owner     string   `json:"owner,omitempty"`
+	Quantity  string   `json:"quantity,omitempty"`
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+	From      string   `json:"from,omitempty"`
+	To        string   `json:"to,omitempty"`
+	// leaves out measurements invalidated by their owner, see annotations.go
+	ExcludeInvalidated bool `json:"excludeInvalidated,omitempty"`
+}
+
+// document type of measurement records, other documents like device locations or anomaly
+// records carry deviceId and tsdevice as well
+const measurementDocType = "measurement"
+
+// quantities which can be filtered by value, mapped to the index supporting the filter
+var queryableQuantities = map[string]string{
+	"pm10":     "indexMeasurementPm10Doc",
+	"pm25":     "indexMeasurementPm25Doc",
+	"temp":     "",
+	"humidity": "",
+}
+
+// builds the Mango query for the validated parameters
+// measurements without owner are attributed to their device, so legacyDeviceIds must contain
+// the devices whose measurements recorded before transfers existed belong to the requested owner
+func buildMeasurementSelector(query MeasurementQuery, deviceIds []string, legacyDeviceIds []string) (string, error) {
+	selector := map[string]interface{}{
+		"docType":       measurementDocType,
+		"tsdeviceEpoch": map[string]interface{}{"$exists": true},
+	}
+	index := "indexMeasurementDateDoc"
+
+	if deviceIds != nil {
+		selector["deviceId"] = map[string]interface{}{"$in": deviceIds}
+		index = "indexMeasurementDeviceDoc"
+	}
+
+	if query.Owner != "" {
+		if legacyDeviceIds == nil {
+			legacyDeviceIds = []string{}
+		}
+		selector["$or"] = []interface{}{
+			map[string]interface{}{"owner": query.Owner},
+			map[string]interface{}{
+				"owner":    map[string]interface{}{"$exists": false},
+				"deviceId": map[string]interface{}{"$in": legacyDeviceIds},
+			},
+		}
+	}
+
+	if query.Quantity != "" || query.Min != nil || query.Max != nil {
+		quantityIndex, ok := queryableQuantities[query.Quantity]
+		if !ok {
+			return "", fmt.Errorf("Invalid quantity %q. Expecting one of pm10, pm25, temp, humidity", query.Quantity)
+		}
+		if query.Min == nil && query.Max == nil {
+			return "", fmt.Errorf("A quantity filter needs min or max")
+		}
+		condition := map[string]interface{}{}
+		if query.Min != nil {
+			condition["$gte"] = *query.Min
+		}
+		if query.Max != nil {
+			condition["$lte"] = *query.Max
+		}
+		selector[query.Quantity] = condition
+		if quantityIndex != "" && deviceIds == nil {
+			index = quantityIndex
+		}
+	}
+
+	from, err := parseTimeArg(query.From)
+	if err != nil {
+		return "", err
+	}
+	to, err := parseTimeArg(query.To)
+	if err != nil {
+		return "", err
+	}
+	// tsdevice keeps the offset and the fraction of the device clock and does not compare in
+	// chronological order as a string, device timestamps have whole seconds
+	window := map[string]interface{}{"$exists": true}
+	if !from.IsZero() {
+		window["$gte"] = from.Add(time.Second - time.Nanosecond).Unix()
+	}
+	if !to.IsZero() {
+		window["$lte"] = to.Unix()
+	}
+	selector["tsdeviceEpoch"] = window
+
+	queryAsBytes, err := json.Marshal(map[string]interface{}{
+		"selector":  selector,
+		"use_index": []string{"_design/" + index},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(queryAsBytes), nil
+}
+
+// builds the Mango query selecting all devices of the owner
+func buildDeviceOwnerSelector(owner string) (string, error) {
+	queryAsBytes, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]interface{}{
+			"owner":  owner,
+			"pubKey": map[string]interface{}{"$exists": true},
+		},
+		"use_index": []string{"_design/indexDeviceOwnerDoc"},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(queryAsBytes), nil
+}
+
+// builds the Mango query selecting all devices which were registered by the owner and transferred since
+func buildDeviceOriginalOwnerSelector(owner string) (string, error) {
+	queryAsBytes, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]interface{}{
+			"originalOwner": owner,
+			"pubKey":        map[string]interface{}{"$exists": true},
+		},
+		"use_index": []string{"_design/indexDeviceOriginalOwnerDoc"},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(queryAsBytes), nil
+}
+
+// parses the query parameters, rejecting unknown fields
+func parseMeasurementQuery(str string) (MeasurementQuery, error) {
+	query := MeasurementQuery{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(str)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&query); err != nil {
+		return MeasurementQuery{}, fmt.Errorf("Invalid query parameters: %s", err)
+	}
+	return query, nil
+}
+
+// executes the rich query and returns the matching key/value pairs
+func getQueryResultRecords(APIstub shim.ChaincodeStubInterface, queryString string) ([]queryRecord, error) {
+	fmt.Printf("- getQueryResultRecords queryString:\n%s\n", queryString)
+	resultsIterator, err := APIstub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	records := []queryRecord{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, queryRecord{Key: queryResponse.Key, Record: queryResponse.Value})
+	}
+	return records, nil
+}
+
+// returns the IDs of all devices registered by the owner, whether they have been transferred or not
+func getLegacyDeviceIdsByOwner(APIstub shim.ChaincodeStubInterface, owner string) ([]string, error) {
+	queryString, err := buildDeviceOwnerSelector(owner)
+	if err != nil {
+		return nil, err
+	}
+	records, err := getQueryResultRecords(APIstub, queryString)
+	if err != nil {
+		return nil, err
+	}
+	deviceIds := []string{}
+	for _, record := range records {
+		device := DeviceInfo{}
+		json.Unmarshal(record.Record, &device)
+		// devices received by a transfer were registered by another owner
+		if device.OriginalOwner == "" {
+			deviceIds = append(deviceIds, record.Key)
+		}
+	}
+	queryString, err = buildDeviceOriginalOwnerSelector(owner)
+	if err != nil {
+		return nil, err
+	}
+	records, err = getQueryResultRecords(APIstub, queryString)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		deviceIds = append(deviceIds, record.Key)
+	}
+	return deviceIds, nil
+}
+
+// runs the measurement query and returns the records ordered by device timestamp
+func queryMeasurementRecords(APIstub shim.ChaincodeStubInterface, query MeasurementQuery) ([]queryRecord, error) {
+	var deviceIds []string
+	if len(query.DeviceIds) > 0 {
+		deviceIds = query.DeviceIds
+	}
+	// measurements carry the owner at the time they were taken, so devices transferred since
+	// stay attributed to their previous owner
+	var legacyDeviceIds []string
+	if query.Owner != "" {
+		ownerDeviceIds, err := getLegacyDeviceIdsByOwner(APIstub, query.Owner)
+		if err != nil {
+			return nil, err
+		}
+		legacyDeviceIds = ownerDeviceIds
+		if deviceIds != nil {
+			legacyDeviceIds = intersectStrings(ownerDeviceIds, deviceIds)
+		}
+	}
+
+	queryString, err := buildMeasurementSelector(query, deviceIds, legacyDeviceIds)
+	if err != nil {
+		return nil, err
+	}
+	records, err := getQueryResultRecords(APIstub, queryString)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamps := make(map[string]time.Time)
+	for _, record := range records {
+		data := SensorData{}
+		json.Unmarshal(record.Record, &data)
+		timestamps[record.Key] = data.TSdevice
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return timestamps[records[i].Key].Before(timestamps[records[j].Key])
+	})
+	if query.ExcludeInvalidated {
+		return filterInvalidated(APIstub, records)
+	}
+	return records, nil
+}
+
+// runs the measurement query and returns the records as JSON
+func runMeasurementQuery(APIstub shim.ChaincodeStubInterface, query MeasurementQuery) sc.Response {
+	records, err := queryMeasurementRecords(APIstub, query)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	buffer := recordsToJSON(records)
+	fmt.Printf("- queryMeasurements:\n%s\n", buffer)
+	return shim.Success(buffer)
+}
+
+func intersectStrings(a, b []string) []string {
+	set := make(map[string]bool)
+	for _, value := range b {
+		set[value] = true
+	}
+	result := []string{}
+	for _, value := range a {
+		if set[value] {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+/*
+ * Expects a JSON object with the MeasurementQuery fields, e.g.
+ * {"owner":"org1","quantity":"pm10","min":50,"from":"2019-07-01T00:00:00Z"}
+ */
+func (s *SmartContract) queryMeasurements(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	query, err := parseMeasurementQuery(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return runMeasurementQuery(APIstub, query)
+}
+
+// expects owner, from, to and optionally true to leave out invalidated measurements
+func (s *SmartContract) getMeasurementsByOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+	if args[0] == "" {
+		return shim.Error("Owner must not be empty")
+	}
+	excludeInvalidated, err := parseExcludeInvalidated(args, 3)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return runMeasurementQuery(APIstub, MeasurementQuery{Owner: args[0], From: args[1], To: args[2], ExcludeInvalidated: excludeInvalidated})
+}
+
+// expects quantity (pm10, pm25, temp, humidity), minimum value, from, to and optionally true to leave out invalidated measurements
+func (s *SmartContract) getMeasurementsAboveThreshold(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 4 && len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 or 5")
+	}
+	threshold, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return shim.Error("Invalid threshold " + args[1])
+	}
+	excludeInvalidated, err := parseExcludeInvalidated(args, 4)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return runMeasurementQuery(APIstub, MeasurementQuery{Quantity: args[0], Min: &threshold, From: args[2], To: args[3], ExcludeInvalidated: excludeInvalidated})
+}
+
+// expects from, to and optionally true to leave out invalidated measurements
+func (s *SmartContract) getMeasurementsByDate(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
+	}
+	excludeInvalidated, err := parseExcludeInvalidated(args, 2)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return runMeasurementQuery(APIstub, MeasurementQuery{From: args[0], To: args[1], ExcludeInvalidated: excludeInvalidated})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestMeasurementSelector(t *testing.T) {
+	threshold := 50.0
+	query := MeasurementQuery{Quantity: "pm10", Min: &threshold, From: "2019-07-01T02:00:00+02:00", To: "2019-07-31 23:59:59+00:00"}
+	queryString, err := buildMeasurementSelector(query, nil, nil)
+	if err != nil {
+		t.Fatalf("Building the selector failed: %s", err)
+	}
+	expected := `{"selector":{"docType":"measurement","pm10":{"$gte":50},"tsdeviceEpoch":{"$exists":true,"$gte":1561939200,"$lte":1564617599}},"use_index":["_design/indexMeasurementPm10Doc"]}`
+	if queryString != expected {
+		t.Errorf("Selector was incorrect, got: %s, want: %s", queryString, expected)
+	}
+
+	queryString, _ = buildMeasurementSelector(MeasurementQuery{}, []string{"DEVICE1", "DEVICE3"}, nil)
+	expected = `{"selector":{"deviceId":{"$in":["DEVICE1","DEVICE3"]},"docType":"measurement","tsdeviceEpoch":{"$exists":true}},"use_index":["_design/indexMeasurementDeviceDoc"]}`
+	if queryString != expected {
+		t.Errorf("Selector was incorrect, got: %s, want: %s", queryString, expected)
+	}
+
+	// device timestamps have whole seconds, a fractional lower bound starts at the next second
+	queryString, _ = buildMeasurementSelector(MeasurementQuery{From: "2019-07-01T02:00:00.5+02:00", To: "2019-07-01T00:00:10.5Z"}, nil, nil)
+	expected = `{"selector":{"docType":"measurement","tsdeviceEpoch":{"$exists":true,"$gte":1561939201,"$lte":1561939210}},"use_index":["_design/indexMeasurementDateDoc"]}`
+	if queryString != expected {
+		t.Errorf("Selector was incorrect, got: %s, want: %s", queryString, expected)
+	}
+}
+
+func TestMeasurementSelectorExcludesOtherDocuments(t *testing.T) {
+	stub := newTestStub()
+	priv := registerTestDevice(stub, 1, "org1")
+	ts := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	if response := stub.invoke("tx1", buildTestMeasurement(priv, 1, 1, 54, ts, "0490033624N", "00082531116E")); response.Status != shim.OK {
+		t.Fatalf("Registering the measurement failed: %s", response.Message)
+	}
+	anomalyKey, _ := stub.CreateCompositeKey(anomalyRecordKey, []string{"DEVICE1", "8017480121707248c4601288a1543101"})
+	anomalyAsBytes, _ := json.Marshal(AnomalyRecord{DeviceId: "DEVICE1", MeasurementId: "8017480121707248c4601288a1543101", TSdevice: ts})
+	stub.MockTransactionStart("setup")
+	stub.PutState(anomalyKey, anomalyAsBytes)
+	stub.MockTransactionEnd("setup")
+
+	queryString, _ := buildMeasurementSelector(MeasurementQuery{}, []string{"DEVICE1"}, nil)
+	query := struct {
+		Selector map[string]interface{} `json:"selector"`
+	}{}
+	json.Unmarshal([]byte(queryString), &query)
+
+	// device locations and anomaly records carry deviceId and tsdevice as well, only the document type tells them apart
+	lookalikes, matching := 0, []string{}
+	for key, value := range stub.State {
+		document := map[string]interface{}{}
+		if json.Unmarshal(value, &document) != nil || document["deviceId"] == nil || document["tsdevice"] == nil {
+			continue
+		}
+		if document["docType"] != query.Selector["docType"] {
+			lookalikes = lookalikes + 1
+			continue
+		}
+		matching = append(matching, key)
+	}
+	if lookalikes < 2 {
+		t.Errorf("Expected the device location and the anomaly record, got %d other documents", lookalikes)
+	}
+	if !reflect.DeepEqual(matching, []string{"8017480121707248c4601288a1543101"}) {
+		t.Errorf("Selector matched other documents than the measurement: %v", matching)
+	}
+}
+
+func TestMeasurementSelectorValidation(t *testing.T) {
+	threshold := 1.0
+	invalid := []MeasurementQuery{
+		{Quantity: "pm10"},
+		{Quantity: "$or", Min: &threshold},
+		{Quantity: "pubKey", Min: &threshold},
+		{Min: &threshold},
+		{From: "yesterday"},
+	}
+	for _, query := range invalid {
+		if _, err := buildMeasurementSelector(query, nil, nil); err == nil {
+			t.Errorf("Expected an error for query %+v", query)
+		}
+	}
+}
+
+func TestQueryParametersCannotInjectOperators(t *testing.T) {
+	if _, err := parseMeasurementQuery(`{"selector":{"owner":{"$ne":""}}}`); err == nil {
+		t.Errorf("Expected unknown fields to be rejected")
+	}
+	if _, err := parseMeasurementQuery(`{"owner":{"$ne":""}}`); err == nil {
+		t.Errorf("Expected an operator object as owner to be rejected")
+	}
+
+	queryString, _ := buildDeviceOwnerSelector(`org1"},"owner":{"$ne":"`)
+	query := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(queryString), &query); err != nil {
+		t.Fatalf("Selector is not valid JSON: %s", queryString)
+	}
+	expected := map[string]interface{}{
+		"owner":  `org1"},"owner":{"$ne":"`,
+		"pubKey": map[string]interface{}{"$exists": true},
+	}
+	if !reflect.DeepEqual(query["selector"], expected) {
+		t.Errorf("Owner was not treated as a literal value, got: %s", queryString)
+	}
+}
@@ -26,7 +26,6 @@ package main
 
 /* Imports
  * 5 utility libraries for formatting, handling bytes, reading and writing JSON, and string manipulation
- * 1 library for verifying eddsa signatures
  * 2 specific Hyperledger Fabric specific libraries for Smart Contracts
  */
 import (
@@ -35,39 +34,78 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
-	"golang.org/x/crypto/ed25519"
 )
 
 // Define the Smart Contract structure
 type SmartContract struct {
 }
 
-// Define the sensor data structure, with 8 properties.  Structure tags are used by encoding/json library
+// Define the sensor data structure.  Structure tags are used by encoding/json library
 type SensorData struct {
-	DeviceId   string    `json:"deviceId"`
-	Pm10       float32   `json:"pm10"`
-	Pm25       float32   `json:"pm25"`
-	Temp       float32   `json:"temp"`
-	Humidity   float32   `json:"humidity"`
-	TSdevice   time.Time `json:"tsdevice"`
-	TSgw	   time.Time `json:"tsgw"`
-	Longtitude string    `json:"longtitude"`
-	Latitude   string    `json:"latitude"`
-}
-
-// Define the devince info structure, with 4 properties.  Structure tags are used by encoding/json library
+	DocType       string            `json:"docType"`               // always measurementDocType, tells measurements apart in rich queries
+	DeviceId      string            `json:"deviceId"`
+	Pm10          float32           `json:"pm10"`
+	Pm25          float32           `json:"pm25"`
+	Temp          float32           `json:"temp"`
+	Humidity      float32           `json:"humidity"`
+	TSdevice      time.Time         `json:"tsdevice"`
+	TSdeviceEpoch int64             `json:"tsdeviceEpoch"`         // TSdevice in Unix seconds, compared numerically by rich queries
+	TSgw          time.Time         `json:"tsgw"`
+	Longtitude    string            `json:"longtitude"`
+	Latitude      string            `json:"latitude"`
+	Lon           float64           `json:"lon"`
+	Lat           float64           `json:"lat"`
+	Geohash       string            `json:"geohash"`
+	SubmittedBy   string            `json:"submittedBy,omitempty"`
+	Owner         string            `json:"owner,omitempty"`       // owner at the time of the measurement, unset before transfers existed
+	Channels      []Channel         `json:"channels,omitempty"`    // all values of channel frames, see channels.go
+	Anomaly       bool              `json:"anomaly,omitempty"`     // failed a check against the previous reading, see anomaly.go
+	Reference     bool              `json:"reference,omitempty"`   // measured by a reference station, see calibration.go
+	Calibrated    []CalibratedValue `json:"calibrated,omitempty"`  // calibrated values, the raw values remain in the fields above
+	Maintenance   string            `json:"maintenance,omitempty"` // maintenance event covering the measurement, see maintenance.go
+}
+
+// Frame lengths of the supported encoding schemes, without the detached signature
+const (
+	defaultFrameLength   = 56
+	alternateFrameLength = 54
+)
+
+// maximum amount of time a device clock may run ahead of the transaction timestamp
+const maxDeviceClockSkew = 5 * time.Minute
+
+// Key range of the device records, ':' is the character after '9', so the exclusive end key
+// includes every DEVICE<number>. Device IDs are 2 bytes in the frames.
+const (
+	deviceRangeStartKey = "DEVICE1"
+	deviceRangeEndKey   = "DEVICE:"
+	maxDeviceNumber     = 65535
+)
+
+// Define the devince info structure.  Structure tags are used by encoding/json library
 type DeviceInfo struct {
-	PublicKey      string `json:"pubKey"`
-	EncodingScheme int    `json:"code"`
-	Owner          string `json:"owner"`
-	ValidationFlag bool   `json:"valid"`
+	PublicKey          string `json:"pubKey"`
+	EncodingScheme     int    `json:"code"`
+	Owner              string `json:"owner"`
+	ValidationFlag     bool   `json:"valid"`
+	UpdatedBy          string `json:"updatedBy,omitempty"`
+	PrivateLocation    bool   `json:"privateLocation,omitempty"` // measurements only carry a coarse location, see private.go
+	OriginalOwner      string `json:"originalOwner,omitempty"`   // owner at registration, set once transferred, see transfer.go
+	Status             string `json:"status,omitempty"`          // provisioned until claimed, see provisioning.go
+	Manufacturer       string `json:"manufacturer,omitempty"`
+	ClaimCodeHash      string `json:"claimCodeHash,omitempty"`
+	SignatureAlgorithm string `json:"alg,omitempty"`   // ed25519 if empty, see keys.go
+	Model              string `json:"model,omitempty"` // sensor model selecting the anomaly limits, see anomaly.go
+	Class              string `json:"class,omitempty"` // reference stations calibrate low-cost sensors, see calibration.go
 }
 
 /*
@@ -94,7 +132,7 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 	} else if function == "registerMeasurement" {
 		return s.registerMeasurement(APIstub, args)
 	} else if function == "getMeasurementRecords" {
-		return s.getMeasurementRecords(APIstub)
+		return s.getMeasurementRecords(APIstub, args)
 	} else if function == "initLedger" {
 		return s.initLedger(APIstub)
 	} else if function == "getDeviceRecords" {
@@ -103,6 +141,110 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.getAllRecords(APIstub)
 	} else if function == "testTransaction" {
 		return s.testTransaction(APIstub, args)
+	} else if function == "migrateCoordinates" {
+		return s.migrateCoordinates(APIstub)
+	} else if function == "getMeasurementsInBoundingBox" {
+		return s.getMeasurementsInBoundingBox(APIstub, args)
+	} else if function == "getNearestDevices" {
+		return s.getNearestDevices(APIstub, args)
+	} else if function == "queryMeasurements" {
+		return s.queryMeasurements(APIstub, args)
+	} else if function == "getMeasurementsByOwner" {
+		return s.getMeasurementsByOwner(APIstub, args)
+	} else if function == "getMeasurementsAboveThreshold" {
+		return s.getMeasurementsAboveThreshold(APIstub, args)
+	} else if function == "getMeasurementsByDate" {
+		return s.getMeasurementsByDate(APIstub, args)
+	} else if function == "getDeviceHistory" {
+		return s.getDeviceHistory(APIstub, args)
+	} else if function == "getMeasurementHistory" {
+		return s.getMeasurementHistory(APIstub, args)
+	} else if function == "setDeviceOwnerDetails" {
+		return s.setDeviceOwnerDetails(APIstub, args)
+	} else if function == "getDeviceOwnerDetails" {
+		return s.getDeviceOwnerDetails(APIstub, args)
+	} else if function == "getPrivateMeasurementLocation" {
+		return s.getPrivateMeasurementLocation(APIstub, args)
+	} else if function == "registerConfidentialMeasurement" {
+		return s.registerConfidentialMeasurement(APIstub, args)
+	} else if function == "getConfidentialMeasurement" {
+		return s.getConfidentialMeasurement(APIstub, args)
+	} else if function == "setDeviceEndorsementPolicies" {
+		return s.setDeviceEndorsementPolicies(APIstub)
+	} else if function == "getDeviceEndorsementPolicy" {
+		return s.getDeviceEndorsementPolicy(APIstub, args)
+	} else if function == "proposeTransfer" {
+		return s.proposeTransfer(APIstub, args)
+	} else if function == "acceptTransfer" {
+		return s.acceptTransfer(APIstub, args)
+	} else if function == "cancelTransfer" {
+		return s.cancelTransfer(APIstub, args)
+	} else if function == "getTransferHistory" {
+		return s.getTransferHistory(APIstub, args)
+	} else if function == "provisionDevices" {
+		return s.provisionDevices(APIstub, args)
+	} else if function == "claimDevice" {
+		return s.claimDevice(APIstub, args)
+	} else if function == "registerDevicesBulk" {
+		return s.registerDevicesBulk(APIstub, args)
+	} else if function == "exportDeviceRegistry" {
+		return s.exportDeviceRegistry(APIstub, args)
+	} else if function == "getQuantityRegistry" {
+		return s.getQuantityRegistry(APIstub)
+	} else if function == "exportMeasurements" {
+		return s.exportMeasurements(APIstub, args)
+	} else if function == "getLatestReadings" {
+		return s.getLatestReadings(APIstub, args)
+	} else if function == "reportHeartbeat" {
+		return s.reportHeartbeat(APIstub, args)
+	} else if function == "getDeviceStatus" {
+		return s.getDeviceStatus(APIstub, args)
+	} else if function == "getInactiveDevices" {
+		return s.getInactiveDevices(APIstub, args)
+	} else if function == "setDeviceModel" {
+		return s.setDeviceModel(APIstub, args)
+	} else if function == "setAnomalyLimits" {
+		return s.setAnomalyLimits(APIstub, args)
+	} else if function == "getAnomalyLimits" {
+		return s.getAnomalyLimits(APIstub, args)
+	} else if function == "getAnomalies" {
+		return s.getAnomalies(APIstub, args)
+	} else if function == "setDeviceClass" {
+		return s.setDeviceClass(APIstub, args)
+	} else if function == "addCalibration" {
+		return s.addCalibration(APIstub, args)
+	} else if function == "deriveCalibration" {
+		return s.deriveCalibration(APIstub, args)
+	} else if function == "getCalibrations" {
+		return s.getCalibrations(APIstub, args)
+	} else if function == "getDailyMeans" {
+		return s.getDailyMeans(APIstub, args)
+	} else if function == "createComplianceReport" {
+		return s.createComplianceReport(APIstub, args)
+	} else if function == "getComplianceReports" {
+		return s.getComplianceReports(APIstub, args)
+	} else if function == "defineZone" {
+		return s.defineZone(APIstub, args)
+	} else if function == "getZone" {
+		return s.getZone(APIstub, args)
+	} else if function == "getDeviceZones" {
+		return s.getDeviceZones(APIstub, args)
+	} else if function == "getZoneAggregates" {
+		return s.getZoneAggregates(APIstub, args)
+	} else if function == "recordMaintenance" {
+		return s.recordMaintenance(APIstub, args)
+	} else if function == "getMaintenance" {
+		return s.getMaintenance(APIstub, args)
+	} else if function == "annotateMeasurement" {
+		return s.annotateMeasurement(APIstub, args)
+	} else if function == "openDispute" {
+		return s.openDispute(APIstub, args)
+	} else if function == "resolveDispute" {
+		return s.resolveDispute(APIstub, args)
+	} else if function == "getAnnotations" {
+		return s.getAnnotations(APIstub, args)
+	} else if function == "getOpenDisputes" {
+		return s.getOpenDisputes(APIstub, args)
 	}
 	return shim.Error("Invalid Smart Contract function name.")
 }
@@ -121,6 +263,7 @@ func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface) sc.Respo
 		deviceAsBytes, _ := json.Marshal(devices[i])
 		deviceIdAsString := "DEVICE" + strconv.Itoa(i+1)
 		APIstub.PutState(deviceIdAsString, deviceAsBytes)
+		setDeviceEndorsementPolicy(APIstub, deviceIdAsString, ownerMSPID(devices[i].Owner))
 		fmt.Println("Added", devices[i])
 		i = i + 1
 	}
@@ -132,56 +275,127 @@ func (s *SmartContract) testTransaction(APIstub shim.ChaincodeStubInterface, arg
 	
 	key := args[0]
 	timeObj := convertDateStringToTime("2019-07-27 13:59:39+02:00")
-	var testData = SensorData{DeviceId: "DEVICE1", Pm10: 1.0, Pm25: 2.0, Temp: 3.0, Humidity: 4.0, TSdevice: timeObj, TSgw: timeObj, Latitude: "000000", Longtitude: "000000"}
+	var testData = SensorData{DocType: measurementDocType, DeviceId: "DEVICE1", Pm10: 1.0, Pm25: 2.0, Temp: 3.0, Humidity: 4.0, TSdevice: timeObj, TSdeviceEpoch: timeObj.Unix(), TSgw: timeObj, Latitude: "0°00.00000'N", Longtitude: "0°00.00000'E", Lat: 0, Lon: 0}
 	testDataAsBytes, _ := json.Marshal(testData)
 	APIstub.PutState(key, testDataAsBytes)
 	return shim.Success(nil)
 }
 
+// returns the first of count unused consecutive device numbers, following the highest device ID in use
+// writes of the current transaction are not visible, so bulk registrations have to count on themselves
+func nextDeviceNumber(APIstub shim.ChaincodeStubInterface, count int) (int, error) {
+	resultsIterator, err := APIstub.GetStateByRange(deviceRangeStartKey, deviceRangeEndKey)
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+	highest := 0
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		if number, err := strconv.Atoi(strings.TrimPrefix(queryResponse.Key, "DEVICE")); err == nil && number > highest {
+			highest = number
+		}
+	}
+	if highest+count > maxDeviceNumber {
+		return 0, fmt.Errorf("Device IDs are exhausted. %d more devices would exceed DEVICE%d", count, maxDeviceNumber)
+	}
+	return highest + 1, nil
+}
+
 func (s *SmartContract) registerDevice(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 	if len(args) != 4 {
 		return shim.Error("Incorrect number of arguments. Expecting 4")
 	}
 
-	startKey := "DEVICE1"
-	endKey := "DEVICE9999"
-
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
-
+	key, err := canonicalPublicKey(args[0])
 	if err != nil {
-		return shim.Error(err.Error())
+		return shim.Error("Invalid public key: " + err.Error())
 	}
-	defer resultsIterator.Close()
-	i := 1
-	for resultsIterator.HasNext() {
-		resultsIterator.Next()
-		i = i + 1
+	scheme, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("Invalid encoding scheme " + args[1] + ". Expecting an integer")
 	}
 	vflag, err := strconv.ParseBool(args[3])
-	scheme, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("Invalid validation flag " + args[3] + ". Expecting true or false")
+	}
+	registered, err := registeredPublicKeys(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if deviceId, ok := registered[key.PublicKey]; ok {
+		return shim.Error("Public key is already registered for " + deviceId)
+	}
+	i, err := nextDeviceNumber(APIstub, 1)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	fmt.Printf("- registerDevice:\nDEVICE%s\n", strconv.Itoa(i))
 
-	var data = DeviceInfo{PublicKey: args[0], EncodingScheme: scheme, Owner: args[2], ValidationFlag: vflag}
-	dataAsBytes, _ := json.Marshal(data)
+	var data = DeviceInfo{PublicKey: key.PublicKey, SignatureAlgorithm: key.SignatureAlgorithm, EncodingScheme: scheme, Owner: args[2], ValidationFlag: vflag, UpdatedBy: mspId}
 	deviceIdAsString := "DEVICE" + strconv.Itoa(i)
+
+	// owner details are optional and only passed in the transient map
+	details, detailsAsBytes, err := getTransientOwnerDetails(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if details != nil {
+		data.PrivateLocation = true
+		if err := APIstub.PutPrivateData(privateCollectionName(ownerMSPID(data.Owner)), deviceIdAsString, detailsAsBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	dataAsBytes, _ := json.Marshal(data)
 	APIstub.PutState(deviceIdAsString, dataAsBytes)
+	// later modifications of the device require an endorsement of the owning organization
+	if err := setDeviceEndorsementPolicy(APIstub, deviceIdAsString, ownerMSPID(data.Owner)); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
+// expects deviceId, only the owner of the device may revoke it
 func (s *SmartContract) revokeDevice(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 	if len(args) != 1 {
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 	id := args[0]
 	fmt.Printf("- revokeDevice:\n%s\n", id)
-	deviceAsBytes, _ := APIstub.GetState(id)
-	device := DeviceInfo{}
-	json.Unmarshal(deviceAsBytes, &device)
+	device, err := getDevice(APIstub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// the endorsement policy of the device key cannot stop this, the owner's peers endorse
+	// every proposal the chaincode accepts
+	owner, err := isDeviceOwner(APIstub, device)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !owner {
+		return shim.Error("Only the owner of " + id + " may revoke it")
+	}
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	device.ValidationFlag = false
-	deviceAsBytes, _ = json.Marshal(device)
-	APIstub.PutState(id, deviceAsBytes)
+	device.UpdatedBy = mspId
+	deviceAsBytes, _ := json.Marshal(device)
+	if err := APIstub.PutState(id, deviceAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(nil)
 }
 
@@ -202,42 +416,253 @@ func (s *SmartContract) registerMeasurement(APIstub shim.ChaincodeStubInterface,
 	if err1 != nil {
 		return shim.Error("Decoding from base64 to bytes failed.")
 	}
-	// parse input string based on decoding scheme
 
-	if b[0] != 170 {
-		return shim.Error("Incorrect header format. Expecting start byte 10101010.")
+	data, txId, device, err := decodeMeasurement(APIstub, b, b2)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// the arguments end up in the block, which must not contain the precise location of private devices
+	if device.PrivateLocation {
+		return shim.Error(data.DeviceId + " has a private location. Its frames have to be passed to registerConfidentialMeasurement")
+	}
+	data.TSgw = convertDateStringToTime(args[2])
+	if err := storeMeasurement(APIstub, txId, data, device); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// checks that the UUID has neither been registered as measurement nor as confidential measurement
+func checkMeasurementUnregistered(APIstub shim.ChaincodeStubInterface, txId string) error {
+	existing, err := APIstub.GetState(txId)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		hashKey, err := APIstub.CreateCompositeKey(measurementHashKey, []string{txId})
+		if err != nil {
+			return err
+		}
+		if existing, err = APIstub.GetState(hashKey); err != nil {
+			return err
+		}
+	}
+	if existing != nil {
+		return errors.New("Measurement " + txId + " has already been registered")
+	}
+	return nil
+}
+
+/*
+ * Stores the decoded measurement under its UUID and updates the records derived from it.
+ * The derived records of the device are read and rewritten, so two measurements of one device
+ * in the same block conflict and the later one is invalidated with MVCC_READ_CONFLICT. This is
+ * by design: anomaly detection compares every reading with the previous one of the device, which
+ * makes ingestion sequential per device even if the other records were kept as per-transaction
+ * keys aggregated at query time. Gateways submit the frames of a device one after another and
+ * resubmit invalidated frames, which the UUID check below makes safe.
+ */
+func storeMeasurement(APIstub shim.ChaincodeStubInterface, txId string, data SensorData, device DeviceInfo) error {
+	// a replayed frame would be counted twice by the derived records
+	if err := checkMeasurementUnregistered(APIstub, txId); err != nil {
+		return err
+	}
+	if err := flagMaintenance(APIstub, &data); err != nil {
+		return err
+	}
+	if err := detectAnomalies(APIstub, txId, &data, device); err != nil {
+		return err
+	}
+	if err := calibrateMeasurement(APIstub, &data, device); err != nil {
+		return err
+	}
+	dataAsBytes, _ := json.Marshal(data)
+	if err := APIstub.PutState(txId, dataAsBytes); err != nil {
+		return err
+	}
+	// reads the previous location of the device, so it runs before the location is updated
+	if err := assignDeviceZones(APIstub, data); err != nil {
+		return err
+	}
+	if err := indexMeasurementLocation(APIstub, txId, data); err != nil {
+		return err
+	}
+	if err := updateLatestReading(APIstub, txId, data); err != nil {
+		return err
+	}
+	if err := updateDailyAggregate(APIstub, data); err != nil {
+		return err
+	}
+	return recordDeviceMeasurement(APIstub, data)
+}
+
+// parses the frame based on the encoding scheme of the device and verifies its signature
+// returns the decoded measurement, its UUID as hex string and the device
+func decodeMeasurement(APIstub shim.ChaincodeStubInterface, b, b2 []byte) (SensorData, string, DeviceInfo, error) {
+	var deviceId uint16
+	if isCOSESign1(b) {
+		// COSE messages carry the device in the key ID of the protected header
+		message, err := parseCOSESign1(b)
+		if err != nil {
+			return SensorData{}, "", DeviceInfo{}, errors.New("Invalid COSE_Sign1 message: " + err.Error())
+		}
+		deviceId, err = coseDeviceId(message)
+		if err != nil {
+			return SensorData{}, "", DeviceInfo{}, err
+		}
+	} else {
+		if len(b) < 3 || b[0] != 170 {
+			return SensorData{}, "", DeviceInfo{}, errors.New("Incorrect header format. Expecting start byte 10101010.")
+		}
+		deviceId = binary.BigEndian.Uint16(b[1:3])
 	}
 	// get decoding scheme from device Id and decode accordingly
-	deviceId := binary.BigEndian.Uint16(b[1:3])
 	deviceIdAsString := "DEVICE" + strconv.Itoa(int(deviceId))
 	deviceAsBytes, _ := APIstub.GetState(deviceIdAsString)
 	device := DeviceInfo{}
 	json.Unmarshal(deviceAsBytes, &device)
+	if device.Status == deviceProvisioned {
+		return SensorData{}, "", device, errors.New("Device has not been claimed yet. Transaction aborted. DeviceId was " + deviceIdAsString)
+	}
 	if device.ValidationFlag == false {
-		return shim.Error("Device has been revoked. Transaction aborted. DeviceId was "+deviceIdAsString)
-	} else {
+		return SensorData{}, "", device, errors.New("Device has been revoked. Transaction aborted. DeviceId was " + deviceIdAsString)
+	}
+	if _, _, err := decodePublicKey(device.PublicKey); err != nil {
+		return SensorData{}, "", device, errors.New("Invalid public key registered for " + deviceIdAsString + ": " + err.Error())
+	}
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return SensorData{}, "", device, err
+	}
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return SensorData{}, "", device, err
+	}
+	if isCOSESign1(b) != (device.EncodingScheme == coseEncodingScheme) {
+		return SensorData{}, "", device, errors.New("Frame does not match encoding scheme " + strconv.Itoa(device.EncodingScheme) + " of " + deviceIdAsString)
+	}
+	data := SensorData{}
+	txId := ""
+	enc := device.EncodingScheme
+	switch enc {
+	case 0:
+		data, txId = decodeMessageWithDefaultEncodingScheme(b, b2, device, deviceId, txTime)
+	case 1:
+		data, txId = decodeMessageWithAlternateEncodingScheme(b, b2, device, deviceId)
+	case coseEncodingScheme:
+		data, txId = decodeMessageWithCOSEEncodingScheme(b, device, deviceId)
+	case lppEncodingScheme:
+		data, txId = decodeMessageWithLPPEncodingScheme(b, device, deviceId, txTime)
+	case channelEncodingScheme:
+		data, txId = decodeMessageWithChannelEncodingScheme(b, b2, device, deviceId)
+	default:
+		data, txId = decodeMessageWithDefaultEncodingScheme(b, b2, device, deviceId, txTime)
+	}
+	if data.DeviceId == "" || txId == "" {
+		return SensorData{}, "", device, errors.New("Error occured while decoding the message. Either decoding from hex to bytes threw the error or the signature is not valid.")
+	}
+	data.DocType = measurementDocType
+	data.TSdeviceEpoch = data.TSdevice.Unix()
+	data.Geohash = encodeGeohash(data.Lat, data.Lon, geohashPrecision)
+	data.SubmittedBy = mspId
+	data.Owner = device.Owner
+	return data, txId, device, nil
+}
+
+/*
+ * Converts measurement records written with the legacy DMS-like coordinate strings
+ * (049°00'33624"N) into decimal degrees and the corrected display form and sets the document
+ * type and the numeric device timestamp of records written before they existed, so rich queries
+ * find them. Records without a geohash get one and are indexed, so bounding-box and
+ * nearest-device queries and the zone assignment cover them, see geo.go and zones.go.
+ * Records which have already been migrated are skipped, so the function can be re-run.
+ * Only admins may run it, it rewrites every measurement and conflicts with ongoing ingestion.
+ */
+func (s *SmartContract) migrateCoordinates(APIstub shim.ChaincodeStubInterface) sc.Response {
+	admin, err := isClientAdmin(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !admin {
+		return shim.Error("Only admins may migrate measurements")
+	}
+	resultsIterator, err := APIstub.GetStateByRange("", "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	migrated, skipped, failed := 0, 0, 0
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if strings.HasPrefix(queryResponse.Key, "DEVICE") {
+			continue
+		}
 		data := SensorData{}
-		txId := ""
-		enc := device.EncodingScheme
-		switch enc {
-		case 0:
-			data, txId = decodeMessageWithDefaultEncodingScheme(b, b2, device, deviceId)
-		case 1:
-			data, txId = decodeMessageWithAlternateEncodingScheme(b, b2, device, deviceId)
-		default:
-			data, txId = decodeMessageWithDefaultEncodingScheme(b, b2, device, deviceId)
+		if json.Unmarshal(queryResponse.Value, &data) != nil || data.DeviceId == "" {
+			continue
 		}
-		if (data == SensorData{} || txId == "") {
-			return shim.Error("Error occured while decoding the message. Either decoding from hex to bytes threw the error or the signature is not valid.")
+		// device locations and other documents carry deviceId as well, measurements written
+		// before the document type existed always carry the coordinate strings
+		if data.DocType != measurementDocType && data.Latitude == "" {
+			continue
+		}
+		legacyCoordinates := strings.Contains(data.Latitude, "\"") || strings.Contains(data.Longtitude, "\"")
+		if !legacyCoordinates && data.DocType == measurementDocType && data.Geohash != "" && data.TSdeviceEpoch == data.TSdevice.Unix() {
+			skipped = skipped + 1
+			continue
+		}
+		if legacyCoordinates {
+			lat, latitude, err := parseLatitudeFromCharBytes(legacyCoordinateToCharBytes(data.Latitude))
+			if err != nil {
+				fmt.Printf("- migrateCoordinates: %s: %s\n", queryResponse.Key, err)
+				failed = failed + 1
+				continue
+			}
+			lon, longtitude, err := parseLongtitudeFromCharBytes(legacyCoordinateToCharBytes(data.Longtitude))
+			if err != nil {
+				fmt.Printf("- migrateCoordinates: %s: %s\n", queryResponse.Key, err)
+				failed = failed + 1
+				continue
+			}
+			data.Lat, data.Latitude = lat, latitude
+			data.Lon, data.Longtitude = lon, longtitude
+		}
+		data.DocType = measurementDocType
+		data.TSdeviceEpoch = data.TSdevice.Unix()
+		indexed := data.Geohash == ""
+		if indexed {
+			data.Geohash = encodeGeohash(data.Lat, data.Lon, geohashPrecision)
 		}
-		data.TSgw = convertDateStringToTime(args[2])
 		dataAsBytes, _ := json.Marshal(data)
-		APIstub.PutState(txId, dataAsBytes)
+		if err := APIstub.PutState(queryResponse.Key, dataAsBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+		if indexed {
+			// the location of devices which have become private since is only indexed coarsely
+			location := data
+			if device, err := getDevice(APIstub, data.DeviceId); err == nil && device.PrivateLocation {
+				location, _ = splitPrivateLocation(data)
+			}
+			if err := assignDeviceZones(APIstub, location); err != nil {
+				return shim.Error(err.Error())
+			}
+			if err := indexMeasurementLocation(APIstub, queryResponse.Key, location); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		migrated = migrated + 1
 	}
-	return shim.Success(nil)
+
+	result := fmt.Sprintf("{\"migrated\":%d,\"skipped\":%d,\"failed\":%d}", migrated, skipped, failed)
+	fmt.Printf("- migrateCoordinates:\n%s\n", result)
+	return shim.Success([]byte(result))
 }
 
-func decodeMessageWithDefaultEncodingScheme(b, b2 []byte, device DeviceInfo, deviceId uint16) (SensorData, string) {
+func decodeMessageWithDefaultEncodingScheme(b, b2 []byte, device DeviceInfo, deviceId uint16, txTime time.Time) (SensorData, string) {
 	/* Default Encoding: (Byte Array starts counting at posistion 0)
 	** Byte 1:		Header: 10101010
 	** Byte 2-3:	Device Id: (1-65535)
@@ -251,18 +676,22 @@ func decodeMessageWithDefaultEncodingScheme(b, b2 []byte, device DeviceInfo, dev
 	** Byte 26:		LowByte Temp
 	** Byte 27:		HighByte Temp
 	** Byte 28-33:	Timestamp hh:mm:ss
-	** Byte 34-44:	Latitude
-	** Byte 45-56:  Longtitude
+	** Byte 34-44:	Latitude DDDMMmmmmmH (degrees, minutes, decimal places of minutes, N or S)
+	** Byte 45-56:  Longtitude DDDDMMmmmmmH (degrees, minutes, decimal places of minutes, E or W)
 	** Byte 57-120:	Signature
 	 */
-	pubKeyFromDevice, err := base64.RawStdEncoding.DecodeString(device.PublicKey)
-	if err != nil {
-		return SensorData{}, "encoding failure..."
+	if len(b) < defaultFrameLength {
+		return SensorData{}, ""
 	}
-	verification := ed25519.Verify(pubKeyFromDevice, b, b2)
+	verification := verifyDeviceSignature(device, b, b2)
 	if !verification {
 		return SensorData{}, ""
 	}
+	// the frame only carries the time of day, the date is reconstructed from the transaction timestamp
+	timestampDevice, err := convertTimestampToDate(b[27:33], txTime)
+	if err != nil {
+		return SensorData{}, ""
+	}
 	uuid := []byte(b[3:19])
 	txId := hex.EncodeToString(uuid)
 	deviceIdStr := "DEVICE" + strconv.Itoa(int(deviceId))
@@ -270,16 +699,60 @@ func decodeMessageWithDefaultEncodingScheme(b, b2 []byte, device DeviceInfo, dev
 	pm25 := calculatePMValueFromBytes(b[21], b[22])
 	humidity := calculateHumidityFromBytes(b[23], b[24])
 	temp := calculateTempFromBytes(b[25], b[26])
-	timestampDevice := convertTimestampToDate(b[27:33], time.Now().UTC())
-	latitude := calculateLatitudeFromCharBytes(b[33:44])
-	longtitude := calculateLongtitudeFromCharBytes(b[44:56])
-	var data = SensorData{DeviceId: deviceIdStr, TSdevice: timestampDevice, Pm10: pm10, Pm25: pm25, Humidity: humidity, Temp: temp, Latitude: latitude, Longtitude: longtitude}
+	lat, latitude, err := parseLatitudeFromCharBytes(b[33:44])
+	if err != nil {
+		return SensorData{}, ""
+	}
+	lon, longtitude, err := parseLongtitudeFromCharBytes(b[44:56])
+	if err != nil {
+		return SensorData{}, ""
+	}
+	var data = SensorData{DeviceId: deviceIdStr, TSdevice: timestampDevice, Pm10: pm10, Pm25: pm25, Humidity: humidity, Temp: temp, Latitude: latitude, Longtitude: longtitude, Lat: lat, Lon: lon}
 	return data, txId
 }
 
 func decodeMessageWithAlternateEncodingScheme(b, b2 []byte, device DeviceInfo, deviceId uint16) (SensorData, string) {
-	//todo
-	return SensorData{}, ""
+	/* Alternate Encoding: same as the default encoding, but with a full timestamp
+	** Byte 1:		Header: 10101010
+	** Byte 2-3:	Device Id: (1-65535)
+	** Byte 4-19:	UUID of the transaction
+	** Byte 20:		LowByte Pm10
+	** Byte 21:		HighByte Pm10
+	** Byte 22:		LowByte Pm25
+	** Byte 23:		HighByte Pm25
+	** Byte 24:		LowByte Humidity
+	** Byte 25:		HighByte Humidity
+	** Byte 26:		LowByte Temp
+	** Byte 27:		HighByte Temp
+	** Byte 28-31:	Timestamp in seconds since 1970-01-01 00:00:00 UTC (big endian)
+	** Byte 32-42:	Latitude DDDMMmmmmmH
+	** Byte 43-54:  Longtitude DDDDMMmmmmmH
+	 */
+	if len(b) < alternateFrameLength {
+		return SensorData{}, ""
+	}
+	verification := verifyDeviceSignature(device, b, b2)
+	if !verification {
+		return SensorData{}, ""
+	}
+	uuid := []byte(b[3:19])
+	txId := hex.EncodeToString(uuid)
+	deviceIdStr := "DEVICE" + strconv.Itoa(int(deviceId))
+	pm10 := calculatePMValueFromBytes(b[19], b[20])
+	pm25 := calculatePMValueFromBytes(b[21], b[22])
+	humidity := calculateHumidityFromBytes(b[23], b[24])
+	temp := calculateTempFromBytes(b[25], b[26])
+	timestampDevice := convertEpochToDate(b[27:31])
+	lat, latitude, err := parseLatitudeFromCharBytes(b[31:42])
+	if err != nil {
+		return SensorData{}, ""
+	}
+	lon, longtitude, err := parseLongtitudeFromCharBytes(b[42:54])
+	if err != nil {
+		return SensorData{}, ""
+	}
+	var data = SensorData{DeviceId: deviceIdStr, TSdevice: timestampDevice, Pm10: pm10, Pm25: pm25, Humidity: humidity, Temp: temp, Latitude: latitude, Longtitude: longtitude, Lat: lat, Lon: lon}
+	return data, txId
 }
 
 func (s *SmartContract) getAllRecords(APIstub shim.ChaincodeStubInterface) sc.Response {
@@ -322,7 +795,15 @@ func (s *SmartContract) getAllRecords(APIstub shim.ChaincodeStubInterface) sc.Re
 	return shim.Success(buffer.Bytes())
 }
 
-func (s *SmartContract) getMeasurementRecords(APIstub shim.ChaincodeStubInterface) sc.Response {
+// expects optionally true to leave out invalidated measurements
+func (s *SmartContract) getMeasurementRecords(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting at most 1")
+	}
+	excludeInvalidated, err := parseExcludeInvalidated(args, 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	resultsIterator, err := APIstub.GetStateByRange("", "")
 	if err != nil {
@@ -341,6 +822,17 @@ func (s *SmartContract) getMeasurementRecords(APIstub shim.ChaincodeStubInterfac
 		if err != nil {
 			return shim.Error(err.Error())
 		}
+		// only measurements can be invalidated, their keys are never composite
+		data := SensorData{}
+		if excludeInvalidated && json.Unmarshal(queryResponse.Value, &data) == nil && data.DocType == measurementDocType {
+			invalidated, err := isInvalidated(APIstub, queryResponse.Key)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if invalidated {
+				continue
+			}
+		}
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
 			buffer.WriteString(",")
@@ -372,10 +864,7 @@ func (s *SmartContract) getMeasurementRecords(APIstub shim.ChaincodeStubInterfac
 
 func (s *SmartContract) getDeviceRecords(APIstub shim.ChaincodeStubInterface) sc.Response {
 
-	startKey := "DEVICE1"
-	endKey := "DEVICE999"
-
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+	resultsIterator, err := APIstub.GetStateByRange(deviceRangeStartKey, deviceRangeEndKey)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -450,40 +939,128 @@ func calculateHumidityFromBytes(b1, b2 byte) float32 {
 	return h
 }
 
-func calculateLatitudeFromCharBytes(b []byte) string {
-	degree := string(b[:3])
-	hours := string(b[3:5])
-	seconds := string(b[5:10])
-	orientation := string(b[10])
+// expects 11 byte input DDDMMmmmmmH, e.g. 0490033624N for 49°00.33624'N
+// returns the latitude in decimal degrees (negative for S) and its display form
+func parseLatitudeFromCharBytes(b []byte) (float64, string, error) {
+	if len(b) != 11 {
+		return 0, "", fmt.Errorf("Incorrect latitude length. Expecting 11 bytes, got %d", len(b))
+	}
+	return parseCoordinate(b, 3, 90, 'N', 'S')
+}
 
-	var str strings.Builder
-	str.WriteString(degree)
-	str.WriteString("°")
-	str.WriteString(hours)
-	str.WriteString("'")
-	str.WriteString(seconds)
-	str.WriteString("\"")
-	str.WriteString(orientation)
+// expects 12 byte input DDDDMMmmmmmH, e.g. 00082531116E for 8°25.31116'E
+// returns the longtitude in decimal degrees (negative for W) and its display form
+func parseLongtitudeFromCharBytes(b []byte) (float64, string, error) {
+	if len(b) != 12 {
+		return 0, "", fmt.Errorf("Incorrect longtitude length. Expecting 12 bytes, got %d", len(b))
+	}
+	return parseCoordinate(b, 4, 180, 'E', 'W')
+}
 
-	return str.String()
+// parses degrees, two digits of minutes, five decimal places of minutes and the hemisphere
+func parseCoordinate(b []byte, degreeDigits int, maxDegrees int, positive, negative byte) (float64, string, error) {
+	for _, c := range b[:len(b)-1] {
+		if c < '0' || c > '9' {
+			return 0, "", fmt.Errorf("Invalid character %q in coordinate", c)
+		}
+	}
+	hemisphere := b[len(b)-1]
+	if hemisphere != positive && hemisphere != negative {
+		return 0, "", fmt.Errorf("Invalid hemisphere %q. Expecting %c or %c", hemisphere, positive, negative)
+	}
+	degrees, _ := strconv.Atoi(string(b[:degreeDigits]))
+	wholeMinutes := string(b[degreeDigits : degreeDigits+2])
+	decimalMinutes := string(b[degreeDigits+2 : len(b)-1])
+	minutes, _ := strconv.ParseFloat(wholeMinutes+"."+decimalMinutes, 64)
+	if minutes >= 60 {
+		return 0, "", fmt.Errorf("Coordinate minutes %g out of range. Expecting less than 60", minutes)
+	}
+	value := float64(degrees) + minutes/60
+	if value > float64(maxDegrees) {
+		return 0, "", fmt.Errorf("Coordinate %g out of range. Expecting at most %d degrees", value, maxDegrees)
+	}
+	// seven decimal places are about a centimeter, which is more than the frame resolution
+	value = math.Round(value*1e7) / 1e7
+	if hemisphere == negative {
+		value = -value
+	}
+	display := fmt.Sprintf("%d°%s.%s'%c", degrees, wholeMinutes, decimalMinutes, hemisphere)
+	return value, display, nil
+}
+
+// formats decimal degrees in the display form of the frames, e.g. 49°00.33624'N
+func formatCoordinate(value float64, positive, negative byte) string {
+	hemisphere := positive
+	if value < 0 {
+		hemisphere = negative
+	}
+	// five decimal places of minutes, like the frames
+	units := int64(math.Round(math.Abs(value) * 60 * 1e5))
+	degrees := units / (60 * 1e5)
+	units = units % (60 * 1e5)
+	return fmt.Sprintf("%d°%02d.%05d'%c", degrees, units/1e5, units%1e5, hemisphere)
+}
+
+// converts the legacy display form 049°00'33624"N back into the frame representation
+func legacyCoordinateToCharBytes(str string) []byte {
+	replacer := strings.NewReplacer("°", "", "'", "", "\"", "")
+	return []byte(replacer.Replace(str))
+}
+
+// Define the query record structure, a key and its JSON value as returned by the range queries
+type queryRecord struct {
+	Key    string
+	Record []byte
 }
 
-func calculateLongtitudeFromCharBytes(b []byte) string {
-	degree := string(b[:4])
-	hours := string(b[4:6])
-	seconds := string(b[6:11])
-	orientation := string(b[11])
+// writes the records as JSON array of {"Key":..., "Record":...} objects
+func recordsToJSON(records []queryRecord) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for i, record := range records {
+		// Add a comma before array members, suppress it for the first array member
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(record.Key)
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"Record\":")
+		// Record is a JSON object, so we write as-is
+		buffer.Write(record.Record)
+		buffer.WriteString("}")
+	}
+	buffer.WriteString("]")
+	return buffer.Bytes()
+}
 
-	var str strings.Builder
-	str.WriteString(degree)
-	str.WriteString("°")
-	str.WriteString(hours)
-	str.WriteString("'")
-	str.WriteString(seconds)
-	str.WriteString("\"")
-	str.WriteString(orientation)
+// parses a timestamp argument in RFC 3339 or in the gateway format 2006-01-02 15:04:05-07:00
+// an empty string yields the zero time, which means no limit
+func parseTimeArg(str string) (time.Time, error) {
+	if str == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02 15:04:05-07:00", str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid timestamp %s. Expecting RFC 3339 format", str)
+	}
+	return t, nil
+}
 
-	return str.String()
+// checks from <= t <= to, zero bounds are treated as open
+func isWithinTimeWindow(t, from, to time.Time) bool {
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	if !to.IsZero() && t.After(to) {
+		return false
+	}
+	return true
 }
 
 func convertDateStringToTime(str string) time.Time {
@@ -492,36 +1069,72 @@ func convertDateStringToTime(str string) time.Time {
 	return t.Local()
 }
 
-// expects 6 byte input + current_time := time.Now().UTC()
-func convertTimestampToDate(b []byte, current_time time.Time) time.Time {
-	hh := string(b[:2])
-	mm := string(b[2:4])
-	ss := string(b[4:6])
+// expects 6 byte input hhmmss (UTC) + the reference time, usually the transaction timestamp
+// The frame carries no date, so the candidates on the day before, on and after the reference
+// date are considered. The latest candidate which is not more than maxDeviceClockSkew ahead of
+// the reference time is picked, i.e. the closest plausible instant for a reading which was
+// buffered on the device for less than 24 hours.
+func convertTimestampToDate(b []byte, reference time.Time) (time.Time, error) {
+	if len(b) != 6 {
+		return time.Time{}, fmt.Errorf("Incorrect timestamp length. Expecting 6 bytes, got %d", len(b))
+	}
+	hours, err := parseDigits(b[:2], 23)
+	if err != nil {
+		return time.Time{}, err
+	}
+	minutes, err := parseDigits(b[2:4], 59)
+	if err != nil {
+		return time.Time{}, err
+	}
+	seconds, err := parseDigits(b[4:6], 59)
+	if err != nil {
+		return time.Time{}, err
+	}
 
-	hours, err := strconv.Atoi(hh)
-	minutes, err := strconv.Atoi(mm)
-	seconds, err := strconv.Atoi(ss)
+	reference = reference.UTC()
+	latest := reference.Add(maxDeviceClockSkew)
+	var result time.Time
+	for offset := -1; offset <= 1; offset++ {
+		day := reference.AddDate(0, 0, offset)
+		candidate := time.Date(day.Year(), day.Month(), day.Day(), hours, minutes, seconds, 0, time.UTC)
+		if candidate.After(latest) {
+			continue
+		}
+		if candidate.After(result) {
+			result = candidate
+		}
+	}
+	return result, nil
+}
 
-	timeNow := current_time.Format("15:04:05")
-	dateNow := current_time.Format("2006-01-02")
+// expects 4 byte input: seconds since 1970-01-01 00:00:00 UTC as big endian unsigned integer
+func convertEpochToDate(b []byte) time.Time {
+	seconds := binary.BigEndian.Uint32(b)
+	return time.Unix(int64(seconds), 0).UTC()
+}
 
-	//get date --- assuming that latency is < 1h
-	if hh == "23" {
-		if timeNow[:2] != hh {
-			newDate := current_time.AddDate(0, 0, -1)
-			dateNow = newDate.Format("2006-01-02")
+// parses ASCII decimal digits and checks the result against the given maximum
+func parseDigits(b []byte, max int) (int, error) {
+	value := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("Invalid character %q in timestamp", c)
 		}
+		value = value*10 + int(c-'0')
 	}
+	if value > max {
+		return 0, fmt.Errorf("Timestamp field %d out of range. Expecting at most %d", value, max)
+	}
+	return value, nil
+}
 
-	year, err := strconv.Atoi(string(dateNow[:4]))
-	month, err := strconv.Atoi(string(dateNow[5:7]))
-	day, err := strconv.Atoi(string(dateNow[8:10]))
-
+// returns the transaction timestamp, which is identical on all endorsing peers
+func getTxTime(APIstub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := APIstub.GetTxTimestamp()
 	if err != nil {
-		fmt.Println("Something went wrong when converting time to Date.")
+		return time.Time{}, err
 	}
-
-	return time.Date(year, time.Month(month), day, hours, minutes, seconds, 0, time.Local)
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
 }
 
 // The main function is only relevant in unit test mode. Only included here for completeness.
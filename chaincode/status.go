@@ -0,0 +1,283 @@
+package main
+
+/*
+ * Liveness of devices.
+ * Every measurement and heartbeat updates the status record of the device with the last-seen
+ * time and a rolling count of messages in hourly buckets over the last 24 hours. The status
+ * is kept apart from the device key, whose key-level endorsement policy would otherwise require
+ * the owner to endorse every measurement. Messages of one device have to be submitted one after
+ * another, see storeMeasurement.
+ *
+ * Devices may send status frames through reportHeartbeat, signed like measurements:
+ *	Byte 1:		Header: 10101011
+ *	Byte 2-3:	Device Id: (1-65535)
+ *	Byte 4-7:	Timestamp in seconds since 1970-01-01 00:00:00 UTC (big endian)
+ *	Byte 8-9:	Battery voltage in mV (big endian)
+ *	Byte 10:	RSSI in dBm (signed)
+ *	Byte 11:	Length n of the firmware version
+ *	Byte 12-n:	Firmware version (ASCII)
+ */
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const deviceStatusKey = "status~deviceId"
+
+const (
+	heartbeatHeader      = 171
+	heartbeatFrameLength = 11
+	// period of the rolling message count
+	messageCountWindow = 24 * time.Hour
+)
+
+// Define the message bucket structure, the number of messages within an hour
+type MessageBucket struct {
+	Hour  time.Time `json:"hour"`
+	Count int       `json:"count"`
+}
+
+// Define the device status structure, when a device was last seen and what it reported
+type DeviceStatus struct {
+	DeviceId        string          `json:"deviceId"`
+	LastSeen        time.Time       `json:"lastSeen"`
+	LastMeasurement time.Time       `json:"lastMeasurement"`
+	MessageCount    int             `json:"messageCount"`
+	RecentMessages  []MessageBucket `json:"recentMessages"`
+	// messages within the last 24 hours, as of the last update or query
+	MessagesLast24h int       `json:"messagesLast24h"`
+	LastHeartbeat   time.Time `json:"lastHeartbeat"`
+	BatteryVoltage  float64   `json:"batteryVoltage,omitempty"`
+	RSSI            int       `json:"rssi,omitempty"`
+	Firmware        string    `json:"firmware,omitempty"`
+}
+
+// Define the inactive device structure, a device which has not been seen recently
+type InactiveDevice struct {
+	DeviceStatus
+	Owner string `json:"owner"`
+}
+
+// returns the status of the device, an empty status if it has never been seen
+func getDeviceStatus(APIstub shim.ChaincodeStubInterface, deviceId string) (DeviceStatus, string, error) {
+	statusKey, err := APIstub.CreateCompositeKey(deviceStatusKey, []string{deviceId})
+	if err != nil {
+		return DeviceStatus{}, "", err
+	}
+	statusAsBytes, err := APIstub.GetState(statusKey)
+	if err != nil {
+		return DeviceStatus{}, "", err
+	}
+	status := DeviceStatus{DeviceId: deviceId, RecentMessages: []MessageBucket{}}
+	if statusAsBytes != nil {
+		if err := json.Unmarshal(statusAsBytes, &status); err != nil {
+			return DeviceStatus{}, "", err
+		}
+	}
+	return status, statusKey, nil
+}
+
+// drops the buckets older than the rolling window and recounts the recent messages
+func (status *DeviceStatus) pruneMessages(now time.Time) {
+	recent := []MessageBucket{}
+	count := 0
+	for _, bucket := range status.RecentMessages {
+		if bucket.Hour.After(now.Add(-messageCountWindow)) {
+			recent = append(recent, bucket)
+			count = count + bucket.Count
+		}
+	}
+	status.RecentMessages = recent
+	status.MessagesLast24h = count
+}
+
+// counts a message received at the given time
+func (status *DeviceStatus) countMessage(now time.Time) {
+	hour := now.Truncate(time.Hour)
+	if n := len(status.RecentMessages); n > 0 && status.RecentMessages[n-1].Hour.Equal(hour) {
+		status.RecentMessages[n-1].Count++
+	} else {
+		status.RecentMessages = append(status.RecentMessages, MessageBucket{Hour: hour, Count: 1})
+	}
+	status.MessageCount++
+	status.pruneMessages(now)
+}
+
+// records a measurement of the device at the transaction time
+func recordDeviceMeasurement(APIstub shim.ChaincodeStubInterface, data SensorData) error {
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return err
+	}
+	status, statusKey, err := getDeviceStatus(APIstub, data.DeviceId)
+	if err != nil {
+		return err
+	}
+	status.LastSeen = txTime
+	if data.TSdevice.After(status.LastMeasurement) {
+		status.LastMeasurement = data.TSdevice
+	}
+	status.countMessage(txTime)
+	statusAsBytes, _ := json.Marshal(status)
+	return APIstub.PutState(statusKey, statusAsBytes)
+}
+
+// parses a status frame, the signature is verified by the caller
+func parseHeartbeat(b []byte) (uint16, time.Time, float64, int, string, error) {
+	if len(b) < heartbeatFrameLength || b[0] != heartbeatHeader {
+		return 0, time.Time{}, 0, 0, "", errors.New("Incorrect header format. Expecting start byte 10101011.")
+	}
+	if len(b) != heartbeatFrameLength+int(b[10]) {
+		return 0, time.Time{}, 0, 0, "", fmt.Errorf("Incorrect frame length. Expecting %d bytes", heartbeatFrameLength+int(b[10]))
+	}
+	firmware := b[heartbeatFrameLength:]
+	for _, c := range firmware {
+		if c < 0x20 || c > 0x7e {
+			return 0, time.Time{}, 0, 0, "", fmt.Errorf("Invalid character %q in firmware version", c)
+		}
+	}
+	deviceId := binary.BigEndian.Uint16(b[1:3])
+	voltage := float64(binary.BigEndian.Uint16(b[7:9])) / 1000
+	return deviceId, convertEpochToDate(b[3:7]), voltage, int(int8(b[9])), string(firmware), nil
+}
+
+// expects the status frame and the signature as base64 strings
+func (s *SmartContract) reportHeartbeat(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	b, err := base64.StdEncoding.DecodeString(args[0])
+	if err != nil {
+		return shim.Error("Decoding from base64 to bytes failed.")
+	}
+	b2, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return shim.Error("Decoding from base64 to bytes failed.")
+	}
+	number, timestamp, voltage, rssi, firmware, err := parseHeartbeat(b)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	deviceId := "DEVICE" + strconv.Itoa(int(number))
+	deviceAsBytes, err := APIstub.GetState(deviceId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if deviceAsBytes == nil {
+		return shim.Error("Device " + deviceId + " does not exist")
+	}
+	device := DeviceInfo{}
+	json.Unmarshal(deviceAsBytes, &device)
+	if !device.ValidationFlag || device.Status == deviceProvisioned {
+		return shim.Error("Device " + deviceId + " is not active")
+	}
+	if !verifyDeviceSignature(device, b, b2) {
+		return shim.Error("Signature of the heartbeat of " + deviceId + " is not valid")
+	}
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	status, statusKey, err := getDeviceStatus(APIstub, deviceId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// older or repeated frames could otherwise be replayed to fake a live device
+	if !timestamp.After(status.LastHeartbeat) || timestamp.After(txTime.Add(maxDeviceClockSkew)) {
+		return shim.Error("Heartbeat timestamp " + timestamp.Format(time.RFC3339) + " is not newer than the last heartbeat or lies in the future")
+	}
+	status.LastSeen = txTime
+	status.LastHeartbeat = timestamp
+	status.BatteryVoltage = voltage
+	status.RSSI = rssi
+	status.Firmware = firmware
+	status.countMessage(txTime)
+	statusAsBytes, _ := json.Marshal(status)
+	if err := APIstub.PutState(statusKey, statusAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- reportHeartbeat:\n%s\n", statusAsBytes)
+	return shim.Success(nil)
+}
+
+// expects deviceId, returns its status
+func (s *SmartContract) getDeviceStatus(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	status, _, err := getDeviceStatus(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	status.pruneMessages(txTime)
+	statusAsBytes, _ := json.Marshal(status)
+	return shim.Success(statusAsBytes)
+}
+
+/*
+ * Expects a duration like 72h or 30m and returns the active devices which have not been
+ * seen within that duration before the transaction time, including devices never seen.
+ */
+func (s *SmartContract) getInactiveDevices(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	duration, err := time.ParseDuration(args[0])
+	if err != nil || duration <= 0 {
+		return shim.Error("Invalid duration " + args[0] + ". Expecting a positive duration like 72h")
+	}
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	resultsIterator, err := APIstub.GetStateByRange(deviceRangeStartKey, deviceRangeEndKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	inactive := []InactiveDevice{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		device := DeviceInfo{}
+		if json.Unmarshal(queryResponse.Value, &device) != nil {
+			continue
+		}
+		if !device.ValidationFlag || device.Status == deviceProvisioned {
+			continue
+		}
+		status, _, err := getDeviceStatus(APIstub, queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if status.LastSeen.After(txTime.Add(-duration)) {
+			continue
+		}
+		status.pruneMessages(txTime)
+		inactive = append(inactive, InactiveDevice{DeviceStatus: status, Owner: device.Owner})
+	}
+	sort.Slice(inactive, func(i, j int) bool {
+		return deviceNumber(inactive[i].DeviceId) < deviceNumber(inactive[j].DeviceId)
+	})
+
+	inactiveAsBytes, _ := json.Marshal(inactive)
+	fmt.Printf("- getInactiveDevices:\n%s\n", inactiveAsBytes)
+	return shim.Success(inactiveAsBytes)
+}
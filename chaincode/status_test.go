@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// builds a signed status frame and returns the reportHeartbeat arguments
+func buildTestHeartbeat(priv ed25519.PrivateKey, deviceId uint16, ts time.Time, millivolts uint16, rssi int8, firmware string) [][]byte {
+	frame := []byte{171, byte(deviceId >> 8), byte(deviceId), 0, 0, 0, 0, 0, 0, byte(rssi), byte(len(firmware))}
+	binary.BigEndian.PutUint32(frame[3:7], uint32(ts.Unix()))
+	binary.BigEndian.PutUint16(frame[7:9], millivolts)
+	frame = append(frame, firmware...)
+	return [][]byte{
+		[]byte("reportHeartbeat"),
+		[]byte(base64.StdEncoding.EncodeToString(frame)),
+		[]byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, frame))),
+	}
+}
+
+func TestRollingMessageCount(t *testing.T) {
+	status := DeviceStatus{}
+	start := time.Date(2019, 7, 6, 10, 15, 0, 0, time.UTC)
+	for _, offset := range []time.Duration{0, 10 * time.Minute, 2 * time.Hour, 20 * time.Hour} {
+		status.countMessage(start.Add(offset))
+	}
+	if status.MessageCount != 4 || status.MessagesLast24h != 4 || len(status.RecentMessages) != 3 {
+		t.Errorf("Counts were incorrect, got: %+v", status)
+	}
+	status.countMessage(start.Add(25 * time.Hour))
+	if status.MessageCount != 5 || status.MessagesLast24h != 3 {
+		t.Errorf("Expected the messages of the first hour to drop out, got: %+v", status)
+	}
+	status.pruneMessages(start.Add(48 * time.Hour))
+	if status.MessagesLast24h != 1 || status.MessageCount != 5 {
+		t.Errorf("Expected only the last message within 24 hours, got: %+v", status)
+	}
+}
+
+func TestDeviceStatus(t *testing.T) {
+	stub := newTestStub()
+	priv1 := registerTestDevice(stub, 1, "org1")
+	priv2 := registerTestDevice(stub, 2, "org2")
+	registerTestDevice(stub, 3, "org1")
+	ts := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	if response := stub.invoke("m1", buildTestMeasurement(priv1, 1, 1, 20, ts, "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	if response := stub.invoke("h1", buildTestHeartbeat(priv2, 2, ts, 3712, -97, "1.4.2")); response.Message != "" {
+		t.Fatalf("reportHeartbeat failed: %s", response.Message)
+	}
+	if response := stub.invoke("h2", buildTestHeartbeat(priv2, 2, ts, 3712, -97, "1.4.2")); response.Message == "" {
+		t.Errorf("Expected a replayed heartbeat to be rejected")
+	}
+	if response := stub.invoke("h3", buildTestHeartbeat(priv1, 2, ts.Add(time.Minute), 3712, -97, "1.4.2")); response.Message == "" {
+		t.Errorf("Expected a heartbeat with an invalid signature to be rejected")
+	}
+
+	response := stub.invoke("q1", [][]byte{[]byte("getDeviceStatus"), []byte("DEVICE2")})
+	status := DeviceStatus{}
+	json.Unmarshal(response.Payload, &status)
+	if status.BatteryVoltage != 3.712 || status.RSSI != -97 || status.Firmware != "1.4.2" || !status.LastHeartbeat.Equal(ts) || status.MessageCount != 1 || status.LastSeen.IsZero() {
+		t.Errorf("Status of DEVICE2 was incorrect, got: %s", response.Payload)
+	}
+	response = stub.invoke("q2", [][]byte{[]byte("getDeviceStatus"), []byte("DEVICE1")})
+	status = DeviceStatus{}
+	json.Unmarshal(response.Payload, &status)
+	if !status.LastMeasurement.Equal(ts) || status.MessageCount != 1 || status.MessagesLast24h != 1 {
+		t.Errorf("Status of DEVICE1 was incorrect, got: %s", response.Payload)
+	}
+
+	// DEVICE2 was last seen three days ago
+	stub.MockTransactionStart("setup")
+	statusKey, _ := stub.CreateCompositeKey(deviceStatusKey, []string{"DEVICE2"})
+	statusAsBytes, _ := json.Marshal(DeviceStatus{DeviceId: "DEVICE2", LastSeen: time.Now().UTC().Add(-72 * time.Hour)})
+	stub.PutState(statusKey, statusAsBytes)
+	stub.MockTransactionEnd("setup")
+
+	response = stub.invoke("q3", [][]byte{[]byte("getInactiveDevices"), []byte("24h")})
+	inactive := []InactiveDevice{}
+	json.Unmarshal(response.Payload, &inactive)
+	if len(inactive) != 2 || inactive[0].DeviceId != "DEVICE2" || inactive[0].Owner != "org2" || inactive[1].DeviceId != "DEVICE3" || !inactive[1].LastSeen.IsZero() {
+		t.Errorf("Expected DEVICE2 and the never seen DEVICE3 to be inactive, got: %s %s", response.Message, response.Payload)
+	}
+	if response := stub.invoke("q4", [][]byte{[]byte("getInactiveDevices"), []byte("7")}); response.Message == "" {
+		t.Errorf("Expected a duration without unit to be rejected")
+	}
+}
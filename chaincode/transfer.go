@@ -0,0 +1,277 @@
+package main
+
+/*
+ * Two-party transfer of a device between organizations.
+ * An admin of the owning organization proposes the transfer, an admin of the receiving
+ * organization accepts it. Either of them may cancel a pending transfer. Accepting changes the
+ * owner of the device, so the transaction also needs an endorsement of the previous owner
+ * because of the key-level endorsement policy of the device (see endorsement.go).
+ *
+ * The device ID stays the same. Every measurement records the owner at the time it was taken,
+ * so measurements recorded before a transfer stay attributed to the previous owner.
+ * The owner details of devices with a private location are personal data of the previous owner
+ * and are deleted from its collection, the new owner sets its own with setDeviceOwnerDetails.
+ * The precise locations of earlier measurements stay in the collection of the previous owner.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	pendingTransferKey = "transfer~deviceId"
+	transferHistoryKey = "transferHistory~deviceId~txId"
+)
+
+// transfer states
+const (
+	transferProposed  = "proposed"
+	transferAccepted  = "accepted"
+	transferCancelled = "cancelled"
+)
+
+// Define the device transfer structure, a pending or closed change of the device owner
+type DeviceTransfer struct {
+	DeviceId   string    `json:"deviceId"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Status     string    `json:"status"`
+	ProposedBy string    `json:"proposedBy"`
+	ProposedAt time.Time `json:"proposedAt"`
+	ClosedBy   string    `json:"closedBy,omitempty"`
+	ClosedAt   time.Time `json:"closedAt"`
+}
+
+// returns the owner a measurement is attributed to
+// measurements recorded before transfers existed belong to the owner at registration
+func measurementOwner(data SensorData, device DeviceInfo) string {
+	if data.Owner != "" {
+		return data.Owner
+	}
+	if device.OriginalOwner != "" {
+		return device.OriginalOwner
+	}
+	return device.Owner
+}
+
+// returns the pending transfer of the device, nil if there is none
+func getPendingTransfer(APIstub shim.ChaincodeStubInterface, deviceId string) (*DeviceTransfer, string, error) {
+	transferKey, err := APIstub.CreateCompositeKey(pendingTransferKey, []string{deviceId})
+	if err != nil {
+		return nil, "", err
+	}
+	transferAsBytes, err := APIstub.GetState(transferKey)
+	if err != nil {
+		return nil, "", err
+	}
+	if transferAsBytes == nil {
+		return nil, transferKey, nil
+	}
+	transfer := DeviceTransfer{}
+	if err := json.Unmarshal(transferAsBytes, &transfer); err != nil {
+		return nil, "", err
+	}
+	return &transfer, transferKey, nil
+}
+
+// moves the pending transfer into the transfer history
+func closeTransfer(APIstub shim.ChaincodeStubInterface, transfer DeviceTransfer, transferKey, status, mspId string) error {
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return err
+	}
+	transfer.Status = status
+	transfer.ClosedBy = mspId
+	transfer.ClosedAt = txTime
+	historyKey, err := APIstub.CreateCompositeKey(transferHistoryKey, []string{transfer.DeviceId, APIstub.GetTxID()})
+	if err != nil {
+		return err
+	}
+	transferAsBytes, _ := json.Marshal(transfer)
+	if err := APIstub.PutState(historyKey, transferAsBytes); err != nil {
+		return err
+	}
+	return APIstub.DelState(transferKey)
+}
+
+// expects deviceId and the receiving owner, e.g. org2
+func (s *SmartContract) proposeTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	deviceAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if deviceAsBytes == nil {
+		return shim.Error("Device " + args[0] + " does not exist")
+	}
+	device := DeviceInfo{}
+	json.Unmarshal(deviceAsBytes, &device)
+	if !device.ValidationFlag {
+		return shim.Error("Device " + args[0] + " has been revoked")
+	}
+	admin, err := isOrganizationAdmin(APIstub, device.Owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !admin {
+		return shim.Error("Only an admin of the owner of " + args[0] + " may propose a transfer")
+	}
+	if args[1] == "" || ownerMSPID(args[1]) == ownerMSPID(device.Owner) {
+		return shim.Error("Invalid receiving owner " + args[1])
+	}
+	pending, transferKey, err := getPendingTransfer(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if pending != nil {
+		return shim.Error("There is already a pending transfer of " + args[0] + " to " + pending.To)
+	}
+	txTime, err := getTxTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspId, _ := getClientMSPID(APIstub)
+	transfer := DeviceTransfer{DeviceId: args[0], From: device.Owner, To: args[1], Status: transferProposed, ProposedBy: mspId, ProposedAt: txTime}
+	transferAsBytes, _ := json.Marshal(transfer)
+	if err := APIstub.PutState(transferKey, transferAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- proposeTransfer:\n%s\n", transferAsBytes)
+	return shim.Success(transferAsBytes)
+}
+
+// expects deviceId, changes the owner of the device to the receiving owner of the pending transfer
+func (s *SmartContract) acceptTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	transfer, transferKey, err := getPendingTransfer(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if transfer == nil {
+		return shim.Error("There is no pending transfer of " + args[0])
+	}
+	admin, err := isOrganizationAdmin(APIstub, transfer.To)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !admin {
+		return shim.Error("Only an admin of " + transfer.To + " may accept the transfer of " + args[0])
+	}
+	deviceAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	device := DeviceInfo{}
+	json.Unmarshal(deviceAsBytes, &device)
+	if !device.ValidationFlag {
+		return shim.Error("Device " + args[0] + " has been revoked")
+	}
+	if device.Status == deviceProvisioned {
+		return shim.Error("Device " + args[0] + " has not been claimed yet")
+	}
+	if device.Owner != transfer.From {
+		return shim.Error("The owner of " + args[0] + " has changed since the transfer was proposed")
+	}
+	if device.PrivateLocation {
+		if err := APIstub.DelPrivateData(privateCollectionName(ownerMSPID(device.Owner)), args[0]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	mspId, _ := getClientMSPID(APIstub)
+	if device.OriginalOwner == "" {
+		device.OriginalOwner = device.Owner
+	}
+	device.Owner = transfer.To
+	device.UpdatedBy = mspId
+	deviceAsBytes, _ = json.Marshal(device)
+	if err := APIstub.PutState(args[0], deviceAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := setDeviceEndorsementPolicy(APIstub, args[0], ownerMSPID(device.Owner)); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := closeTransfer(APIstub, *transfer, transferKey, transferAccepted, mspId); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- acceptTransfer:\n%s\n", deviceAsBytes)
+	return shim.Success(deviceAsBytes)
+}
+
+// expects deviceId, withdraws (current owner) or declines (receiving owner) the pending transfer
+func (s *SmartContract) cancelTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	transfer, transferKey, err := getPendingTransfer(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if transfer == nil {
+		return shim.Error("There is no pending transfer of " + args[0])
+	}
+	fromAdmin, err := isOrganizationAdmin(APIstub, transfer.From)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	toAdmin, err := isOrganizationAdmin(APIstub, transfer.To)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !fromAdmin && !toAdmin {
+		return shim.Error("Only an admin of " + transfer.From + " or " + transfer.To + " may cancel the transfer of " + args[0])
+	}
+	mspId, _ := getClientMSPID(APIstub)
+	if err := closeTransfer(APIstub, *transfer, transferKey, transferCancelled, mspId); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// expects deviceId, returns all closed transfers and the pending one, if any, ordered by proposal time
+func (s *SmartContract) getTransferHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(transferHistoryKey, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	transfers := []DeviceTransfer{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		transfer := DeviceTransfer{}
+		if json.Unmarshal(queryResponse.Value, &transfer) != nil {
+			continue
+		}
+		transfers = append(transfers, transfer)
+	}
+	sort.SliceStable(transfers, func(i, j int) bool {
+		return transfers[i].ProposedAt.Before(transfers[j].ProposedAt)
+	})
+	pending, _, err := getPendingTransfer(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if pending != nil {
+		transfers = append(transfers, *pending)
+	}
+
+	transfersAsBytes, _ := json.Marshal(transfers)
+	fmt.Printf("- getTransferHistory:\n%s\n", transfersAsBytes)
+	return shim.Success(transfersAsBytes)
+}
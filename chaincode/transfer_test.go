@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceTransfer(t *testing.T) {
+	stub := newTestStub()
+	priv := registerTestDevice(stub, 1, "org1")
+	ts := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	if response := stub.invoke("m1", buildTestMeasurement(priv, 1, 1, 20, ts, "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+
+	response := stub.invoke("tx1", [][]byte{[]byte("proposeTransfer"), []byte("DEVICE1"), []byte("org2")})
+	if !strings.HasPrefix(response.Message, "Only an admin") {
+		t.Errorf("Expected a non-admin proposal to be rejected, got: %s", response.Message)
+	}
+	stub.setCaller("Org2MSP", "Admin@org2.example.com")
+	response = stub.invoke("tx2", [][]byte{[]byte("proposeTransfer"), []byte("DEVICE1"), []byte("org2")})
+	if !strings.HasPrefix(response.Message, "Only an admin") {
+		t.Errorf("Expected a proposal by the receiving admin to be rejected, got: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "Admin@org1.example.com")
+	response = stub.invoke("tx3", [][]byte{[]byte("proposeTransfer"), []byte("DEVICE1"), []byte("org2")})
+	if response.Message != "" {
+		t.Fatalf("proposeTransfer failed: %s", response.Message)
+	}
+	response = stub.invoke("tx4", [][]byte{[]byte("proposeTransfer"), []byte("DEVICE1"), []byte("org2")})
+	if !strings.HasPrefix(response.Message, "There is already a pending transfer") {
+		t.Errorf("Expected a second proposal to be rejected, got: %s", response.Message)
+	}
+	response = stub.invoke("tx5", [][]byte{[]byte("acceptTransfer"), []byte("DEVICE1")})
+	if !strings.HasPrefix(response.Message, "Only an admin of org2") {
+		t.Errorf("Expected the proposing admin not to be able to accept, got: %s", response.Message)
+	}
+
+	stub.setCaller("Org2MSP", "Admin@org2.example.com")
+	response = stub.invoke("tx6", [][]byte{[]byte("acceptTransfer"), []byte("DEVICE1")})
+	if response.Message != "" {
+		t.Fatalf("acceptTransfer failed: %s", response.Message)
+	}
+	device := DeviceInfo{}
+	json.Unmarshal(stub.State["DEVICE1"], &device)
+	if device.Owner != "org2" || device.OriginalOwner != "org1" || device.UpdatedBy != "Org2MSP" {
+		t.Errorf("Device was not transferred, got: %+v", device)
+	}
+	orgs, _ := getDeviceEndorsementOrgs(stub, "DEVICE1")
+	if len(orgs) != 1 || orgs[0] != "Org2MSP" {
+		t.Errorf("Expected the endorsement policy to require the new owner, got: %v", orgs)
+	}
+
+	stub.invoke("m2", buildTestMeasurement(priv, 1, 2, 20, ts.Add(time.Hour), "0490033624N", "00082531116E"))
+	for uuid, owner := range map[string]string{"8017480121707248c4601288a1543101": "org1", "8017480121707248c4601288a1543102": "org2"} {
+		data := SensorData{}
+		json.Unmarshal(stub.State[uuid], &data)
+		if data.Owner != owner {
+			t.Errorf("Measurement %s should be attributed to %s, got: %s", uuid, owner, data.Owner)
+		}
+	}
+
+	response = stub.invoke("tx7", [][]byte{[]byte("proposeTransfer"), []byte("DEVICE1"), []byte("org1")})
+	if response.Message != "" {
+		t.Fatalf("proposeTransfer failed: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "Admin@org1.example.com")
+	response = stub.invoke("tx8", [][]byte{[]byte("cancelTransfer"), []byte("DEVICE1")})
+	if response.Message != "" {
+		t.Fatalf("Expected the receiving admin to be able to decline, got: %s", response.Message)
+	}
+
+	response = stub.invoke("tx9", [][]byte{[]byte("getTransferHistory"), []byte("DEVICE1")})
+	transfers := []DeviceTransfer{}
+	json.Unmarshal(response.Payload, &transfers)
+	if len(transfers) != 2 || transfers[0].Status != transferAccepted || transfers[1].Status != transferCancelled || transfers[1].ClosedBy != "Org1MSP" {
+		t.Errorf("Unexpected transfer history: %s", string(response.Payload))
+	}
+	if _, key, _ := getPendingTransfer(stub, "DEVICE1"); stub.State[key] != nil {
+		t.Errorf("Expected no pending transfer after cancellation")
+	}
+}
+
+func TestAcceptTransferOfPrivateDevice(t *testing.T) {
+	stub := newTestStub()
+	registerTestDevice(stub, 1, "org1")
+	stub.setCaller("Org1MSP", "Admin@org1.example.com")
+	stub.transient = map[string][]byte{ownerDetailsTransientKey: []byte(`{"name":"Jane Doe","address":"Kaiserstr. 12","lat":49.0056,"lon":8.4218}`)}
+	if response := stub.invoke("tx1", [][]byte{[]byte("setDeviceOwnerDetails"), []byte("DEVICE1")}); response.Message != "" {
+		t.Fatalf("setDeviceOwnerDetails failed: %s", response.Message)
+	}
+	stub.transient = nil
+	if response := stub.invoke("tx2", [][]byte{[]byte("proposeTransfer"), []byte("DEVICE1"), []byte("org2")}); response.Message != "" {
+		t.Fatalf("proposeTransfer failed: %s", response.Message)
+	}
+
+	// revoked while the transfer is pending
+	device := DeviceInfo{}
+	json.Unmarshal(stub.State["DEVICE1"], &device)
+	device.ValidationFlag = false
+	deviceAsBytes, _ := json.Marshal(device)
+	stub.MockTransactionStart("revoke")
+	stub.PutState("DEVICE1", deviceAsBytes)
+	stub.MockTransactionEnd("revoke")
+	stub.setCaller("Org2MSP", "Admin@org2.example.com")
+	if response := stub.invoke("tx3", [][]byte{[]byte("acceptTransfer"), []byte("DEVICE1")}); !strings.HasSuffix(response.Message, "has been revoked") {
+		t.Errorf("Expected the transfer of a revoked device to be rejected, got: %s", response.Message)
+	}
+
+	device.ValidationFlag = true
+	deviceAsBytes, _ = json.Marshal(device)
+	stub.MockTransactionStart("restore")
+	stub.PutState("DEVICE1", deviceAsBytes)
+	stub.MockTransactionEnd("restore")
+	if response := stub.invoke("tx4", [][]byte{[]byte("acceptTransfer"), []byte("DEVICE1")}); response.Message != "" {
+		t.Fatalf("acceptTransfer failed: %s", response.Message)
+	}
+	if stub.PvtState["collectionOrg1Private"]["DEVICE1"] != nil {
+		t.Errorf("Owner details of the previous owner were not deleted")
+	}
+}
+
+func TestOwnerSelectorIncludesLegacyMeasurements(t *testing.T) {
+	queryString, _ := buildMeasurementSelector(MeasurementQuery{Owner: "org1"}, nil, []string{"DEVICE1"})
+	expected := `{"selector":{"$or":[{"owner":"org1"},{"deviceId":{"$in":["DEVICE1"]},"owner":{"$exists":false}}],"docType":"measurement","tsdeviceEpoch":{"$exists":true}},"use_index":["_design/indexMeasurementDateDoc"]}`
+	if queryString != expected {
+		t.Errorf("Selector was incorrect, got: %s, want: %s", queryString, expected)
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+/*
+ * Monitoring zones, e.g. districts, defined by admins as a polygon, an explicit list of devices
+ * or both. Polygons are given in GeoJSON order as [lon, lat] vertices, the ring may be closed.
+ * Devices are assigned to the polygon zones containing their location. registerMeasurement
+ * reassigns a device once its newest measurement reports a new location, defining a zone assigns
+ * all devices by their last known location. Membership is indexed as zoneMember~zoneId~deviceId,
+ * the zones of a device are kept in its assignment record.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	zoneKey           = "zone~zoneId"
+	zoneMemberIndex   = "zoneMember~zoneId~deviceId"
+	zoneAssignmentKey = "zoneAssignment~deviceId"
+)
+
+// Define the zone structure
+type Zone struct {
+	Id        string      `json:"id"`
+	Name      string      `json:"name,omitempty"`
+	Polygon   [][]float64 `json:"polygon,omitempty"`
+	DeviceIds []string    `json:"deviceIds,omitempty"`
+	DefinedBy string      `json:"definedBy,omitempty"` // organization whose admins may replace the zone
+	UpdatedBy string      `json:"updatedBy,omitempty"`
+}
+
+// Define the zone assignment structure, the polygon zones containing the location of a device
+type ZoneAssignment struct {
+	DeviceId string   `json:"deviceId"`
+	Geohash  string   `json:"geohash"`
+	Zones    []string `json:"zones"`
+}
+
+// Define the zone statistics structure, the statistics of a quantity over all readings of a zone
+type ZoneStatistics struct {
+	Mean  float64 `json:"mean"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+// Define the zone aggregate structure, DeviceCount counts the devices of the zone, ReportingDevices those with readings
+type ZoneAggregate struct {
+	ZoneId           string                     `json:"zoneId"`
+	From             string                     `json:"from"`
+	To               string                     `json:"to"`
+	DeviceCount      int                        `json:"deviceCount"`
+	ReportingDevices int                        `json:"reportingDevices"`
+	Quantities       map[string]*ZoneStatistics `json:"quantities"`
+}
+
+// checks the polygon has at least three vertices with valid coordinates
+func validatePolygon(polygon [][]float64) error {
+	if len(polygon) < 3 {
+		return errors.New("A polygon needs at least three vertices")
+	}
+	for _, vertex := range polygon {
+		if len(vertex) != 2 || vertex[0] < -180 || vertex[0] > 180 || vertex[1] < -90 || vertex[1] > 90 {
+			return fmt.Errorf("Invalid vertex %v. Expecting [lon, lat]", vertex)
+		}
+	}
+	return nil
+}
+
+// checks whether the point lies inside the polygon by casting a ray towards increasing longitude
+func polygonContains(polygon [][]float64, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		xi, yi := polygon[i][0], polygon[i][1]
+		xj, yj := polygon[j][0], polygon[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// returns the zone, an error if it does not exist
+func getZone(APIstub shim.ChaincodeStubInterface, zoneId string) (Zone, error) {
+	key, err := APIstub.CreateCompositeKey(zoneKey, []string{zoneId})
+	if err != nil {
+		return Zone{}, err
+	}
+	zoneAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return Zone{}, err
+	}
+	if zoneAsBytes == nil {
+		return Zone{}, errors.New("Zone " + zoneId + " does not exist")
+	}
+	zone := Zone{}
+	if err := json.Unmarshal(zoneAsBytes, &zone); err != nil {
+		return Zone{}, err
+	}
+	return zone, nil
+}
+
+// returns all zones
+func getZones(APIstub shim.ChaincodeStubInterface) ([]Zone, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(zoneKey, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	zones := []Zone{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		zone := Zone{}
+		if json.Unmarshal(queryResponse.Value, &zone) != nil {
+			continue
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// returns the listed devices of the zone and the devices assigned by location, ordered by device number
+func getZoneDeviceIds(APIstub shim.ChaincodeStubInterface, zone Zone) ([]string, error) {
+	seen := make(map[string]bool)
+	deviceIds := []string{}
+	for _, deviceId := range zone.DeviceIds {
+		if !seen[deviceId] {
+			seen[deviceId] = true
+			deviceIds = append(deviceIds, deviceId)
+		}
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(zoneMemberIndex, []string{zone.Id})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attributes, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[attributes[1]] {
+			seen[attributes[1]] = true
+			deviceIds = append(deviceIds, attributes[1])
+		}
+	}
+	sort.Slice(deviceIds, func(i, j int) bool {
+		return deviceNumber(deviceIds[i]) < deviceNumber(deviceIds[j])
+	})
+	return deviceIds, nil
+}
+
+// returns the assignment of the device, an empty assignment if it has none
+func getZoneAssignment(APIstub shim.ChaincodeStubInterface, deviceId string) (ZoneAssignment, string, error) {
+	key, err := APIstub.CreateCompositeKey(zoneAssignmentKey, []string{deviceId})
+	if err != nil {
+		return ZoneAssignment{}, "", err
+	}
+	assignmentAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return ZoneAssignment{}, "", err
+	}
+	assignment := ZoneAssignment{DeviceId: deviceId, Zones: []string{}}
+	if assignmentAsBytes != nil {
+		if err := json.Unmarshal(assignmentAsBytes, &assignment); err != nil {
+			return ZoneAssignment{}, "", err
+		}
+	}
+	return assignment, key, nil
+}
+
+// adds or removes the device from the members of the zone
+func setZoneMember(APIstub shim.ChaincodeStubInterface, zoneId, deviceId string, member bool) error {
+	memberKey, err := APIstub.CreateCompositeKey(zoneMemberIndex, []string{zoneId, deviceId})
+	if err != nil {
+		return err
+	}
+	if !member {
+		return APIstub.DelState(memberKey)
+	}
+	return APIstub.PutState(memberKey, []byte{0x00})
+}
+
+// reassigns the device to the polygon zones containing its new location
+func assignDeviceZones(APIstub shim.ChaincodeStubInterface, data SensorData) error {
+	locationKey, err := APIstub.CreateCompositeKey(deviceLocationKey, []string{data.DeviceId})
+	if err != nil {
+		return err
+	}
+	locationAsBytes, err := APIstub.GetState(locationKey)
+	if err != nil {
+		return err
+	}
+	// only the newest measurement gives the location of the device
+	if locationAsBytes != nil {
+		location := DeviceLocation{}
+		if err := json.Unmarshal(locationAsBytes, &location); err == nil && !data.TSdevice.After(location.TSdevice) {
+			return nil
+		}
+	}
+	assignment, assignmentKey, err := getZoneAssignment(APIstub, data.DeviceId)
+	if err != nil {
+		return err
+	}
+	if assignment.Geohash == data.Geohash {
+		return nil
+	}
+	zones, err := getZones(APIstub)
+	if err != nil {
+		return err
+	}
+	previous := make(map[string]bool)
+	for _, zoneId := range assignment.Zones {
+		previous[zoneId] = true
+	}
+	assignment.Geohash = data.Geohash
+	assignment.Zones = []string{}
+	for _, zone := range zones {
+		inside := len(zone.Polygon) > 0 && polygonContains(zone.Polygon, data.Lat, data.Lon)
+		if inside {
+			assignment.Zones = append(assignment.Zones, zone.Id)
+		}
+		if inside != previous[zone.Id] {
+			if err := setZoneMember(APIstub, zone.Id, data.DeviceId, inside); err != nil {
+				return err
+			}
+		}
+	}
+	assignmentAsBytes, _ := json.Marshal(assignment)
+	return APIstub.PutState(assignmentKey, assignmentAsBytes)
+}
+
+// assigns all devices with a known location to the zone or removes them by its polygon
+func assignZoneDevices(APIstub shim.ChaincodeStubInterface, zone Zone) error {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(deviceLocationKey, []string{})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		location := DeviceLocation{}
+		if json.Unmarshal(queryResponse.Value, &location) != nil {
+			continue
+		}
+		assignment, assignmentKey, err := getZoneAssignment(APIstub, location.DeviceId)
+		if err != nil {
+			return err
+		}
+		inside := len(zone.Polygon) > 0 && polygonContains(zone.Polygon, location.Lat, location.Lon)
+		zones := []string{}
+		member := false
+		for _, zoneId := range assignment.Zones {
+			if zoneId == zone.Id {
+				member = true
+			} else {
+				zones = append(zones, zoneId)
+			}
+		}
+		if inside == member {
+			continue
+		}
+		if inside {
+			zones = append(zones, zone.Id)
+		}
+		assignment.Geohash = location.Geohash
+		assignment.Zones = zones
+		if err := setZoneMember(APIstub, zone.Id, location.DeviceId, inside); err != nil {
+			return err
+		}
+		assignmentAsBytes, _ := json.Marshal(assignment)
+		if err := APIstub.PutState(assignmentKey, assignmentAsBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aggregates the PM readings of the zone, calibrated values replace raw values where available
+func aggregateZone(measurements []SensorData) (map[string]*ZoneStatistics, int) {
+	quantities := make(map[string]*ZoneStatistics)
+	devices := make(map[string]bool)
+	for _, data := range measurements {
+		values := complianceValues(data)
+		for _, quantity := range []string{quantityPm10, quantityPm25} {
+			value, ok := values[quantity]
+			if !ok {
+				continue
+			}
+			statistics, ok := quantities[quantity]
+			if !ok {
+				statistics = &ZoneStatistics{Max: value}
+				quantities[quantity] = statistics
+			}
+			// Mean holds the sum until all readings are added
+			statistics.Mean = statistics.Mean + value
+			statistics.Count++
+			if value > statistics.Max {
+				statistics.Max = value
+			}
+			devices[data.DeviceId] = true
+		}
+	}
+	for _, statistics := range quantities {
+		statistics.Mean = statistics.Mean / float64(statistics.Count)
+	}
+	return quantities, len(devices)
+}
+
+/*
+ * Expects the zone as JSON object with a polygon, a device list or both, e.g.
+ * {"id":"stuttgart-mitte","name":"Stuttgart-Mitte","polygon":[[9.16,48.77],[9.19,48.77],[9.19,48.79],[9.16,48.79]]}
+ * Replaces an existing zone with the same ID, if it was defined by the organization of the caller.
+ * Only admins may define zones.
+ */
+func (s *SmartContract) defineZone(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	admin, err := isClientAdmin(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !admin {
+		return shim.Error("Only admins may define zones")
+	}
+	zone := Zone{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(args[0])))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&zone); err != nil {
+		return shim.Error("Invalid zone: " + err.Error())
+	}
+	if zone.Id == "" {
+		return shim.Error("Expecting a zone ID")
+	}
+	if len(zone.Polygon) == 0 && len(zone.DeviceIds) == 0 {
+		return shim.Error("Expecting a polygon or a list of devices")
+	}
+	if len(zone.Polygon) > 0 {
+		if err := validatePolygon(zone.Polygon); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	for _, deviceId := range zone.DeviceIds {
+		if _, err := getDevice(APIstub, deviceId); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	mspId, err := getClientMSPID(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key, err := APIstub.CreateCompositeKey(zoneKey, []string{zone.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	existingAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	zone.DefinedBy = mspId
+	if existingAsBytes != nil {
+		existing := Zone{}
+		if err := json.Unmarshal(existingAsBytes, &existing); err != nil {
+			return shim.Error(err.Error())
+		}
+		// zones defined before the defining organization was recorded belong to the last updater
+		if existing.DefinedBy == "" {
+			existing.DefinedBy = existing.UpdatedBy
+		}
+		if existing.DefinedBy != "" && existing.DefinedBy != mspId {
+			return shim.Error("Zone " + zone.Id + " was defined by " + existing.DefinedBy + ", only its admins may replace it")
+		}
+	}
+	zone.UpdatedBy = mspId
+	zoneAsBytes, _ := json.Marshal(zone)
+	if err := APIstub.PutState(key, zoneAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := assignZoneDevices(APIstub, zone); err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- defineZone:\n%s\n", zoneAsBytes)
+	return shim.Success(zoneAsBytes)
+}
+
+// expects zoneId, returns the zone with all of its devices
+func (s *SmartContract) getZone(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	zone, err := getZone(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	zone.DeviceIds, err = getZoneDeviceIds(APIstub, zone)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	zoneAsBytes, _ := json.Marshal(zone)
+	return shim.Success(zoneAsBytes)
+}
+
+// expects deviceId, returns the IDs of the zones the device belongs to
+func (s *SmartContract) getDeviceZones(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	assignment, _, err := getZoneAssignment(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	zones, err := getZones(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	zoneIds := assignment.Zones
+	for _, zone := range zones {
+		for _, deviceId := range zone.DeviceIds {
+			if deviceId == args[0] && !containsString(zoneIds, zone.Id) {
+				zoneIds = append(zoneIds, zone.Id)
+			}
+		}
+	}
+	sort.Strings(zoneIds)
+	zoneIdsAsBytes, _ := json.Marshal(zoneIds)
+	return shim.Success(zoneIdsAsBytes)
+}
+
+// formats a bound of a time window in UTC, open bounds stay empty
+func formatWindowBound(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+/*
+ * Expects zoneId and the time window from, to as timestamps, returns the mean and maximum of
+ * PM10 and PM2.5 over the valid readings of the zone devices and the number of devices.
+ * The window is returned in UTC.
+ */
+func (s *SmartContract) getZoneAggregates(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	from, err := parseTimeArg(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	to, err := parseTimeArg(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	zone, err := getZone(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	deviceIds, err := getZoneDeviceIds(APIstub, zone)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// the window is selected on the numeric device timestamp, see buildMeasurementSelector
+	aggregate := ZoneAggregate{ZoneId: zone.Id, From: formatWindowBound(from), To: formatWindowBound(to), DeviceCount: len(deviceIds), Quantities: map[string]*ZoneStatistics{}}
+	// an empty device list would select the measurements of all devices
+	if len(deviceIds) > 0 {
+		records, err := queryMeasurementRecords(APIstub, MeasurementQuery{DeviceIds: deviceIds, From: aggregate.From, To: aggregate.To, ExcludeInvalidated: true})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		measurements := []SensorData{}
+		for _, record := range records {
+			data := SensorData{}
+			if json.Unmarshal(record.Record, &data) == nil {
+				measurements = append(measurements, data)
+			}
+		}
+		aggregate.Quantities, aggregate.ReportingDevices = aggregateZone(measurements)
+	}
+	aggregateAsBytes, _ := json.Marshal(aggregate)
+	fmt.Printf("- getZoneAggregates:\n%s\n", aggregateAsBytes)
+	return shim.Success(aggregateAsBytes)
+}
+
+// checks whether the list contains the value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
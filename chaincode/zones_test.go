@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPolygonContains(t *testing.T) {
+	// U-shaped polygon open to the north
+	polygon := [][]float64{{0, 0}, {3, 0}, {3, 3}, {2, 3}, {2, 1}, {1, 1}, {1, 3}, {0, 3}, {0, 0}}
+	tests := []struct {
+		lat, lon float64
+		expected bool
+	}{
+		{0.5, 0.5, true},
+		{2, 0.5, true},
+		{2, 1.5, false},
+		{2, 2.5, true},
+		{4, 1.5, false},
+		{0.5, -1, false},
+	}
+	for _, test := range tests {
+		if polygonContains(polygon, test.lat, test.lon) != test.expected {
+			t.Errorf("Containment of %g, %g was incorrect, want: %v", test.lat, test.lon, test.expected)
+		}
+	}
+	if validatePolygon([][]float64{{0, 0}, {1, 1}}) == nil || validatePolygon([][]float64{{0, 0}, {1, 1}, {200, 1}}) == nil {
+		t.Errorf("Expected invalid polygons to be rejected")
+	}
+}
+
+func TestAggregateZone(t *testing.T) {
+	measurements := []SensorData{
+		{DeviceId: "DEVICE1", Pm10: 10, Pm25: 5},
+		{DeviceId: "DEVICE1", Pm10: 30, Pm25: 7, Calibrated: []CalibratedValue{{Quantity: quantityPm25, Raw: 7, Value: 6}}},
+		{DeviceId: "DEVICE2", Pm10: 50, Pm25: 1},
+	}
+	quantities, devices := aggregateZone(measurements)
+	if devices != 2 || *quantities[quantityPm10] != (ZoneStatistics{Mean: 30, Max: 50, Count: 3}) || *quantities[quantityPm25] != (ZoneStatistics{Mean: 4, Max: 6, Count: 3}) {
+		t.Errorf("Zone aggregate was incorrect, got: %d %+v %+v", devices, quantities[quantityPm10], quantities[quantityPm25])
+	}
+}
+
+func TestFormatWindowBound(t *testing.T) {
+	if bound := formatWindowBound(time.Date(2019, 7, 1, 2, 0, 0, 500000000, time.FixedZone("CEST", 2*60*60))); bound != "2019-07-01T00:00:00.5Z" {
+		t.Errorf("Window bound was incorrect, got: %s", bound)
+	}
+	if bound := formatWindowBound(time.Time{}); bound != "" {
+		t.Errorf("Expected an open bound to stay empty, got: %s", bound)
+	}
+}
+
+func TestZones(t *testing.T) {
+	stub := newTestStub()
+	priv1 := registerTestDevice(stub, 1, "org1")
+	priv2 := registerTestDevice(stub, 2, "org2")
+	registerTestDevice(stub, 3, "org2")
+	ts := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	if response := stub.invoke("m1", buildTestMeasurement(priv1, 1, 1, 20, ts, "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+
+	karlsruhe := `{"id":"karlsruhe","name":"Karlsruhe","polygon":[[8.3,48.9],[8.5,48.9],[8.5,49.1],[8.3,49.1]]}`
+	if response := stub.invoke("z1", [][]byte{[]byte("defineZone"), []byte(karlsruhe)}); response.Message != "Only admins may define zones" {
+		t.Errorf("Expected a non-admin to be rejected, got: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "Admin@org1.example.com")
+	if response := stub.invoke("z2", [][]byte{[]byte("defineZone"), []byte(`{"id":"empty"}`)}); response.Message == "" {
+		t.Errorf("Expected a zone without polygon and devices to be rejected")
+	}
+	if response := stub.invoke("z3", [][]byte{[]byte("defineZone"), []byte(karlsruhe)}); response.Message != "" {
+		t.Fatalf("defineZone failed: %s", response.Message)
+	}
+	if response := stub.invoke("z4", [][]byte{[]byte("defineZone"), []byte(`{"id":"network","deviceIds":["DEVICE2","DEVICE3"]}`)}); response.Message != "" {
+		t.Fatalf("defineZone failed: %s", response.Message)
+	}
+	stub.setCaller("Org2MSP", "Admin@org2.example.com")
+	if response := stub.invoke("z5", [][]byte{[]byte("defineZone"), []byte(`{"id":"karlsruhe","deviceIds":["DEVICE3"],"definedBy":"Org2MSP"}`)}); response.Message != "Zone karlsruhe was defined by Org1MSP, only its admins may replace it" {
+		t.Errorf("Expected an admin of another organization not to replace the zone, got: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "Admin@org1.example.com")
+	if response := stub.invoke("z6", [][]byte{[]byte("defineZone"), []byte(`{"id":"network","deviceIds":["DEVICE2","DEVICE3"]}`)}); response.Message != "" {
+		t.Errorf("Expected an admin of the defining organization to replace the zone, got: %s", response.Message)
+	}
+	stub.setCaller("Org1MSP", "User1@org1.example.com")
+
+	// DEVICE1 is assigned by its last known location, DEVICE2 by its first measurement
+	if response := stub.invoke("m2", buildTestMeasurement(priv2, 2, 2, 40, ts, "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	response := stub.invoke("q1", [][]byte{[]byte("getZone"), []byte("karlsruhe")})
+	zone := Zone{}
+	json.Unmarshal(response.Payload, &zone)
+	if !reflect.DeepEqual(zone.DeviceIds, []string{"DEVICE1", "DEVICE2"}) || zone.DefinedBy != "Org1MSP" || zone.UpdatedBy != "Org1MSP" {
+		t.Errorf("Zone was incorrect, got: %s %s", response.Message, response.Payload)
+	}
+	response = stub.invoke("q2", [][]byte{[]byte("getDeviceZones"), []byte("DEVICE2")})
+	zoneIds := []string{}
+	json.Unmarshal(response.Payload, &zoneIds)
+	if !reflect.DeepEqual(zoneIds, []string{"karlsruhe", "network"}) {
+		t.Errorf("Zones of DEVICE2 were incorrect, got: %s", response.Payload)
+	}
+
+	// DEVICE1 moves out of the zone, an older reading from within it is ignored
+	if response := stub.invoke("m3", buildTestMeasurement(priv1, 1, 3, 20, ts.Add(time.Minute), "0520000000N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	if response := stub.invoke("m4", buildTestMeasurement(priv1, 1, 4, 20, ts.Add(-time.Minute), "0490033624N", "00082531116E")); response.Message != "" {
+		t.Fatalf("registerMeasurement failed: %s", response.Message)
+	}
+	response = stub.invoke("q3", [][]byte{[]byte("getZone"), []byte("karlsruhe")})
+	zone = Zone{}
+	json.Unmarshal(response.Payload, &zone)
+	if !reflect.DeepEqual(zone.DeviceIds, []string{"DEVICE2"}) {
+		t.Errorf("Expected DEVICE1 to leave the zone, got: %s", response.Payload)
+	}
+
+	response = stub.invoke("q4", [][]byte{[]byte("getDailyMeans"), []byte(`{"zone":"network","quantity":"pm10","from":"2019-01-01","to":"2019-01-02"}`)})
+	means := DailyMeans{}
+	json.Unmarshal(response.Payload, &means)
+	if _, ok := means.Devices["DEVICE3"]; response.Message != "" || len(means.Devices) != 2 || !ok {
+		t.Errorf("Expected the daily means of the zone devices, got: %s %s", response.Message, response.Payload)
+	}
+}